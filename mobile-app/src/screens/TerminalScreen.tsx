@@ -20,7 +20,7 @@ import {
 } from 'react-native';
 import Icon from 'react-native-vector-icons/MaterialIcons';
 import { Device } from '../types/device';
-import { getSSHService, SSHConnectionConfig } from '../services/sshService';
+import { getSSHService, SSHAuthError, SSHConnectionConfig } from '../services/sshService';
 import { getANSIParser, ANSISegment } from '../utils/ansiParser';
 import { Header } from '../components/Header';
 import { colors, typography, spacing, borderRadius, shadows, getThemeColors } from '../styles/theme';
@@ -132,11 +132,11 @@ export const TerminalScreen: React.FC<TerminalScreenProps> = ({
         setOutput(prev => prev + `\n错误: ${error.message}\n`);
       });
       
-      sshService.onClose(newSessionId, () => {
-        setOutput(prev => prev + '\n连接已关闭。\n');
+      sshService.onClose(newSessionId, (reason) => {
+        setOutput(prev => prev + `\n连接已关闭${reason ? `：${reason}` : ''}。\n`);
         Alert.alert(
           '连接已关闭',
-          'SSH 连接已断开。',
+          reason || 'SSH 连接已断开。',
           [{ text: '确定', onPress: () => navigation.goBack() }]
         );
       });
@@ -160,6 +160,14 @@ export const TerminalScreen: React.FC<TerminalScreenProps> = ({
       setOutput(prev => prev + `\n连接失败: ${errorMessage}\n`);
       setConnecting(false);
       
+      if (error instanceof SSHAuthError) {
+        // Wrong password or verification code: ask again instead of leaving
+        setPassword('');
+        setNeedsPassword(true);
+        Alert.alert('认证失败', errorMessage, [{ text: '确定' }]);
+        return;
+      }
+      
       Alert.alert(
         '连接失败',
         errorMessage,
@@ -20,11 +20,24 @@ export interface SSHSession {
   ws?: WebSocket;
   buffer: string;
   heartbeatInterval?: NodeJS.Timeout; // 心跳定时器
+  exitReason?: string; // 远程 Shell 的退出状态，来自 exit 消息
 }
 
 export type SSHDataCallback = (data: string) => void;
 export type SSHErrorCallback = (error: Error) => void;
-export type SSHCloseCallback = () => void;
+export type SSHCloseCallback = (reason?: string) => void;
+
+/**
+ * Thrown when shadowd rejects the credentials, so the user can be asked again
+ */
+export class SSHAuthError extends Error {
+  constructor(message: string) {
+    super(message);
+    this.name = 'SSHAuthError';
+    // Keep instanceof working when classes are compiled to ES5
+    Object.setPrototypeOf(this, SSHAuthError.prototype);
+  }
+}
 
 export class SSHService {
   private sessions: Map<string, SSHSession> = new Map();
@@ -125,6 +138,12 @@ export class SSHService {
           const message = JSON.parse(event.data);
           
           switch (message.type) {
+            case 'hello':
+              console.log(
+                `shadowd protocol ${message.version}, capabilities: ${(message.capabilities || []).join(', ')}`
+              );
+              break;
+              
             case 'connected':
               clearTimeout(connectionTimeout);
               console.log('SSH connection established via proxy');
@@ -144,6 +163,7 @@ export class SSHService {
               break;
               
             case 'data':
+            case 'stderr':
               // Forward SSH output to all callbacks
               const callbacks = this.dataCallbacks.get(sessionId);
               if (callbacks) {
@@ -165,11 +185,36 @@ export class SSHService {
               }
               break;
               
+            case 'auth_failed':
+            case 'connect_failed':
+              // The connect request was refused; the server keeps the WebSocket open
+              console.log(`SSH ${message.type}:`, message.message);
+              clearTimeout(connectionTimeout);
+              ws.close();
+              reject(
+                message.type === 'auth_failed'
+                  ? new SSHAuthError(message.message)
+                  : new Error(message.message)
+              );
+              break;
+              
+            case 'exit':
+              if (message.signal) {
+                session.exitReason = `进程被信号 ${message.signal} 终止`;
+              } else if (message.exitCode !== undefined) {
+                session.exitReason = `进程已退出，退出码 ${message.exitCode}`;
+              } else {
+                session.exitReason = '进程已退出';
+              }
+              break;
+              
             case 'closed':
               console.log('SSH connection closed by server');
               const closeCallback = this.closeCallbacks.get(sessionId);
               if (closeCallback) {
-                closeCallback();
+                closeCallback(session.exitReason || message.message);
+                // Only report the close once, not again from onclose
+                this.closeCallbacks.delete(sessionId);
               }
               ws.close();
               break;
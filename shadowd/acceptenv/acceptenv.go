@@ -0,0 +1,18 @@
+package acceptenv
+
+import "path"
+
+// Default are the client variables accepted when AcceptEnv is not configured,
+// by the SSH server and the WebSocket proxy alike
+var Default = []string{"LANG", "LC_*", "TERM"}
+
+// Match reports whether name matches one of the patterns; "*" and "?" match
+// as in sshd_config
+func Match(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
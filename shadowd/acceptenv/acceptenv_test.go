@@ -0,0 +1,31 @@
+package acceptenv
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		variable string
+		want     bool
+	}{
+		{"exact", Default, "LANG", true},
+		{"wildcard", Default, "LC_ALL", true},
+		{"wildcard needs prefix", Default, "XLC_ALL", false},
+		{"not listed", Default, "LD_PRELOAD", false},
+		{"case-sensitive", Default, "lang", false},
+		{"single character", []string{"GIT_?"}, "GIT_X", true},
+		{"single character only", []string{"GIT_?"}, "GIT_XY", false},
+		{"anything", []string{"*"}, "PATH", true},
+		{"no patterns", nil, "LANG", false},
+		{"malformed pattern", []string{"[", "TERM"}, "TERM", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Match(tt.patterns, tt.variable); got != tt.want {
+				t.Errorf("Match(%q, %q) = %v, want %v", tt.patterns, tt.variable, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -11,8 +12,13 @@ import (
 type Config struct {
 	Headscale HeadscaleConfig `yaml:"headscale"`
 	SSH       SSHConfig       `yaml:"ssh"`
+	WebSocket WebSocketConfig `yaml:"websocket,omitempty"`
 	GRPC      GRPCConfig      `yaml:"grpc"`
 	Device    DeviceConfig    `yaml:"device"`
+	Lockout   LockoutConfig   `yaml:"lockout,omitempty"`
+	Sessions  SessionsConfig  `yaml:"sessions,omitempty"`
+	Jump      JumpConfig      `yaml:"jump,omitempty"`
+	Pairing   PairingConfig   `yaml:"pairing,omitempty"`
 }
 
 // HeadscaleConfig contains Headscale server connection settings
@@ -23,11 +29,90 @@ type HeadscaleConfig struct {
 
 // SSHConfig contains SSH server settings
 type SSHConfig struct {
-	Port               int               `yaml:"port"`
-	HostKeyPath        string            `yaml:"host_key_path"`
-	AuthorizedKeysPath string            `yaml:"authorized_keys_path"`
-	AllowedNetworks    []string          `yaml:"allowed_networks"`
-	Users              map[string]string `yaml:"users"` // username -> password
+	Port               int                         `yaml:"port"`
+	HostKeyPath        string                      `yaml:"host_key_path,omitempty"`
+	HostKeys           []string                    `yaml:"host_keys,omitempty"` // several host keys; replaces host_key_path
+	AuthorizedKeysPath string                      `yaml:"authorized_keys_path"`
+	KeysReloadInterval time.Duration               `yaml:"authorized_keys_reload_interval,omitempty"` // e.g. "5s"
+	AllowedNetworks    []string                    `yaml:"allowed_networks"`
+	Users              map[string]string           `yaml:"users"`                          // username -> password
+	PermitRootLogin    bool                        `yaml:"permit_root_login,omitempty"`    // allow logging in as root (uid 0)
+	TOTP               map[string]string           `yaml:"totp,omitempty"`                 // username -> base32 TOTP secret (second factor)
+	AcceptEnv          []string                    `yaml:"accept_env,omitempty"`           // client env variables passed to sessions (default LANG, LC_*, TERM)
+	TrustedUserCAKeys  string                      `yaml:"trusted_user_ca_keys,omitempty"` // file of CA public keys
+	RevokedCertSerials []uint64                    `yaml:"revoked_cert_serials,omitempty"` // refused certificate serials
+	SFTPRoots          map[string]string           `yaml:"sftp_roots,omitempty"`           // username (or "*") -> SFTP root, e.g. "%h"
+	PortForwarding     map[string]ForwardingConfig `yaml:"port_forwarding,omitempty"`      // username (or "*") -> policy
+	Recording          RecordingConfig             `yaml:"recording,omitempty"`
+	KeepAliveInterval  time.Duration               `yaml:"keepalive_interval,omitempty"`  // probe clients this often, e.g. "15s"; negative disables
+	KeepAliveCountMax  int                         `yaml:"keepalive_count_max,omitempty"` // unanswered probes before disconnecting (default 3)
+}
+
+// RecordingConfig contains asciicast session recording settings.
+// Recording is off unless Dir is set.
+type RecordingConfig struct {
+	Dir          string        `yaml:"dir,omitempty"`            // e.g. "/var/lib/shadowd/recordings"
+	RecordInput  bool          `yaml:"record_input,omitempty"`   // also record keystrokes, including typed passwords
+	MaxAge       time.Duration `yaml:"max_age,omitempty"`        // e.g. "720h"; 0 keeps recordings forever
+	MaxTotalSize int64         `yaml:"max_total_size,omitempty"` // bytes for all recordings; oldest are deleted first
+	MaxFileSize  int64         `yaml:"max_file_size,omitempty"`  // bytes per recording; recording stops at the cap
+}
+
+// ForwardingConfig lists "host:ports" rules, e.g. "127.0.0.1:3000-9000", for one user's port forwards
+type ForwardingConfig struct {
+	Local  []string `yaml:"local,omitempty"`  // destinations for ssh -L
+	Remote []string `yaml:"remote,omitempty"` // bind addresses for ssh -R
+}
+
+// WebSocketConfig contains WebSocket SSH proxy settings
+type WebSocketConfig struct {
+	ListenAddr           string        `yaml:"listen_addr,omitempty"`           // default "0.0.0.0:8022"
+	ResumeGracePeriod    time.Duration `yaml:"resume_grace_period,omitempty"`   // how long a dropped shell waits to be resumed, e.g. "5m"
+	ResumeBufferSize     int           `yaml:"resume_buffer_size,omitempty"`    // bytes of output kept per session for replay
+	PingInterval         time.Duration `yaml:"ping_interval,omitempty"`         // ping clients this often, e.g. "30s"; negative disables
+	PongTimeout          time.Duration `yaml:"pong_timeout,omitempty"`          // extra time a silent client gets after a ping (default "10s")
+	AllowedOrigins       []string      `yaml:"allowed_origins,omitempty"`       // browser origins besides our own, e.g. "https://app.example.com"
+	AllowUnauthenticated bool          `yaml:"allow_unauthenticated,omitempty"` // accept clients without a paired device's ticket
+}
+
+// LockoutConfig contains brute-force protection settings for SSH and WebSocket logins.
+// Zero values fall back to the defaults in the lockout package.
+type LockoutConfig struct {
+	Disabled    bool          `yaml:"disabled,omitempty"`
+	MaxFailures int           `yaml:"max_failures,omitempty"` // failures within window before a ban
+	Window      time.Duration `yaml:"window,omitempty"`       // e.g. "10m"
+	BanDuration time.Duration `yaml:"ban_duration,omitempty"` // e.g. "15m"
+	BaseDelay   time.Duration `yaml:"base_delay,omitempty"`   // delay after the first failure, doubled each time
+	MaxDelay    time.Duration `yaml:"max_delay,omitempty"`
+	Allowlist   []string      `yaml:"allowlist,omitempty"` // CIDRs never tracked, e.g. the Mesh range
+}
+
+// SessionsConfig contains session limits for SSH and WebSocket sessions.
+// Zero values disable the corresponding limit.
+type SessionsConfig struct {
+	IdleTimeout time.Duration `yaml:"idle_timeout,omitempty"` // no input or output for this long, e.g. "30m"
+	MaxLifetime time.Duration `yaml:"max_lifetime,omitempty"` // e.g. "12h"
+	Warning     time.Duration `yaml:"warning,omitempty"`      // warn the client this long before disconnecting (default "1m")
+	MaxPerUser  int           `yaml:"max_per_user,omitempty"` // concurrent sessions per username
+	MaxPerIP    int           `yaml:"max_per_ip,omitempty"`   // concurrent sessions per source IP
+}
+
+// JumpConfig lists the mesh peers SSH (ssh -J) and WebSocket clients may jump to.
+// Jumping is off unless Targets is set.
+type JumpConfig struct {
+	Targets []string `yaml:"targets,omitempty"` // CIDRs, IP addresses or device names, e.g. "100.64.0.0/10", "laptop"
+	Ports   []int    `yaml:"ports,omitempty"`   // default 22 and ssh.port
+
+	// KnownHosts holds the targets' host keys for the WebSocket proxy
+	// (default "jump_known_hosts" next to the host key)
+	KnownHosts string `yaml:"known_hosts,omitempty"`
+}
+
+// PairingConfig contains settings for paired devices and their WebSocket tickets
+type PairingConfig struct {
+	StatePath string        `yaml:"state_path,omitempty"` // default "paired_devices.json" next to the host key
+	CodeTTL   time.Duration `yaml:"code_ttl,omitempty"`   // how long a pairing code can be used (default "10m")
+	TicketTTL time.Duration `yaml:"ticket_ttl,omitempty"` // how long a ticket is valid (default "1m")
 }
 
 // GRPCConfig contains gRPC server settings
@@ -72,8 +157,8 @@ func (c *Config) Validate() error {
 	if c.SSH.Port <= 0 || c.SSH.Port > 65535 {
 		return fmt.Errorf("ssh.port must be between 1 and 65535")
 	}
-	if c.SSH.HostKeyPath == "" {
-		return fmt.Errorf("ssh.host_key_path is required")
+	if c.SSH.HostKeyPath == "" && len(c.SSH.HostKeys) == 0 {
+		return fmt.Errorf("ssh.host_key_path or ssh.host_keys is required")
 	}
 	if c.SSH.AuthorizedKeysPath == "" {
 		return fmt.Errorf("ssh.authorized_keys_path is required")
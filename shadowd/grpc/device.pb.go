@@ -55,6 +55,37 @@ type ToolResponse struct {
 	Error   string `json:"error"`
 }
 
+// SessionInfo describes a live session
+type SessionInfo struct {
+	Id             string `json:"id"`
+	User           string `json:"user"`
+	KeyFingerprint string `json:"key_fingerprint"`
+	RemoteIp       string `json:"remote_ip"`
+	Transport      string `json:"transport"`
+	StartedAt      int64  `json:"started_at"`
+	BytesIn        int64  `json:"bytes_in"`
+	BytesOut       int64  `json:"bytes_out"`
+	PtyCols        int32  `json:"pty_cols"`
+	PtyRows        int32  `json:"pty_rows"`
+	Foreground     string `json:"foreground"`
+}
+
+// SessionList contains the live sessions
+type SessionList struct {
+	Sessions []*SessionInfo `json:"sessions"`
+}
+
+// SessionRequest identifies a session
+type SessionRequest struct {
+	Id string `json:"id"`
+}
+
+// TerminateSessionRequest identifies a session to terminate
+type TerminateSessionRequest struct {
+	Id      string `json:"id"`
+	Message string `json:"message"`
+}
+
 // DeviceServiceServer is the server API for DeviceService
 type DeviceServiceServer interface {
 	GetDeviceInfo(context.Context, *Empty) (*DeviceInfo, error)
@@ -67,6 +98,13 @@ type ToolServiceServer interface {
 	ExecuteTool(context.Context, *ToolRequest) (*ToolResponse, error)
 }
 
+// SessionServiceServer is the server API for SessionService
+type SessionServiceServer interface {
+	ListSessions(context.Context, *Empty) (*SessionList, error)
+	GetSession(context.Context, *SessionRequest) (*SessionInfo, error)
+	TerminateSession(context.Context, *TerminateSessionRequest) (*Empty, error)
+}
+
 // ToolServiceClient is the client API for ToolService
 type ToolServiceClient interface {
 	ExecuteTool(ctx context.Context, in *ToolRequest, opts ...grpc.CallOption) (*ToolResponse, error)
@@ -101,6 +139,11 @@ func RegisterToolServiceServer(s *grpc.Server, srv ToolServiceServer) {
 	s.RegisterService(&_ToolService_serviceDesc, srv)
 }
 
+// RegisterSessionServiceServer registers the SessionService server
+func RegisterSessionServiceServer(s *grpc.Server, srv SessionServiceServer) {
+	s.RegisterService(&_SessionService_serviceDesc, srv)
+}
+
 func _DeviceService_GetDeviceInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(Empty)
 	if err := dec(in); err != nil {
@@ -206,3 +249,78 @@ var _ToolService_serviceDesc = grpc.ServiceDesc{
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/device.proto",
 }
+
+func _SessionService_ListSessions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SessionServiceServer).ListSessions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/device.SessionService/ListSessions",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SessionServiceServer).ListSessions(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SessionService_GetSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SessionServiceServer).GetSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/device.SessionService/GetSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SessionServiceServer).GetSession(ctx, req.(*SessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SessionService_TerminateSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TerminateSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SessionServiceServer).TerminateSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/device.SessionService/TerminateSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SessionServiceServer).TerminateSession(ctx, req.(*TerminateSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _SessionService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "device.SessionService",
+	HandlerType: (*SessionServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListSessions",
+			Handler:    _SessionService_ListSessions_Handler,
+		},
+		{
+			MethodName: "GetSession",
+			Handler:    _SessionService_GetSession_Handler,
+		},
+		{
+			MethodName: "TerminateSession",
+			Handler:    _SessionService_TerminateSession_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/device.proto",
+}
@@ -2,6 +2,7 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -9,9 +10,12 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/shadow-shuttle/shadowd/sessions"
 	"github.com/shadow-shuttle/shadowd/types"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Config contains gRPC server configuration
@@ -30,6 +34,7 @@ type Server struct {
 	startTime     time.Time
 	deviceInfo    *types.Device
 	deviceService *deviceServiceImpl
+	sessions      *sessions.Registry
 }
 
 // deviceServiceImpl implements the DeviceService gRPC interface
@@ -37,13 +42,19 @@ type deviceServiceImpl struct {
 	server *Server
 }
 
+// sessionServiceImpl implements the SessionService gRPC interface
+type sessionServiceImpl struct {
+	server *Server
+}
+
 // toolServiceImpl implements the ToolService gRPC interface
 type toolServiceImpl struct {
 	server *Server
 }
 
-// NewServer creates a new gRPC server instance
-func NewServer(config Config, deviceInfo *types.Device, log *logrus.Logger) (*Server, error) {
+// NewServer creates a new gRPC server instance.
+// registry may be nil, in which case no sessions are reported.
+func NewServer(config Config, deviceInfo *types.Device, registry *sessions.Registry, log *logrus.Logger) (*Server, error) {
 	if log == nil {
 		log = logrus.New()
 	}
@@ -53,6 +64,7 @@ func NewServer(config Config, deviceInfo *types.Device, log *logrus.Logger) (*Se
 		log:        log,
 		startTime:  time.Now(),
 		deviceInfo: deviceInfo,
+		sessions:   registry,
 	}
 
 	return server, nil
@@ -82,6 +94,9 @@ func (s *Server) Start() error {
 	// Register ToolService
 	toolService := &toolServiceImpl{server: s}
 	RegisterToolServiceServer(s.grpcServer, toolService)
+	
+	// Register SessionService
+	RegisterSessionServiceServer(s.grpcServer, &sessionServiceImpl{server: s})
 
 	s.log.WithField("address", addr).Info("Starting gRPC server")
 
@@ -182,6 +197,62 @@ func (d *deviceServiceImpl) HealthCheck(ctx context.Context, req *Empty) (*Healt
 	}, nil
 }
 
+// ListSessions returns the live SSH and WebSocket sessions
+func (ss *sessionServiceImpl) ListSessions(ctx context.Context, req *Empty) (*SessionList, error) {
+	ss.server.log.Debug("ListSessions called")
+	
+	list := &SessionList{Sessions: []*SessionInfo{}}
+	for _, info := range ss.server.sessions.List() {
+		list.Sessions = append(list.Sessions, sessionInfo(info))
+	}
+	return list, nil
+}
+
+// GetSession returns one live session
+func (ss *sessionServiceImpl) GetSession(ctx context.Context, req *SessionRequest) (*SessionInfo, error) {
+	ss.server.log.WithField("session", req.Id).Debug("GetSession called")
+	
+	info, err := ss.server.sessions.Get(req.Id)
+	if errors.Is(err, sessions.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "session %q not found", req.Id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sessionInfo(info), nil
+}
+
+// TerminateSession disconnects a live session, showing req.Message to the client first
+func (ss *sessionServiceImpl) TerminateSession(ctx context.Context, req *TerminateSessionRequest) (*Empty, error) {
+	ss.server.log.WithField("session", req.Id).Info("TerminateSession called")
+	
+	err := ss.server.sessions.Terminate(req.Id, req.Message)
+	if errors.Is(err, sessions.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "session %q not found", req.Id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Empty{}, nil
+}
+
+// sessionInfo converts a registry snapshot to its gRPC message
+func sessionInfo(info sessions.Info) *SessionInfo {
+	return &SessionInfo{
+		Id:             info.ID,
+		User:           info.User,
+		KeyFingerprint: info.KeyFingerprint,
+		RemoteIp:       info.RemoteIP,
+		Transport:      info.Transport,
+		StartedAt:      info.StartedAt.Unix(),
+		BytesIn:        info.BytesIn,
+		BytesOut:       info.BytesOut,
+		PtyCols:        int32(info.PtyCols),
+		PtyRows:        int32(info.PtyRows),
+		Foreground:     info.Foreground,
+	}
+}
+
 // GetDeviceInfoFromSystem collects device information from the system
 func GetDeviceInfoFromSystem(meshIP string, sshPort, grpcPort int) *types.Device {
 	hostname, _ := os.Hostname()
@@ -0,0 +1,118 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shadow-shuttle/shadowd/lockout"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestServer returns an API server with a guard and a discarded log
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	guard, err := lockout.NewGuard(lockout.Config{}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(Config{}, nil, Services{Guard: guard}, log)
+}
+
+func TestAdminRoutes(t *testing.T) {
+	handler := newTestServer(t).routes()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		remoteAddr string
+		host       string
+		origin     string
+		want       int
+	}{
+		{"local list", http.MethodGet, "/api/bans", "127.0.0.1:50000", "127.0.0.1:8080", "", http.StatusOK},
+		{"localhost name", http.MethodGet, "/api/bans", "127.0.0.1:50000", "localhost:8080", "", http.StatusOK},
+		{"IPv6 loopback", http.MethodGet, "/api/bans", "[::1]:50000", "[::1]:8080", "", http.StatusOK},
+		{"remote address", http.MethodGet, "/api/bans", "203.0.113.7:50000", "127.0.0.1:8080", "", http.StatusForbidden},
+		{"DNS rebinding", http.MethodGet, "/api/bans", "127.0.0.1:50000", "attacker.example:8080", "", http.StatusForbidden},
+		{"mesh address as host", http.MethodGet, "/api/bans", "127.0.0.1:50000", "100.64.0.1:8080", "", http.StatusForbidden},
+		{"browser on localhost", http.MethodDelete, "/api/bans/all", "127.0.0.1:50000", "127.0.0.1:8080", "http://localhost:3000", http.StatusForbidden},
+		{"preflight", http.MethodOptions, "/api/bans/all", "127.0.0.1:50000", "127.0.0.1:8080", "http://attacker.example", http.StatusForbidden},
+		{"local clear", http.MethodDelete, "/api/bans/all", "127.0.0.1:50000", "127.0.0.1:8080", "", http.StatusNotFound},
+		{"recordings rebound", http.MethodGet, "/api/recordings", "127.0.0.1:50000", "attacker.example", "", http.StatusForbidden},
+		{"recording from browser", http.MethodGet, "/api/recordings/x", "127.0.0.1:50000", "localhost", "http://localhost:3000", http.StatusForbidden},
+		{"recordings disabled", http.MethodGet, "/api/recordings", "127.0.0.1:50000", "localhost", "", http.StatusNotFound},
+		{"sessions", http.MethodGet, "/api/sessions", "127.0.0.1:50000", "localhost", "", http.StatusOK},
+		{"sessions rebound", http.MethodGet, "/api/sessions", "127.0.0.1:50000", "attacker.example", "", http.StatusForbidden},
+		{"terminate from browser", http.MethodDelete, "/api/sessions/x", "127.0.0.1:50000", "localhost", "http://localhost:3000", http.StatusForbidden},
+		{"terminate remotely", http.MethodDelete, "/api/sessions/x", "203.0.113.7:50000", "localhost", "", http.StatusForbidden},
+		{"paired devices", http.MethodGet, "/api/pairing/devices", "127.0.0.1:50000", "localhost", "", http.StatusOK},
+		{"pairing code rebound", http.MethodPost, "/api/pairing/codes", "127.0.0.1:50000", "attacker.example", "", http.StatusForbidden},
+		{"pairing code from browser", http.MethodPost, "/api/pairing/codes", "127.0.0.1:50000", "localhost", "http://localhost:3000", http.StatusForbidden},
+		{"paired devices rebound", http.MethodGet, "/api/pairing/devices", "127.0.0.1:50000", "attacker.example", "", http.StatusForbidden},
+		{"unpair from browser", http.MethodDelete, "/api/pairing/devices/phone", "127.0.0.1:50000", "localhost", "http://localhost:3000", http.StatusForbidden},
+		{"unpair remotely", http.MethodDelete, "/api/pairing/devices/phone", "203.0.113.7:50000", "localhost", "", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Host = tt.host
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if v := rec.Header().Get("Access-Control-Allow-Origin"); v != "" {
+				t.Errorf("admin route sent Access-Control-Allow-Origin %q", v)
+			}
+		})
+	}
+}
+
+func TestPublicRoutesAllowCORS(t *testing.T) {
+	handler := newTestServer(t).routes()
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/pairing", nil)
+	req.Header.Set("Origin", "https://app.example")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("preflight = %d with headers %v", rec.Code, rec.Header())
+	}
+}
+
+func TestIsLoopbackHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"localhost", true},
+		{"LOCALHOST:8080", true},
+		{"localhost.:8080", true},
+		{"127.0.0.1", true},
+		{"127.1.2.3:8080", true},
+		{"[::1]", true},
+		{"[::1]:8080", true},
+		{"localhost.attacker.example", false},
+		{"192.168.1.2:8080", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := isLoopbackHost(tt.host); got != tt.want {
+			t.Errorf("isLoopbackHost(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package jump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Errors returned by Permit and the host key callback
+var (
+	ErrNotPermitted    = errors.New("jump destination not permitted")
+	ErrUnknownHostKey  = errors.New("host key of jump target is not known")
+	ErrHostKeyMismatch = errors.New("host key of jump target does not match known_hosts")
+)
+
+// defaultPorts are the destination ports allowed when Config.Ports is empty
+var defaultPorts = []int{22}
+
+// Config lists the mesh peers sessions may jump to, through direct-tcpip
+// channels (ssh -J) or the WebSocket proxy's connect message
+type Config struct {
+	// Targets are CIDRs ("100.64.0.0/10"), IP addresses or device names
+	// ("laptop", "build.mesh.example"); names match exactly, ignoring case
+	Targets []string
+
+	// Ports are the destination ports allowed on those targets (default: 22)
+	Ports []int
+
+	// KnownHostsPath is an OpenSSH known_hosts file with the targets' host
+	// keys. Connections the server makes itself, for the WebSocket proxy, are
+	// refused unless the target's key is listed there; ssh -J clients check
+	// the keys themselves.
+	KnownHostsPath string
+}
+
+// Policy decides which destinations may be jumped to. A nil *Policy permits none.
+type Policy struct {
+	networks []*net.IPNet
+	names    map[string]bool
+	ports    map[int]bool
+	lookup   func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	knownHostsPath string
+}
+
+// NewPolicy parses a jump policy
+func NewPolicy(cfg Config) (*Policy, error) {
+	p := &Policy{
+		names:          make(map[string]bool),
+		ports:          make(map[int]bool),
+		lookup:         net.DefaultResolver.LookupIPAddr,
+		knownHostsPath: cfg.KnownHostsPath,
+	}
+
+	for _, target := range cfg.Targets {
+		target = strings.TrimSpace(target)
+		switch {
+		case target == "":
+			continue
+		case strings.Contains(target, "/"):
+			_, network, err := net.ParseCIDR(target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid jump target %q: %w", target, err)
+			}
+			p.networks = append(p.networks, network)
+		case net.ParseIP(target) != nil:
+			ip := net.ParseIP(target)
+			bits := 8 * len(ip.To16())
+			if v4 := ip.To4(); v4 != nil {
+				ip, bits = v4, 32
+			}
+			p.networks = append(p.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			p.names[normalizeName(target)] = true
+		}
+	}
+
+	ports := cfg.Ports
+	if len(ports) == 0 {
+		ports = defaultPorts
+	}
+	for _, port := range ports {
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid jump port %d", port)
+		}
+		p.ports[port] = true
+	}
+
+	return p, nil
+}
+
+// Permit checks a destination against the policy and returns the address to
+// dial. Names are resolved here and the checked address is returned, so a
+// second lookup cannot lead somewhere else.
+func (p *Policy) Permit(ctx context.Context, host string, port int) (string, error) {
+	if p == nil || !p.ports[port] {
+		return "", ErrNotPermitted
+	}
+
+	named := p.names[normalizeName(host)]
+	if !named && len(p.networks) == 0 {
+		return "", ErrNotPermitted
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := p.lookup(ctx, host)
+		if err != nil {
+			if named {
+				return "", fmt.Errorf("failed to resolve %s: %w", host, err)
+			}
+			return "", ErrNotPermitted
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		if named || p.containsIP(ip) {
+			return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+		}
+	}
+	return "", ErrNotPermitted
+}
+
+// HostKeyCallback returns a callback that checks the host key of a target
+// against the known_hosts file, for a connection to the address Permit
+// returned for host. The entry for host, as the client named it, is checked
+// first; if there is none, the entry for the address dialed. Hosts without an
+// entry are refused, as are keys that do not match. The file is read on every
+// connection, so edits apply without a restart.
+func (p *Policy) HostKeyCallback(host string) ssh.HostKeyCallback {
+	host = normalizeName(host)
+	return func(_ string, remote net.Addr, key ssh.PublicKey) error {
+		if p == nil || p.knownHostsPath == "" {
+			return fmt.Errorf("%w: no known_hosts file is configured", ErrUnknownHostKey)
+		}
+
+		check, err := knownhosts.New(p.knownHostsPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %s does not exist", ErrUnknownHostKey, p.knownHostsPath)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read known hosts: %w", err)
+		}
+
+		_, port, err := net.SplitHostPort(remote.String())
+		if err != nil {
+			return err
+		}
+		var keyErr *knownhosts.KeyError
+		err = check(net.JoinHostPort(host, port), remote, key)
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			err = check(remote.String(), remote, key)
+		}
+
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				return fmt.Errorf("%w: %s offered %s %s", ErrUnknownHostKey, host, key.Type(), ssh.FingerprintSHA256(key))
+			}
+			return fmt.Errorf("%w: %s offered %s %s", ErrHostKeyMismatch, host, key.Type(), ssh.FingerprintSHA256(key))
+		}
+		return err
+	}
+}
+
+// containsIP reports whether ip is in one of the policy's networks
+func (p *Policy) containsIP(ip net.IP) bool {
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeName lowercases a device name and drops a trailing dot
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,155 @@
+package jump
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestPermit(t *testing.T) {
+	p, err := NewPolicy(Config{
+		Targets: []string{"100.64.0.0/10", "192.168.1.5", "Build-Box."},
+		Ports:   []int{22, 2222},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.lookup = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		switch normalizeName(host) {
+		case "build-box":
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.7")}}, nil
+		case "peer":
+			return []net.IPAddr{{IP: net.ParseIP("8.8.8.8")}, {IP: net.ParseIP("100.64.0.9")}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		name string
+		host string
+		port int
+		want string // empty when refused
+	}{
+		{"address in network", "100.64.1.2", 22, "100.64.1.2:22"},
+		{"single address", "192.168.1.5", 2222, "192.168.1.5:2222"},
+		{"address outside", "192.168.1.6", 22, ""},
+		{"port not allowed", "100.64.1.2", 80, ""},
+		{"named target", "BUILD-BOX", 22, "10.0.0.7:22"},
+		{"name resolving into network", "peer", 22, "100.64.0.9:22"},
+		{"unknown name", "elsewhere", 22, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.Permit(context.Background(), tt.host, tt.port)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("Permit(%s, %d) = %s, want refused", tt.host, tt.port, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Permit(%s, %d) = %q, %v, want %q", tt.host, tt.port, got, err, tt.want)
+			}
+		})
+	}
+
+	var nilPolicy *Policy
+	if _, err := nilPolicy.Permit(context.Background(), "100.64.1.2", 22); !errors.Is(err, ErrNotPermitted) {
+		t.Errorf("nil policy: err = %v, want ErrNotPermitted", err)
+	}
+}
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	nameKey := newTestHostKey(t)
+	addrKey := newTestHostKey(t)
+	otherKey := newTestHostKey(t)
+
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	lines := knownhosts.Line([]string{"[build-box]:2222"}, nameKey) + "\n" +
+		knownhosts.Line([]string{"100.64.0.9"}, addrKey) + "\n"
+	if err := os.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPolicy(Config{Targets: []string{"100.64.0.0/10"}, KnownHostsPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		remote  string
+		key     ssh.PublicKey
+		wantErr error
+	}{
+		{"known by name", "build-box", "100.64.0.7:2222", nameKey, nil},
+		{"name is case-insensitive", "Build-Box.", "100.64.0.7:2222", nameKey, nil},
+		{"known by address", "peer", "100.64.0.9:22", addrKey, nil},
+		{"name entry takes precedence", "build-box", "100.64.0.9:2222", addrKey, ErrHostKeyMismatch},
+		{"wrong key", "peer", "100.64.0.9:22", otherKey, ErrHostKeyMismatch},
+		{"entry for another port", "build-box", "100.64.0.7:22", nameKey, ErrUnknownHostKey},
+		{"unknown host", "laptop", "100.64.0.8:22", otherKey, ErrUnknownHostKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, err := net.ResolveTCPAddr("tcp", tt.remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.HostKeyCallback(tt.host)(tt.remote, remote, tt.key)
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHostKeyCallbackFailsClosed(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("100.64.0.9"), Port: 22}
+	key := newTestHostKey(t)
+
+	missing, err := NewPolicy(Config{KnownHostsPath: filepath.Join(t.TempDir(), "missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unset, err := NewPolicy(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, p := range map[string]*Policy{"missing file": missing, "no file": unset, "nil policy": nil} {
+		t.Run(name, func(t *testing.T) {
+			if err := p.HostKeyCallback("peer")(remote.String(), remote, key); !errors.Is(err, ErrUnknownHostKey) {
+				t.Errorf("err = %v, want ErrUnknownHostKey", err)
+			}
+		})
+	}
+}
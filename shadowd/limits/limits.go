@@ -0,0 +1,242 @@
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrTooManySessions is returned by Acquire when the user or source IP already has the maximum number of sessions
+var ErrTooManySessions = errors.New("too many concurrent sessions")
+
+// defaultWarning is how long before a disconnect the client is warned
+const defaultWarning = time.Minute
+
+// Config contains session limits shared by native SSH and the WebSocket proxy.
+// Zero values disable the corresponding limit.
+type Config struct {
+	// IdleTimeout disconnects a session without input or output for this long
+	IdleTimeout time.Duration
+
+	// MaxLifetime disconnects a session this long after it started, active or not
+	MaxLifetime time.Duration
+
+	// Warning is how long before a disconnect the client is warned (default: 1m,
+	// capped at half the timeout)
+	Warning time.Duration
+
+	// MaxPerUser is the maximum number of concurrent sessions per username
+	MaxPerUser int
+
+	// MaxPerIP is the maximum number of concurrent sessions per source IP
+	MaxPerIP int
+}
+
+// Limiter counts open sessions per user and source IP and enforces timeouts.
+// A nil *Limiter imposes no limits.
+type Limiter struct {
+	config Config
+	log    *logrus.Logger
+
+	mu     sync.Mutex
+	byUser map[string]int
+	byIP   map[string]int
+}
+
+// NewLimiter creates a limiter; a zero Warning falls back to the default
+func NewLimiter(cfg Config, log *logrus.Logger) *Limiter {
+	if log == nil {
+		log = logrus.New()
+	}
+	if cfg.Warning <= 0 {
+		cfg.Warning = defaultWarning
+	}
+
+	return &Limiter{
+		config: cfg,
+		log:    log,
+		byUser: make(map[string]int),
+		byIP:   make(map[string]int),
+	}
+}
+
+// Acquire registers a new session for user from ip, or returns ErrTooManySessions.
+// The session must be released with Release when it ends.
+func (l *Limiter) Acquire(user, ip string) (*Session, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.config.MaxPerUser > 0 && l.byUser[user] >= l.config.MaxPerUser {
+		l.log.WithFields(logrus.Fields{
+			"user":  user,
+			"limit": l.config.MaxPerUser,
+		}).Warn("Session refused: user has too many sessions")
+		return nil, fmt.Errorf("%w for user %s (limit %d)", ErrTooManySessions, user, l.config.MaxPerUser)
+	}
+	if l.config.MaxPerIP > 0 && l.byIP[ip] >= l.config.MaxPerIP {
+		l.log.WithFields(logrus.Fields{
+			"remote_ip": ip,
+			"limit":     l.config.MaxPerIP,
+		}).Warn("Session refused: source IP has too many sessions")
+		return nil, fmt.Errorf("%w from %s (limit %d)", ErrTooManySessions, ip, l.config.MaxPerIP)
+	}
+
+	l.byUser[user]++
+	l.byIP[ip]++
+
+	now := time.Now()
+	return &Session{
+		limiter:      l,
+		user:         user,
+		ip:           ip,
+		started:      now,
+		lastActivity: now,
+		done:         make(chan struct{}),
+	}, nil
+}
+
+// release forgets a session in the per-user and per-IP counts
+func (l *Limiter) release(user, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.byUser[user]--; l.byUser[user] <= 0 {
+		delete(l.byUser, user)
+	}
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+// Session is one counted session. A nil *Session has no limits.
+type Session struct {
+	limiter *Limiter
+	user    string
+	ip      string
+	started time.Time
+
+	mu           sync.Mutex
+	lastActivity time.Time
+	released     bool
+	done         chan struct{}
+}
+
+// Touch records input or output on the session, resetting the idle timeout
+func (s *Session) Touch() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.lastActivity = time.Now()
+	s.mu.Unlock()
+}
+
+// Release ends the session; it is safe to call more than once
+func (s *Session) Release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.released {
+		s.mu.Unlock()
+		return
+	}
+	s.released = true
+	close(s.done)
+	s.mu.Unlock()
+
+	s.limiter.release(s.user, s.ip)
+}
+
+// Enforce watches the session's timeouts until it is released. warn is called
+// once before each disconnect with a message for the client, and expire is
+// called with the reason when a timeout is reached; the session is released
+// after expire returns. Either callback may be nil.
+func (s *Session) Enforce(warn func(message string), expire func(reason string)) {
+	if s == nil {
+		return
+	}
+	cfg := s.limiter.config
+	if cfg.IdleTimeout <= 0 && cfg.MaxLifetime <= 0 {
+		return
+	}
+
+	go func() {
+		var warned time.Time // deadline the client was last warned about
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-timer.C:
+			}
+
+			deadline, timeout, reason := s.deadline()
+			warning := cfg.Warning
+			if warning > timeout/2 {
+				// Don't warn about a short timeout the moment it starts
+				warning = timeout / 2
+			}
+			now := time.Now()
+
+			switch {
+			case !now.Before(deadline):
+				s.limiter.log.WithFields(logrus.Fields{
+					"user":      s.user,
+					"remote_ip": s.ip,
+					"reason":    reason,
+				}).Info("Disconnecting session")
+				if expire != nil {
+					expire(reason)
+				}
+				s.Release()
+				return
+			case !now.Before(deadline.Add(-warning)) && !warned.Equal(deadline):
+				warned = deadline
+				if warn != nil {
+					warn(fmt.Sprintf("Disconnecting in %s: %s", deadline.Sub(now).Round(time.Second), reason))
+				}
+				timer.Reset(deadline.Sub(now))
+			case now.Before(deadline.Add(-warning)):
+				timer.Reset(deadline.Add(-warning).Sub(now))
+			default:
+				timer.Reset(deadline.Sub(now))
+			}
+		}
+	}()
+}
+
+// deadline returns the earliest timeout, its configured length and a description of it
+func (s *Session) deadline() (time.Time, time.Duration, string) {
+	cfg := s.limiter.config
+
+	s.mu.Lock()
+	lastActivity := s.lastActivity
+	s.mu.Unlock()
+
+	var deadline time.Time
+	var timeout time.Duration
+	var reason string
+	if cfg.IdleTimeout > 0 {
+		deadline = lastActivity.Add(cfg.IdleTimeout)
+		timeout = cfg.IdleTimeout
+		reason = fmt.Sprintf("idle timeout (%s)", cfg.IdleTimeout)
+	}
+	if cfg.MaxLifetime > 0 {
+		if end := s.started.Add(cfg.MaxLifetime); deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+			timeout = cfg.MaxLifetime
+			reason = fmt.Sprintf("maximum session lifetime (%s)", cfg.MaxLifetime)
+		}
+	}
+	return deadline, timeout, reason
+}
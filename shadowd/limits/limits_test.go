@@ -0,0 +1,169 @@
+package limits
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestLimiter(cfg Config) *Limiter {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return NewLimiter(cfg, log)
+}
+
+func TestAcquire(t *testing.T) {
+	l := newTestLimiter(Config{MaxPerUser: 2, MaxPerIP: 2})
+
+	a1, err := l.Acquire("alice", "203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire("alice", "203.0.113.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		user    string
+		ip      string
+		wantErr bool
+	}{
+		{"user at limit", "alice", "203.0.113.3", true},
+		{"other user", "bob", "203.0.113.1", false},
+		{"ip at limit", "carol", "203.0.113.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := l.Acquire(tt.user, tt.ip)
+			if tt.wantErr && !errors.Is(err, ErrTooManySessions) {
+				t.Errorf("err = %v, want ErrTooManySessions", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+		})
+	}
+
+	// Releasing twice frees one slot only
+	a1.Release()
+	a1.Release()
+	if _, err := l.Acquire("alice", "203.0.113.4"); err != nil {
+		t.Errorf("after release: err = %v, want nil", err)
+	}
+	if _, err := l.Acquire("alice", "203.0.113.5"); !errors.Is(err, ErrTooManySessions) {
+		t.Errorf("after release: err = %v, want ErrTooManySessions", err)
+	}
+
+	var nilLimiter *Limiter
+	if s, err := nilLimiter.Acquire("alice", "203.0.113.1"); s != nil || err != nil {
+		t.Errorf("nil limiter: %v, %v, want no session and no error", s, err)
+	}
+}
+
+// enforced runs Enforce on a new session and reports what it did
+func enforced(t *testing.T, cfg Config, touch func(*Session)) (warnings []string, reason string, released bool) {
+	t.Helper()
+
+	l := newTestLimiter(cfg)
+	s, err := l.Acquire("alice", "203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warned := make(chan string, 10)
+	expired := make(chan string, 1)
+	s.Enforce(func(m string) { warned <- m }, func(r string) { expired <- r })
+	if touch != nil {
+		touch(s)
+	}
+
+	select {
+	case reason = <-expired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not expired")
+	}
+	close(warned)
+	for m := range warned {
+		warnings = append(warnings, m)
+	}
+
+	// Enforce releases the session after expire returns
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := l.Acquire("alice", "203.0.113.1"); err == nil {
+			return warnings, reason, true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return warnings, reason, false
+}
+
+func TestEnforceIdleTimeout(t *testing.T) {
+	start := time.Now()
+	warnings, reason, released := enforced(t, Config{
+		IdleTimeout: 200 * time.Millisecond,
+		Warning:     100 * time.Millisecond,
+		MaxPerUser:  1,
+	}, func(s *Session) {
+		// Activity pushes the deadline back
+		time.Sleep(150 * time.Millisecond)
+		s.Touch()
+	})
+
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("expired after %s, want the touch to delay it", elapsed)
+	}
+	if !strings.Contains(reason, "idle timeout") {
+		t.Errorf("reason = %q, want the idle timeout", reason)
+	}
+	if len(warnings) == 0 || !strings.HasPrefix(warnings[len(warnings)-1], "Disconnecting in") {
+		t.Errorf("warnings = %q, want one before the disconnect", warnings)
+	}
+	if !released {
+		t.Error("session not released after expiring")
+	}
+}
+
+func TestEnforceMaxLifetime(t *testing.T) {
+	_, reason, released := enforced(t, Config{
+		IdleTimeout: time.Hour,
+		MaxLifetime: 100 * time.Millisecond,
+		MaxPerUser:  1,
+	}, func(s *Session) {
+		// Activity does not extend the lifetime
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			s.Touch()
+		}
+	})
+
+	if !strings.Contains(reason, "maximum session lifetime") {
+		t.Errorf("reason = %q, want the lifetime", reason)
+	}
+	if !released {
+		t.Error("session not released after expiring")
+	}
+}
+
+func TestEnforceStopsOnRelease(t *testing.T) {
+	l := newTestLimiter(Config{IdleTimeout: 50 * time.Millisecond})
+	s, err := l.Acquire("alice", "203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := make(chan string, 1)
+	s.Enforce(nil, func(r string) { expired <- r })
+	s.Release()
+
+	select {
+	case r := <-expired:
+		t.Errorf("released session expired: %s", r)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
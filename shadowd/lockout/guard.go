@@ -0,0 +1,315 @@
+package lockout
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrBanned is returned by Check when the source IP or username is banned
+var ErrBanned = errors.New("too many failed login attempts")
+
+// pruneThreshold is the record count above which stale records are dropped on each failure
+const pruneThreshold = 1024
+
+// Config contains brute-force protection settings
+type Config struct {
+	// MaxFailures is the number of failures within Window that triggers a ban
+	MaxFailures int
+
+	// Window is how long failures are remembered
+	Window time.Duration
+
+	// BanDuration is how long a ban lasts
+	BanDuration time.Duration
+
+	// BaseDelay is the delay after the first failure; it doubles with each further failure
+	BaseDelay time.Duration
+
+	// MaxDelay caps the exponential delay
+	MaxDelay time.Duration
+
+	// Allowlist are CIDR ranges that are never tracked, delayed or banned (e.g. the Mesh network).
+	// Loopback is always allowlisted because the WebSocket proxy connects from it;
+	// the SSH server tracks proxied logins by the real client address instead.
+	Allowlist []string
+}
+
+// Ban describes an active ban
+type Ban struct {
+	Key         string    `json:"key"`  // "ip:<addr>" or "user:<name>"
+	Kind        string    `json:"kind"` // "ip" or "user"
+	Value       string    `json:"value"`
+	Failures    int       `json:"failures"`
+	BannedUntil time.Time `json:"bannedUntil"`
+}
+
+// record tracks failures for one key
+type record struct {
+	failures    int
+	firstSeen   time.Time
+	bannedUntil time.Time
+}
+
+// Guard tracks login failures per source IP and per username.
+// A nil *Guard disables protection.
+type Guard struct {
+	config    Config
+	log       *logrus.Logger
+	allowlist []*net.IPNet
+
+	mu      sync.Mutex
+	records map[string]*record
+	now     func() time.Time
+}
+
+// DefaultConfig returns the default brute-force protection settings
+func DefaultConfig() Config {
+	return Config{
+		MaxFailures: 5,
+		Window:      10 * time.Minute,
+		BanDuration: 15 * time.Minute,
+		BaseDelay:   time.Second,
+		MaxDelay:    30 * time.Second,
+	}
+}
+
+// NewGuard creates a new guard; zero values in cfg fall back to DefaultConfig
+func NewGuard(cfg Config, log *logrus.Logger) (*Guard, error) {
+	if log == nil {
+		log = logrus.New()
+	}
+
+	defaults := DefaultConfig()
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = defaults.MaxFailures
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = defaults.Window
+	}
+	if cfg.BanDuration <= 0 {
+		cfg.BanDuration = defaults.BanDuration
+	}
+	if cfg.BaseDelay <= 0 {
+		cfg.BaseDelay = defaults.BaseDelay
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = defaults.MaxDelay
+	}
+
+	g := &Guard{
+		config:  cfg,
+		log:     log,
+		records: make(map[string]*record),
+		now:     time.Now,
+	}
+
+	for _, cidr := range append([]string{"127.0.0.0/8", "::1/128"}, cfg.Allowlist...) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist CIDR %q: %w", cidr, err)
+		}
+		g.allowlist = append(g.allowlist, network)
+	}
+
+	return g, nil
+}
+
+// IsAllowlisted reports whether ip is exempt from tracking
+func (g *Guard) IsAllowlisted(ip string) bool {
+	if g == nil {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range g.allowlist {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns ErrBanned if the source IP or the username is currently banned.
+// An empty username only checks the IP.
+func (g *Guard) Check(ip, username string) error {
+	if g == nil || g.IsAllowlisted(ip) {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	for _, key := range keysFor(ip, username) {
+		if rec, ok := g.records[key]; ok && now.Before(rec.bannedUntil) {
+			return ErrBanned
+		}
+	}
+	return nil
+}
+
+// Failure records a failed login and returns how long the caller should delay
+// its response. transport ("ssh" or "websocket") is only used for logging.
+func (g *Guard) Failure(ip, username, transport string) time.Duration {
+	if g == nil || g.IsAllowlisted(ip) {
+		return 0
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	if len(g.records) >= pruneThreshold {
+		g.prune(now)
+	}
+
+	maxFailures := 0
+	for _, key := range keysFor(ip, username) {
+		rec, ok := g.records[key]
+		if !ok || (now.Sub(rec.firstSeen) > g.config.Window && !now.Before(rec.bannedUntil)) {
+			rec = &record{firstSeen: now}
+			g.records[key] = rec
+		}
+		rec.failures++
+		if rec.failures > maxFailures {
+			maxFailures = rec.failures
+		}
+
+		if rec.failures >= g.config.MaxFailures && !now.Before(rec.bannedUntil) {
+			rec.bannedUntil = now.Add(g.config.BanDuration)
+			kind, value := splitKey(key)
+			g.log.WithFields(logrus.Fields{
+				"event":        "auth_ban",
+				"kind":         kind,
+				"value":        value,
+				"remote_ip":    ip,
+				"user":         username,
+				"transport":    transport,
+				"failures":     rec.failures,
+				"banned_until": rec.bannedUntil.Format(time.RFC3339),
+			}).Warn("Login source banned after repeated failures")
+		}
+	}
+
+	return g.delayFor(maxFailures)
+}
+
+// Success clears the failure counters for a source IP and username
+func (g *Guard) Success(ip, username string) {
+	if g == nil || g.IsAllowlisted(ip) {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	for _, key := range keysFor(ip, username) {
+		if rec, ok := g.records[key]; ok && !now.Before(rec.bannedUntil) {
+			delete(g.records, key)
+		}
+	}
+}
+
+// Bans returns the currently active bans, soonest expiry first
+func (g *Guard) Bans() []Ban {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	bans := []Ban{}
+	g.prune(now)
+	for key, rec := range g.records {
+		if !now.Before(rec.bannedUntil) {
+			continue
+		}
+		kind, value := splitKey(key)
+		bans = append(bans, Ban{
+			Key:         key,
+			Kind:        kind,
+			Value:       value,
+			Failures:    rec.failures,
+			BannedUntil: rec.bannedUntil,
+		})
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].BannedUntil.Before(bans[j].BannedUntil)
+	})
+	return bans
+}
+
+// Clear lifts a ban (and resets its counter) by key; "all" clears everything.
+// It returns whether anything was cleared.
+func (g *Guard) Clear(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if key == "all" {
+		cleared := len(g.records) > 0
+		g.records = make(map[string]*record)
+		g.log.WithField("event", "auth_ban_cleared").WithField("key", key).Info("All login bans cleared")
+		return cleared
+	}
+
+	if _, ok := g.records[key]; !ok {
+		return false
+	}
+	delete(g.records, key)
+
+	kind, value := splitKey(key)
+	g.log.WithFields(logrus.Fields{
+		"event": "auth_ban_cleared",
+		"kind":  kind,
+		"value": value,
+	}).Info("Login ban cleared")
+	return true
+}
+
+// prune drops records whose window and ban have both expired
+func (g *Guard) prune(now time.Time) {
+	for key, rec := range g.records {
+		if now.Sub(rec.firstSeen) > g.config.Window && !now.Before(rec.bannedUntil) {
+			delete(g.records, key)
+		}
+	}
+}
+
+// delayFor returns BaseDelay * 2^(failures-1), capped at MaxDelay
+func (g *Guard) delayFor(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := g.config.BaseDelay
+	for i := 1; i < failures && delay < g.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > g.config.MaxDelay {
+		delay = g.config.MaxDelay
+	}
+	return delay
+}
+
+// keysFor returns the tracking keys for a source IP and username
+func keysFor(ip, username string) []string {
+	keys := []string{"ip:" + ip}
+	if username != "" {
+		keys = append(keys, "user:"+username)
+	}
+	return keys
+}
+
+// splitKey splits "ip:1.2.3.4" into its kind and value
+func splitKey(key string) (string, string) {
+	kind, value, _ := strings.Cut(key, ":")
+	return kind, value
+}
@@ -0,0 +1,203 @@
+package lockout
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestGuard returns a guard with a clock the test moves by hand
+func newTestGuard(t *testing.T, cfg Config) (*Guard, *time.Time) {
+	t.Helper()
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	g, err := NewGuard(cfg, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	g.now = func() time.Time { return now }
+	return g, &now
+}
+
+func TestFailureDelays(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		failures int
+		want     time.Duration
+	}{
+		{"first failure", Config{}, 1, time.Second},
+		{"doubles", Config{}, 3, 4 * time.Second},
+		{"capped", Config{MaxFailures: 100}, 10, 30 * time.Second},
+		{"custom base", Config{BaseDelay: 100 * time.Millisecond}, 2, 200 * time.Millisecond},
+		{"custom cap", Config{MaxFailures: 100, MaxDelay: 5 * time.Second}, 8, 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, _ := newTestGuard(t, tt.cfg)
+			var delay time.Duration
+			for i := 0; i < tt.failures; i++ {
+				delay = g.Failure("203.0.113.7", "alice", "ssh")
+			}
+			if delay != tt.want {
+				t.Errorf("delay after %d failures = %v, want %v", tt.failures, delay, tt.want)
+			}
+		})
+	}
+}
+
+func TestBans(t *testing.T) {
+	g, now := newTestGuard(t, Config{MaxFailures: 3, Window: time.Minute, BanDuration: 10 * time.Minute})
+
+	for i := 0; i < 2; i++ {
+		g.Failure("203.0.113.7", "alice", "ssh")
+	}
+	if err := g.Check("203.0.113.7", "alice"); err != nil {
+		t.Fatalf("banned after 2 of 3 failures: %v", err)
+	}
+
+	g.Failure("203.0.113.7", "alice", "ssh")
+	tests := []struct {
+		ip, user string
+		banned   bool
+	}{
+		{"203.0.113.7", "alice", true},
+		{"203.0.113.7", "", true},
+		{"198.51.100.1", "alice", true}, // the user is banned from any address
+		{"198.51.100.1", "bob", false},
+		{"198.51.100.1", "", false},
+	}
+	for _, tt := range tests {
+		if err := g.Check(tt.ip, tt.user); (err == ErrBanned) != tt.banned {
+			t.Errorf("Check(%q, %q) = %v, want banned %v", tt.ip, tt.user, err, tt.banned)
+		}
+	}
+	if bans := g.Bans(); len(bans) != 2 || bans[0].Failures != 3 {
+		t.Errorf("Bans() = %+v, want the IP and the user with 3 failures", bans)
+	}
+
+	// A success does not lift an active ban
+	g.Success("203.0.113.7", "alice")
+	if err := g.Check("203.0.113.7", "alice"); err != ErrBanned {
+		t.Error("success lifted an active ban")
+	}
+
+	*now = now.Add(10 * time.Minute)
+	if err := g.Check("203.0.113.7", "alice"); err != nil {
+		t.Errorf("still banned after the ban expired: %v", err)
+	}
+	if bans := g.Bans(); len(bans) != 0 {
+		t.Errorf("Bans() after expiry = %+v", bans)
+	}
+}
+
+func TestFailureWindow(t *testing.T) {
+	g, now := newTestGuard(t, Config{MaxFailures: 3, Window: time.Minute})
+
+	g.Failure("203.0.113.7", "", "ssh")
+	g.Failure("203.0.113.7", "", "ssh")
+	*now = now.Add(2 * time.Minute)
+	if delay := g.Failure("203.0.113.7", "", "ssh"); delay != time.Second {
+		t.Errorf("delay after the window passed = %v, want the first failure's", delay)
+	}
+	if err := g.Check("203.0.113.7", ""); err != nil {
+		t.Errorf("banned for failures spread over two windows: %v", err)
+	}
+}
+
+func TestSuccessResetsCounters(t *testing.T) {
+	g, _ := newTestGuard(t, Config{MaxFailures: 3})
+
+	g.Failure("203.0.113.7", "alice", "ssh")
+	g.Failure("203.0.113.7", "alice", "ssh")
+	g.Success("203.0.113.7", "alice")
+	if delay := g.Failure("203.0.113.7", "alice", "ssh"); delay != time.Second {
+		t.Errorf("delay after a success = %v, want the first failure's", delay)
+	}
+}
+
+func TestClear(t *testing.T) {
+	g, _ := newTestGuard(t, Config{MaxFailures: 1})
+	g.Failure("203.0.113.7", "alice", "ssh")
+	g.Failure("198.51.100.1", "", "websocket")
+
+	if g.Clear("ip:192.0.2.1") {
+		t.Error("cleared a ban that does not exist")
+	}
+	if !g.Clear("user:alice") {
+		t.Fatal("user ban not cleared")
+	}
+	if err := g.Check("", "alice"); err != nil {
+		t.Errorf("user still banned after clearing: %v", err)
+	}
+	if err := g.Check("203.0.113.7", ""); err != ErrBanned {
+		t.Error("clearing the user lifted the IP ban")
+	}
+	if !g.Clear("all") || len(g.Bans()) != 0 {
+		t.Error("bans left after clearing all")
+	}
+	if g.Clear("all") {
+		t.Error("clearing an empty guard reported a change")
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	g, _ := newTestGuard(t, Config{MaxFailures: 1, Allowlist: []string{"100.64.0.0/10"}})
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"127.8.9.10", true},
+		{"::1", true},
+		{"100.100.1.2", true},
+		{"100.128.0.1", false},
+		{"203.0.113.7", false},
+		{"not an ip", false},
+	}
+	for _, tt := range tests {
+		if got := g.IsAllowlisted(tt.ip); got != tt.want {
+			t.Errorf("IsAllowlisted(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	// Allowlisted sources are never delayed or banned, even for a banned user
+	for i := 0; i < 5; i++ {
+		if delay := g.Failure("127.0.0.1", "alice", "ssh"); delay != 0 {
+			t.Fatalf("loopback delayed by %v", delay)
+		}
+	}
+	if err := g.Check("127.0.0.1", "alice"); err != nil {
+		t.Errorf("loopback banned: %v", err)
+	}
+	g.Failure("203.0.113.7", "alice", "ssh")
+	if err := g.Check("127.0.0.1", "alice"); err != nil {
+		t.Errorf("banned user refused from loopback: %v", err)
+	}
+}
+
+func TestNewGuardRejectsBadAllowlist(t *testing.T) {
+	if _, err := NewGuard(Config{Allowlist: []string{"10.0.0.0"}}, nil); err == nil {
+		t.Error("allowlist entry without a prefix length accepted")
+	}
+}
+
+func TestNilGuard(t *testing.T) {
+	var g *Guard
+	if err := g.Check("203.0.113.7", "alice"); err != nil {
+		t.Errorf("nil guard Check = %v", err)
+	}
+	if delay := g.Failure("203.0.113.7", "alice", "ssh"); delay != 0 {
+		t.Errorf("nil guard Failure = %v", delay)
+	}
+	g.Success("203.0.113.7", "alice")
+	if g.IsAllowlisted("127.0.0.1") {
+		t.Error("nil guard allowlists")
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
+	nethttp "net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -13,10 +18,18 @@ import (
 	"github.com/shadow-shuttle/shadowd/config"
 	"github.com/shadow-shuttle/shadowd/grpc"
 	"github.com/shadow-shuttle/shadowd/http"
+	"github.com/shadow-shuttle/shadowd/jump"
+	"github.com/shadow-shuttle/shadowd/limits"
+	"github.com/shadow-shuttle/shadowd/lockout"
 	"github.com/shadow-shuttle/shadowd/network"
+	"github.com/shadow-shuttle/shadowd/pairing"
+	"github.com/shadow-shuttle/shadowd/recording"
+	"github.com/shadow-shuttle/shadowd/sessions"
 	"github.com/shadow-shuttle/shadowd/ssh"
 	"github.com/shadow-shuttle/shadowd/websocket"
 	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 )
 
 var (
@@ -35,6 +48,56 @@ func main() {
 		return
 	}
 
+	// Special CLI subcommand: passwd
+	// Usage: shadowd passwd [-config shadowd.yaml] <user>
+	if len(os.Args) > 1 && os.Args[1] == "passwd" {
+		if err := runPasswd(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting password: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Special CLI subcommand: totp
+	// Usage: shadowd totp enroll [-config shadowd.yaml] <user>
+	if len(os.Args) > 1 && os.Args[1] == "totp" {
+		if err := runTOTP(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error enrolling TOTP: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Special CLI subcommand: bans
+	// Usage: shadowd bans [list | clear <ip:addr|user:name|all>]
+	if len(os.Args) > 1 && os.Args[1] == "bans" {
+		if err := runBans(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error managing bans: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Special CLI subcommand: hostkey
+	// Usage: shadowd hostkey [-config shadowd.yaml] [list | rotate [-type ed25519]]
+	if len(os.Args) > 1 && os.Args[1] == "hostkey" {
+		if err := runHostKey(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error managing host keys: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Hidden CLI subcommand: sftp-server
+	// Started by the SSH server as the logged-in account to serve one SFTP session on stdin/stdout
+	if len(os.Args) > 1 && os.Args[1] == "sftp-server" {
+		if err := runSFTPServer(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "sftp-server: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flag.Parse()
 
 	// Initialize logger
@@ -72,29 +135,66 @@ func main() {
 		log.Fatal("Failed to obtain Mesh IP address")
 	}
 
+	// Initialize brute-force protection shared by SSH and the WebSocket proxy
+	guard := initializeLockout(cfg, log)
+
+	// Initialize session limits shared by SSH and the WebSocket proxy
+	limiter := initializeLimits(cfg, log)
+
+	// Initialize session recording shared by SSH and the HTTP API
+	recordings := initializeRecording(cfg, log)
+
+	// Track live sessions of all transports for the admin API
+	registry := sessions.NewRegistry(log)
+
+	// Mesh peers that SSH and WebSocket clients may jump to
+	jumps := initializeJump(cfg, log)
+
+	// Paired devices and their tickets, issued by the HTTP API and accepted by
+	// the WebSocket proxy and, from it, by the SSH server
+	tickets := initializePairing(cfg, log)
+
 	// Initialize SSH server
-	sshServer := initializeSSH(cfg, meshIP, log)
+	sshServer := initializeSSH(cfg, meshIP, ssh.Services{
+		Guard:      guard,
+		Limiter:    limiter,
+		Sessions:   registry,
+		Jumps:      jumps,
+		Tickets:    tickets,
+		Recordings: recordings,
+	}, log)
 	if sshServer == nil {
 		log.Fatal("Failed to initialize SSH server")
 	}
 	defer sshServer.Stop()
 
 	// Initialize gRPC server
-	grpcServer := initializeGRPC(cfg, meshIP, log)
+	grpcServer := initializeGRPC(cfg, meshIP, registry, log)
 	if grpcServer == nil {
 		log.Fatal("Failed to initialize gRPC server")
 	}
 	defer grpcServer.Stop()
 
 	// Initialize WebSocket SSH proxy
-	wsServer := initializeWebSocket(cfg, log)
+	wsServer := initializeWebSocket(cfg, websocket.Services{
+		Guard:    guard,
+		Limiter:  limiter,
+		Sessions: registry,
+		Jumps:    jumps,
+		Tickets:  tickets,
+	}, log)
 	if wsServer == nil {
 		log.Fatal("Failed to initialize WebSocket server")
 	}
 	defer wsServer.Stop()
 
 	// Initialize HTTP API server
-	httpServer := initializeHTTP(grpcServer, log)
+	httpServer := initializeHTTP(grpcServer, http.Services{
+		Guard:      guard,
+		Sessions:   registry,
+		Tickets:    tickets,
+		Recordings: recordings,
+	}, log)
 	if httpServer == nil {
 		log.Fatal("Failed to initialize HTTP server")
 	}
@@ -108,10 +208,24 @@ func main() {
 
 	log.Info("Shadowd started successfully")
 
-	// Wait for interrupt signal
+	// Wait for interrupt signal; SIGHUP reloads authorized keys and host keys
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		log.Info("Received SIGHUP, reloading authorized keys and host keys")
+		if err := sshServer.ReloadAuthorizedKeys(); err != nil {
+			log.WithError(err).Warn("Failed to reload authorized keys")
+		}
+		// Host key paths change with 'shadowd hostkey rotate', so re-read them
+		if newCfg, err := config.LoadConfig(*configPath); err != nil {
+			log.WithError(err).Warn("Failed to reload configuration")
+		} else if err := sshServer.ReloadHostKeys(ssh.HostKeyPaths(sshHostKeyConfig(newCfg))); err != nil {
+			log.WithError(err).Warn("Failed to reload host keys")
+		}
+	}
 
 	log.Info("Shutting down Shadowd")
 	// Cleanup is handled by defer statements
@@ -183,6 +297,313 @@ func runGenerateQR() error {
 	return nil
 }
 
+// runPasswd hashes a new password for an SSH user and writes it into the config file.
+// The password is read from the terminal without echo, or from stdin when piped.
+func runPasswd(args []string) error {
+	fs := flag.NewFlagSet("passwd", flag.ContinueOnError)
+	path := fs.String("config", "shadowd.yaml", "Path to configuration file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: shadowd passwd [-config shadowd.yaml] <user>")
+	}
+	username := fs.Arg(0)
+
+	cfg, err := config.LoadConfig(*path)
+	if err != nil {
+		return err
+	}
+
+	password, err := readNewPassword()
+	if err != nil {
+		return err
+	}
+
+	hash, err := ssh.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if cfg.SSH.Users == nil {
+		cfg.SSH.Users = make(map[string]string)
+	}
+	cfg.SSH.Users[username] = hash
+
+	if err := config.SaveConfig(*path, cfg); err != nil {
+		return err
+	}
+
+	fmt.Printf("Password for %s updated in %s\n", username, *path)
+	return nil
+}
+
+// readNewPassword prompts for a password twice, or reads one line from piped stdin
+func readNewPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "New password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+
+	fmt.Fprint(os.Stderr, "Retype new password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+
+	if string(first) != string(second) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	if len(first) == 0 {
+		return "", fmt.Errorf("empty password")
+	}
+	return string(first), nil
+}
+
+// runTOTP enrolls an SSH user for TOTP: it prints an otpauth QR code for an
+// authenticator app, checks a code from the app and saves the secret to the config file
+func runTOTP(args []string) error {
+	if len(args) == 0 || args[0] != "enroll" {
+		return fmt.Errorf("usage: shadowd totp enroll [-config shadowd.yaml] [-issuer Shadowd] <user>")
+	}
+
+	fs := flag.NewFlagSet("totp enroll", flag.ContinueOnError)
+	path := fs.String("config", "shadowd.yaml", "Path to configuration file")
+	issuer := fs.String("issuer", "Shadowd", "Issuer name shown in the authenticator app")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: shadowd totp enroll [-config shadowd.yaml] [-issuer Shadowd] <user>")
+	}
+	username := fs.Arg(0)
+
+	cfg, err := config.LoadConfig(*path)
+	if err != nil {
+		return err
+	}
+
+	secret, err := ssh.GenerateTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = cfg.Device.Name
+	}
+	uri := ssh.TOTPURI(*issuer, username+"@"+hostname, secret)
+
+	fmt.Println()
+	fmt.Printf("Scan this QR code with an authenticator app to enroll %s:\n", username)
+	fmt.Println()
+	qrterminal.GenerateWithConfig(uri, qrterminal.Config{
+		Level:     qrterminal.M,
+		Writer:    os.Stdout,
+		BlackChar: qrterminal.BLACK,
+		WhiteChar: qrterminal.WHITE,
+		QuietZone: 1,
+	})
+	fmt.Println()
+	fmt.Printf("Or enter the secret manually: %s\n", secret)
+	fmt.Println()
+
+	// Make sure the app was set up correctly before locking the user into it
+	reader := bufio.NewReader(os.Stdin)
+	for attempt := 0; ; attempt++ {
+		fmt.Fprint(os.Stderr, "Enter the code shown in the app: ")
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read code: %w", err)
+		}
+		if ssh.ValidateTOTP(secret, line, time.Now()) {
+			break
+		}
+		if attempt == 2 {
+			return fmt.Errorf("code did not match, %s was not enrolled", username)
+		}
+		fmt.Fprintln(os.Stderr, "Code did not match, try again")
+	}
+
+	if cfg.SSH.TOTP == nil {
+		cfg.SSH.TOTP = make(map[string]string)
+	}
+	cfg.SSH.TOTP[username] = secret
+
+	if err := config.SaveConfig(*path, cfg); err != nil {
+		return err
+	}
+
+	fmt.Printf("TOTP enabled for %s in %s (restart shadowd to apply)\n", username, *path)
+	return nil
+}
+
+// runBans lists or clears login bans through the local HTTP admin API
+func runBans(args []string) error {
+	fs := flag.NewFlagSet("bans", flag.ContinueOnError)
+	api := fs.String("api", "http://127.0.0.1:8080", "Base URL of the local HTTP API")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	action := "list"
+	if fs.NArg() > 0 {
+		action = fs.Arg(0)
+	}
+
+	switch {
+	case action == "list" && fs.NArg() <= 1:
+		resp, err := nethttp.Get(*api + "/api/bans")
+		if err != nil {
+			return fmt.Errorf("failed to reach shadowd: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != nethttp.StatusOK {
+			return fmt.Errorf("shadowd returned %s", resp.Status)
+		}
+
+		var result http.BansResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+
+		if len(result.Bans) == 0 {
+			fmt.Println("No active bans")
+			return nil
+		}
+		for _, ban := range result.Bans {
+			fmt.Printf("%-40s failures=%-3d until %s\n", ban.Key, ban.Failures, ban.BannedUntil.Local().Format(time.RFC3339))
+		}
+		return nil
+
+	case action == "clear" && fs.NArg() == 2:
+		req, err := nethttp.NewRequest(nethttp.MethodDelete, *api+"/api/bans/"+url.PathEscape(fs.Arg(1)), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := nethttp.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to reach shadowd: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != nethttp.StatusNoContent {
+			return fmt.Errorf("shadowd returned %s", resp.Status)
+		}
+		fmt.Printf("Cleared %s\n", fs.Arg(1))
+		return nil
+
+	default:
+		return fmt.Errorf("usage: shadowd bans [-api URL] [list | clear <ip:addr|user:name|all>]")
+	}
+}
+
+// runHostKey lists the host keys or performs the next step of rotating one.
+// Rotation rewrites the config file; SIGHUP makes a running shadowd pick it up.
+func runHostKey(args []string) error {
+	fs := flag.NewFlagSet("hostkey", flag.ContinueOnError)
+	path := fs.String("config", "shadowd.yaml", "Path to configuration file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadConfig(*path)
+	if err != nil {
+		return err
+	}
+	paths := ssh.HostKeyPaths(sshHostKeyConfig(cfg))
+
+	action := "list"
+	if fs.NArg() > 0 {
+		action = fs.Arg(0)
+	}
+
+	switch action {
+	case "list":
+		seen := make(map[string]bool)
+		for _, keyPath := range paths {
+			signer, err := ssh.ReadHostKey(keyPath)
+			if err != nil {
+				fmt.Printf("%-50s %v\n", keyPath, err)
+				continue
+			}
+			key := signer.PublicKey()
+			state := "announced"
+			if !seen[key.Type()] {
+				state = "active"
+				seen[key.Type()] = true
+			}
+			fmt.Printf("%-50s %-20s %-9s %s\n", keyPath, key.Type(), state, gossh.FingerprintSHA256(key))
+		}
+		return nil
+
+	case "rotate":
+		rotateFlags := flag.NewFlagSet("rotate", flag.ContinueOnError)
+		keyType := rotateFlags.String("type", ssh.HostKeyEd25519, "Key type to rotate: ed25519, ecdsa or rsa")
+		if err := rotateFlags.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+
+		rotation, err := ssh.RotateHostKeys(paths, *keyType)
+		if err != nil {
+			return err
+		}
+
+		cfg.SSH.HostKeyPath = ""
+		cfg.SSH.HostKeys = rotation.Paths
+		if err := config.SaveConfig(*path, cfg); err != nil {
+			return err
+		}
+
+		if rotation.Added != "" {
+			fmt.Printf("Added %s (%s)\n", rotation.Added, gossh.FingerprintSHA256(rotation.AddedKey))
+			fmt.Println("Reload shadowd (SIGHUP) so clients learn the new key. Once they have connected,")
+			fmt.Println("run 'shadowd hostkey rotate' again to make it active and retire the old key.")
+		}
+		for _, retired := range rotation.Retired {
+			fmt.Printf("Retired %s (renamed to %s.retired)\n", retired, retired)
+		}
+		if len(rotation.Retired) > 0 {
+			fmt.Println("Reload shadowd (SIGHUP) to start using the new key.")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("usage: shadowd hostkey [-config shadowd.yaml] [list | rotate [-type ed25519|ecdsa|rsa]]")
+	}
+}
+
+// sshHostKeyConfig returns the host key part of the SSH server configuration
+func sshHostKeyConfig(cfg *config.Config) ssh.Config {
+	return ssh.Config{
+		HostKeyPath:  cfg.SSH.HostKeyPath,
+		HostKeyPaths: cfg.SSH.HostKeys,
+	}
+}
+
+// runSFTPServer serves one SFTP session on stdin/stdout
+func runSFTPServer(args []string) error {
+	fs := flag.NewFlagSet("sftp-server", flag.ContinueOnError)
+	root := fs.String("root", "", "Directory the session is confined to")
+	home := fs.String("home", "", "Home directory of the account")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return ssh.RunSFTPServer(*root, *home)
+}
+
 // initializeWireGuard initializes and starts the WireGuard manager
 func initializeWireGuard(cfg *config.Config, log *logrus.Logger) *network.WireGuardManager {
 	wgConfig := network.Config{
@@ -222,21 +643,167 @@ func waitForMeshIP(wgManager *network.WireGuardManager, log *logrus.Logger) stri
 	return meshIP
 }
 
+// initializeLockout creates the login failure guard, or returns nil when disabled
+func initializeLockout(cfg *config.Config, log *logrus.Logger) *lockout.Guard {
+	if cfg.Lockout.Disabled {
+		log.Warn("Brute-force protection is disabled")
+		return nil
+	}
+
+	lockoutConfig := lockout.Config{
+		MaxFailures: cfg.Lockout.MaxFailures,
+		Window:      cfg.Lockout.Window,
+		BanDuration: cfg.Lockout.BanDuration,
+		BaseDelay:   cfg.Lockout.BaseDelay,
+		MaxDelay:    cfg.Lockout.MaxDelay,
+		Allowlist:   cfg.Lockout.Allowlist,
+	}
+
+	guard, err := lockout.NewGuard(lockoutConfig, log)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid lockout configuration")
+	}
+
+	return guard
+}
+
+// initializeLimits creates the session limiter, or returns nil when no limit is configured
+func initializeLimits(cfg *config.Config, log *logrus.Logger) *limits.Limiter {
+	sessions := cfg.Sessions
+	if sessions.IdleTimeout <= 0 && sessions.MaxLifetime <= 0 && sessions.MaxPerUser <= 0 && sessions.MaxPerIP <= 0 {
+		return nil
+	}
+
+	limitsConfig := limits.Config{
+		IdleTimeout: sessions.IdleTimeout,
+		MaxLifetime: sessions.MaxLifetime,
+		Warning:     sessions.Warning,
+		MaxPerUser:  sessions.MaxPerUser,
+		MaxPerIP:    sessions.MaxPerIP,
+	}
+
+	log.WithFields(logrus.Fields{
+		"idle_timeout": limitsConfig.IdleTimeout.String(),
+		"max_lifetime": limitsConfig.MaxLifetime.String(),
+		"max_per_user": limitsConfig.MaxPerUser,
+		"max_per_ip":   limitsConfig.MaxPerIP,
+	}).Info("Session limits enabled")
+	return limits.NewLimiter(limitsConfig, log)
+}
+
+// initializeRecording creates the session recording store, or returns nil when disabled
+func initializeRecording(cfg *config.Config, log *logrus.Logger) *recording.Store {
+	if cfg.SSH.Recording.Dir == "" {
+		return nil
+	}
+
+	recordingConfig := recording.Config{
+		Dir:          cfg.SSH.Recording.Dir,
+		RecordInput:  cfg.SSH.Recording.RecordInput,
+		MaxAge:       cfg.SSH.Recording.MaxAge,
+		MaxTotalSize: cfg.SSH.Recording.MaxTotalSize,
+		MaxFileSize:  cfg.SSH.Recording.MaxFileSize,
+	}
+
+	recordings, err := recording.NewStore(recordingConfig, log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize session recording")
+	}
+
+	log.WithFields(logrus.Fields{
+		"dir":          recordingConfig.Dir,
+		"record_input": recordingConfig.RecordInput,
+	}).Info("Session recording enabled")
+	return recordings
+}
+
+// initializeJump parses the jump host policy, or returns nil when no target is allowed
+func initializeJump(cfg *config.Config, log *logrus.Logger) *jump.Policy {
+	if len(cfg.Jump.Targets) == 0 {
+		return nil
+	}
+
+	// Peers run sshd or shadowd, so both ports are allowed unless configured
+	ports := cfg.Jump.Ports
+	if len(ports) == 0 {
+		ports = []int{22, cfg.SSH.Port}
+	}
+
+	knownHosts := cfg.Jump.KnownHosts
+	if knownHosts == "" {
+		knownHosts = filepath.Join(filepath.Dir(ssh.HostKeyPaths(sshHostKeyConfig(cfg))[0]), "jump_known_hosts")
+	}
+
+	jumps, err := jump.NewPolicy(jump.Config{
+		Targets:        cfg.Jump.Targets,
+		Ports:          ports,
+		KnownHostsPath: knownHosts,
+	})
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize jump host policy")
+	}
+
+	log.WithFields(logrus.Fields{
+		"targets":     cfg.Jump.Targets,
+		"ports":       ports,
+		"known_hosts": knownHosts,
+	}).Info("Jump host enabled")
+	return jumps
+}
+
+// initializePairing loads the paired devices, by default from next to the first host key
+func initializePairing(cfg *config.Config, log *logrus.Logger) *pairing.Authority {
+	statePath := cfg.Pairing.StatePath
+	if statePath == "" {
+		statePath = filepath.Join(filepath.Dir(ssh.HostKeyPaths(sshHostKeyConfig(cfg))[0]), "paired_devices.json")
+	}
+
+	tickets, err := pairing.NewAuthority(pairing.Config{
+		StatePath: statePath,
+		CodeTTL:   cfg.Pairing.CodeTTL,
+		TicketTTL: cfg.Pairing.TicketTTL,
+	}, log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize device pairing")
+	}
+
+	if cfg.WebSocket.AllowUnauthenticated {
+		log.Warn("WebSocket clients may connect without a ticket from a paired device")
+	}
+	return tickets
+}
+
 // initializeSSH initializes and starts the SSH server
-func initializeSSH(cfg *config.Config, meshIP string, log *logrus.Logger) *ssh.Server {
+func initializeSSH(cfg *config.Config, meshIP string, services ssh.Services, log *logrus.Logger) *ssh.Server {
 	// Add localhost to allowed networks for WebSocket proxy
 	allowedNetworks := append(cfg.SSH.AllowedNetworks, "127.0.0.1/32")
 	
+	portForwarding := make(map[string]ssh.ForwardPolicy, len(cfg.SSH.PortForwarding))
+	for user, policy := range cfg.SSH.PortForwarding {
+		portForwarding[user] = ssh.ForwardPolicy{Local: policy.Local, Remote: policy.Remote}
+	}
+	
 	sshConfig := ssh.Config{
-		MeshIP:             "127.0.0.1", // Listen on localhost for WebSocket proxy
-		Port:               cfg.SSH.Port,
-		HostKeyPath:        cfg.SSH.HostKeyPath,
-		AuthorizedKeysPath: cfg.SSH.AuthorizedKeysPath,
-		AllowedNetworks:    allowedNetworks,
-		Users:              cfg.SSH.Users,
+		MeshIP:                       "127.0.0.1", // Listen on localhost for WebSocket proxy
+		Port:                         cfg.SSH.Port,
+		HostKeyPath:                  cfg.SSH.HostKeyPath,
+		HostKeyPaths:                 cfg.SSH.HostKeys,
+		AuthorizedKeysPath:           cfg.SSH.AuthorizedKeysPath,
+		AuthorizedKeysReloadInterval: cfg.SSH.KeysReloadInterval,
+		AllowedNetworks:              allowedNetworks,
+		Users:                        cfg.SSH.Users,
+		PermitRootLogin:              cfg.SSH.PermitRootLogin,
+		TOTPSecrets:                  cfg.SSH.TOTP,
+		TrustedUserCAKeysPath:        cfg.SSH.TrustedUserCAKeys,
+		RevokedCertSerials:           cfg.SSH.RevokedCertSerials,
+		SFTPRoots:                    cfg.SSH.SFTPRoots,
+		PortForwarding:               portForwarding,
+		AcceptEnv:                    cfg.SSH.AcceptEnv,
+		KeepAliveInterval:            cfg.SSH.KeepAliveInterval,
+		KeepAliveCountMax:            cfg.SSH.KeepAliveCountMax,
 	}
 
-	sshServer, err := ssh.NewServer(sshConfig, log)
+	sshServer, err := ssh.NewServer(sshConfig, services, log)
 	if err != nil {
 		log.WithError(err).Error("Failed to create SSH server")
 		return nil
@@ -251,7 +818,7 @@ func initializeSSH(cfg *config.Config, meshIP string, log *logrus.Logger) *ssh.S
 }
 
 // initializeGRPC initializes and starts the gRPC server
-func initializeGRPC(cfg *config.Config, meshIP string, log *logrus.Logger) *grpc.Server {
+func initializeGRPC(cfg *config.Config, meshIP string, registry *sessions.Registry, log *logrus.Logger) *grpc.Server {
 	// Collect device information
 	deviceInfo := grpc.GetDeviceInfoFromSystem(meshIP, cfg.SSH.Port, cfg.GRPC.Port)
 	
@@ -261,7 +828,7 @@ func initializeGRPC(cfg *config.Config, meshIP string, log *logrus.Logger) *grpc
 		TLSEnabled: cfg.GRPC.TLSEnabled,
 	}
 
-	grpcServer, err := grpc.NewServer(grpcConfig, deviceInfo, log)
+	grpcServer, err := grpc.NewServer(grpcConfig, deviceInfo, registry, log)
 	if err != nil {
 		log.WithError(err).Error("Failed to create gRPC server")
 		return nil
@@ -276,14 +843,26 @@ func initializeGRPC(cfg *config.Config, meshIP string, log *logrus.Logger) *grpc
 }
 
 // initializeWebSocket initializes and starts the WebSocket SSH proxy
-func initializeWebSocket(cfg *config.Config, log *logrus.Logger) *websocket.Server {
+func initializeWebSocket(cfg *config.Config, services websocket.Services, log *logrus.Logger) *websocket.Server {
+	listenAddr := cfg.WebSocket.ListenAddr
+	if listenAddr == "" {
+		listenAddr = "0.0.0.0:8022" // Listen on all interfaces
+	}
+	
 	wsConfig := websocket.Config{
-		ListenAddr: "0.0.0.0:8022", // Listen on all interfaces
-		SSHHost:    "127.0.0.1",    // Use IPv4 localhost
-		SSHPort:    cfg.SSH.Port,   // Connect to shadowd SSH server
+		ListenAddr:           listenAddr,
+		SSHHost:              "127.0.0.1",  // Use IPv4 localhost
+		SSHPort:              cfg.SSH.Port, // Connect to shadowd SSH server
+		ResumeGracePeriod:    cfg.WebSocket.ResumeGracePeriod,
+		ResumeBufferSize:     cfg.WebSocket.ResumeBufferSize,
+		PingInterval:         cfg.WebSocket.PingInterval,
+		PongTimeout:          cfg.WebSocket.PongTimeout,
+		AllowedOrigins:       cfg.WebSocket.AllowedOrigins,
+		AllowUnauthenticated: cfg.WebSocket.AllowUnauthenticated,
+		AcceptEnv:            cfg.SSH.AcceptEnv, // one policy for env requests over either transport
 	}
 
-	wsServer := websocket.NewServer(wsConfig, log)
+	wsServer := websocket.NewServer(wsConfig, services, log)
 
 	if err := wsServer.Start(); err != nil {
 		log.WithError(err).Error("Failed to start WebSocket server")
@@ -294,12 +873,12 @@ func initializeWebSocket(cfg *config.Config, log *logrus.Logger) *websocket.Serv
 }
 
 // initializeHTTP initializes and starts the HTTP API server
-func initializeHTTP(grpcServer *grpc.Server, log *logrus.Logger) *http.Server {
+func initializeHTTP(grpcServer *grpc.Server, services http.Services, log *logrus.Logger) *http.Server {
 	httpConfig := http.Config{
 		ListenAddr: "0.0.0.0:8080", // HTTP API on port 8080
 	}
 
-	httpServer := http.NewServer(httpConfig, grpcServer, log)
+	httpServer := http.NewServer(httpConfig, grpcServer, services, log)
 
 	if err := httpServer.Start(); err != nil {
 		log.WithError(err).Error("Failed to start HTTP server")
@@ -0,0 +1,505 @@
+package pairing
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Errors returned by the Authority
+var (
+	ErrInvalidCode     = errors.New("invalid or expired pairing code")
+	ErrInvalidDeviceID = errors.New("device ID must be 1-128 letters, digits or ._:-")
+	ErrDeviceExists    = errors.New("device already paired")
+	ErrInvalidToken    = errors.New("invalid device token")
+	ErrInvalidTicket   = errors.New("invalid or expired ticket")
+	ErrNotFound        = errors.New("device not paired")
+)
+
+// Defaults for pairing codes and tickets
+const (
+	defaultCodeTTL   = 10 * time.Minute
+	defaultTicketTTL = time.Minute
+)
+
+// validDeviceID matches the device IDs clients may pair with
+var validDeviceID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// b64 is the encoding of tokens and tickets, safe in URLs and headers
+var b64 = base64.RawURLEncoding
+
+// Config contains pairing settings
+type Config struct {
+	// StatePath is the file paired devices and the ticket signing key are kept
+	// in; it is created with mode 0600
+	StatePath string
+
+	// CodeTTL is how long a pairing code can be used (default: 10m)
+	CodeTTL time.Duration
+
+	// TicketTTL is how long a ticket is valid (default: 1m)
+	TicketTTL time.Duration
+}
+
+// Device is a paired client device
+type Device struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name,omitempty"`
+	User     string    `json:"user"` // account the device logs in as
+	PairedAt time.Time `json:"pairedAt"`
+	LastSeen time.Time `json:"lastSeen"` // when it last got a ticket
+}
+
+// Ticket is a short-lived credential of a paired device
+type Ticket struct {
+	Ticket    string    `json:"ticket"`
+	DeviceID  string    `json:"deviceId"`
+	User      string    `json:"user"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Grant is what a verified ticket allows
+type Grant struct {
+	DeviceID  string
+	User      string
+	ExpiresAt time.Time
+}
+
+// ticketClaims is the signed part of a ticket
+type ticketClaims struct {
+	DeviceID string `json:"d"`
+	User     string `json:"u"`
+	Expires  int64  `json:"e"`
+}
+
+// pairedDevice is a device with the hash of its token, as stored
+type pairedDevice struct {
+	Device
+	TokenHash string `json:"tokenHash"`
+}
+
+// state is the content of the state file
+type state struct {
+	Key     []byte          `json:"key"`
+	Devices []*pairedDevice `json:"devices"`
+}
+
+// pendingCode is a pairing code that has not been used yet
+type pendingCode struct {
+	user    string
+	expires time.Time
+}
+
+// Authority pairs client devices and issues and verifies their tickets.
+// A nil *Authority has no paired devices and accepts no ticket.
+type Authority struct {
+	config Config
+	log    *logrus.Logger
+
+	mu      sync.Mutex
+	key     []byte
+	devices map[string]*pairedDevice
+	codes   map[string]pendingCode
+	now     func() time.Time
+
+	// Called with the ID of each device unpaired, to end its sessions
+	onUnpair []func(deviceID string)
+}
+
+// NewAuthority loads the paired devices from the state file, creating it with
+// a new signing key if it does not exist
+func NewAuthority(cfg Config, log *logrus.Logger) (*Authority, error) {
+	if log == nil {
+		log = logrus.New()
+	}
+	if cfg.StatePath == "" {
+		return nil, fmt.Errorf("state path is required")
+	}
+	if cfg.CodeTTL <= 0 {
+		cfg.CodeTTL = defaultCodeTTL
+	}
+	if cfg.TicketTTL <= 0 {
+		cfg.TicketTTL = defaultTicketTTL
+	}
+
+	a := &Authority{
+		config:  cfg,
+		log:     log,
+		devices: make(map[string]*pairedDevice),
+		codes:   make(map[string]pendingCode),
+		now:     time.Now,
+	}
+
+	data, err := os.ReadFile(cfg.StatePath)
+	switch {
+	case err == nil:
+		var st state
+		if err := json.Unmarshal(data, &st); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", cfg.StatePath, err)
+		}
+		if len(st.Key) < sha256.Size {
+			return nil, fmt.Errorf("%s has no valid signing key", cfg.StatePath)
+		}
+		a.key = st.Key
+		for _, d := range st.Devices {
+			a.devices[d.ID] = d
+		}
+
+	case errors.Is(err, os.ErrNotExist):
+		a.key = make([]byte, sha256.Size)
+		if _, err := rand.Read(a.key); err != nil {
+			return nil, fmt.Errorf("failed to generate signing key: %w", err)
+		}
+		if err := a.save(); err != nil {
+			return nil, err
+		}
+		log.WithField("path", cfg.StatePath).Info("Created pairing state")
+
+	default:
+		return nil, fmt.Errorf("failed to read %s: %w", cfg.StatePath, err)
+	}
+
+	return a, nil
+}
+
+// NewCode returns a one-time pairing code for a device that will log in as
+// user, and when it expires. The code is shown to the device, usually in the
+// pairing QR code.
+func (a *Authority) NewCode(user string) (string, time.Time, error) {
+	if a == nil {
+		return "", time.Time{}, fmt.Errorf("pairing is disabled")
+	}
+	if user == "" {
+		return "", time.Time{}, fmt.Errorf("user is required")
+	}
+
+	code, err := randomString(10)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	for c, pending := range a.codes {
+		if now.After(pending.expires) {
+			delete(a.codes, c)
+		}
+	}
+
+	expires := now.Add(a.config.CodeTTL)
+	a.codes[code] = pendingCode{user: user, expires: expires}
+
+	a.log.WithFields(logrus.Fields{
+		"user":       user,
+		"expires_at": expires,
+	}).Info("Pairing code created")
+	return code, expires, nil
+}
+
+// Pair redeems a pairing code for the device with the given ID and name and
+// returns the device and its token. A device that is already paired must be
+// unpaired before it can pair again; the code stays usable until then.
+func (a *Authority) Pair(code, deviceID, name string) (Device, string, error) {
+	if a == nil {
+		return Device{}, "", ErrInvalidCode
+	}
+	if !validDeviceID.MatchString(deviceID) {
+		return Device{}, "", ErrInvalidDeviceID
+	}
+
+	token, err := randomString(32)
+	if err != nil {
+		return Device{}, "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	pending, ok := a.lookupCode(code)
+	if !ok || now.After(pending.expires) {
+		return Device{}, "", ErrInvalidCode
+	}
+	if _, exists := a.devices[deviceID]; exists {
+		return Device{}, "", ErrDeviceExists
+	}
+	delete(a.codes, code)
+
+	device := &pairedDevice{
+		Device: Device{
+			ID:       deviceID,
+			Name:     name,
+			User:     pending.user,
+			PairedAt: now,
+		},
+		TokenHash: hashToken(token),
+	}
+	a.devices[deviceID] = device
+	if err := a.save(); err != nil {
+		delete(a.devices, deviceID)
+		return Device{}, "", err
+	}
+
+	a.log.WithFields(logrus.Fields{
+		"device": deviceID,
+		"name":   name,
+		"user":   pending.user,
+	}).Info("Device paired")
+	return device.Device, token, nil
+}
+
+// Issue returns a new ticket for the device the token belongs to
+func (a *Authority) Issue(token string) (Ticket, error) {
+	if a == nil {
+		return Ticket{}, ErrInvalidToken
+	}
+
+	hash := hashToken(token)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var device *pairedDevice
+	for _, d := range a.devices {
+		if subtle.ConstantTimeCompare([]byte(d.TokenHash), []byte(hash)) == 1 {
+			device = d
+		}
+	}
+	if device == nil {
+		return Ticket{}, ErrInvalidToken
+	}
+
+	// Last use is informational, so failing to persist it does not refuse the ticket
+	device.LastSeen = a.now()
+	if err := a.save(); err != nil {
+		a.log.WithError(err).Warn("Failed to save pairing state")
+	}
+	return a.sign(device.Device)
+}
+
+// Renew returns a fresh ticket for a verified grant, as long as its device is
+// still paired to the same user
+func (a *Authority) Renew(grant Grant) (Ticket, error) {
+	if a == nil {
+		return Ticket{}, ErrInvalidTicket
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	device, ok := a.devices[grant.DeviceID]
+	if !ok || device.User != grant.User {
+		return Ticket{}, ErrNotFound
+	}
+	return a.sign(device.Device)
+}
+
+// Verify checks a ticket's signature and expiry, and that its device is still
+// paired to the same user
+func (a *Authority) Verify(ticket string) (Grant, error) {
+	if a == nil {
+		return Grant{}, ErrInvalidTicket
+	}
+
+	payload, sig, ok := strings.Cut(ticket, ".")
+	if !ok {
+		return Grant{}, ErrInvalidTicket
+	}
+	mac, err := b64.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, a.mac(payload)) {
+		return Grant{}, ErrInvalidTicket
+	}
+
+	data, err := b64.DecodeString(payload)
+	if err != nil {
+		return Grant{}, ErrInvalidTicket
+	}
+	var claims ticketClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return Grant{}, ErrInvalidTicket
+	}
+
+	expires := time.Unix(claims.Expires, 0)
+	if a.now().After(expires) {
+		return Grant{}, ErrInvalidTicket
+	}
+
+	a.mu.Lock()
+	device, ok := a.devices[claims.DeviceID]
+	a.mu.Unlock()
+	if !ok || device.User != claims.User {
+		return Grant{}, ErrInvalidTicket
+	}
+
+	return Grant{
+		DeviceID:  claims.DeviceID,
+		User:      claims.User,
+		ExpiresAt: expires,
+	}, nil
+}
+
+// Devices returns the paired devices, oldest first
+func (a *Authority) Devices() []Device {
+	if a == nil {
+		return []Device{}
+	}
+
+	a.mu.Lock()
+	devices := make([]Device, 0, len(a.devices))
+	for _, d := range a.devices {
+		devices = append(devices, d.Device)
+	}
+	a.mu.Unlock()
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].PairedAt.Before(devices[j].PairedAt)
+	})
+	return devices
+}
+
+// OnUnpair registers fn to be called with the ID of every device unpaired,
+// after its token and tickets have stopped working
+func (a *Authority) OnUnpair(fn func(deviceID string)) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	a.onUnpair = append(a.onUnpair, fn)
+	a.mu.Unlock()
+}
+
+// Unpair removes a paired device; its token and tickets stop working at once,
+// and the OnUnpair callbacks end the sessions it has open
+func (a *Authority) Unpair(deviceID string) error {
+	if a == nil {
+		return ErrNotFound
+	}
+
+	a.mu.Lock()
+	device, ok := a.devices[deviceID]
+	if !ok {
+		a.mu.Unlock()
+		return ErrNotFound
+	}
+	delete(a.devices, deviceID)
+	if err := a.save(); err != nil {
+		a.devices[deviceID] = device
+		a.mu.Unlock()
+		return err
+	}
+	callbacks := append([]func(string){}, a.onUnpair...)
+	a.mu.Unlock()
+
+	a.log.WithFields(logrus.Fields{
+		"device": deviceID,
+		"user":   device.User,
+	}).Info("Device unpaired")
+
+	for _, fn := range callbacks {
+		fn(deviceID)
+	}
+	return nil
+}
+
+// lookupCode finds a pending code in constant time per entry; a.mu must be held
+func (a *Authority) lookupCode(code string) (pendingCode, bool) {
+	var found pendingCode
+	ok := false
+	for c, pending := range a.codes {
+		if subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+			found, ok = pending, true
+		}
+	}
+	return found, ok
+}
+
+// sign returns a ticket for device, valid for TicketTTL
+func (a *Authority) sign(device Device) (Ticket, error) {
+	expires := a.now().Add(a.config.TicketTTL).Truncate(time.Second)
+	data, err := json.Marshal(ticketClaims{
+		DeviceID: device.ID,
+		User:     device.User,
+		Expires:  expires.Unix(),
+	})
+	if err != nil {
+		return Ticket{}, err
+	}
+
+	payload := b64.EncodeToString(data)
+	return Ticket{
+		Ticket:    payload + "." + b64.EncodeToString(a.mac(payload)),
+		DeviceID:  device.ID,
+		User:      device.User,
+		ExpiresAt: expires,
+	}, nil
+}
+
+// mac returns the signature of a ticket payload
+func (a *Authority) mac(payload string) []byte {
+	h := hmac.New(sha256.New, a.key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// save writes the state file atomically; a.mu must be held or a not yet shared
+func (a *Authority) save() error {
+	st := state{Key: a.key, Devices: make([]*pairedDevice, 0, len(a.devices))}
+	for _, d := range a.devices {
+		st.Devices = append(st.Devices, d)
+	}
+	sort.Slice(st.Devices, func(i, j int) bool {
+		return st.Devices[i].PairedAt.Before(st.Devices[j].PairedAt)
+	})
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(a.config.StatePath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	tmp := a.config.StatePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write pairing state: %w", err)
+	}
+	if err := os.Rename(tmp, a.config.StatePath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write pairing state: %w", err)
+	}
+	return nil
+}
+
+// hashToken returns the stored form of a device token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns n random bytes, encoded for URLs
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random value: %w", err)
+	}
+	return b64.EncodeToString(b), nil
+}
@@ -0,0 +1,282 @@
+package pairing
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestAuthority returns an authority keeping its state in a temporary directory
+func newTestAuthority(t *testing.T, cfg Config) *Authority {
+	t.Helper()
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	cfg.StatePath = filepath.Join(t.TempDir(), "pairing.json")
+	a, err := NewAuthority(cfg, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// pairDevice pairs a device to user and returns its token
+func pairDevice(t *testing.T, a *Authority, deviceID, user string) string {
+	t.Helper()
+
+	code, _, err := a.NewCode(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := a.Pair(code, deviceID, deviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestUnpair(t *testing.T) {
+	a := newTestAuthority(t, Config{})
+	phoneToken := pairDevice(t, a, "phone", "alice")
+	pairDevice(t, a, "tablet", "alice")
+
+	ticket, err := a.Issue(phoneToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var unpaired []string
+	a.OnUnpair(func(deviceID string) {
+		// The device must already be gone when its sessions are ended
+		if _, err := a.Verify(ticket.Ticket); err == nil {
+			t.Error("ticket still valid in the unpair callback")
+		}
+		unpaired = append(unpaired, deviceID)
+	})
+
+	if err := a.Unpair("phone"); err != nil {
+		t.Fatal(err)
+	}
+	if len(unpaired) != 1 || unpaired[0] != "phone" {
+		t.Errorf("callback got %v, want [phone]", unpaired)
+	}
+	if _, err := a.Issue(phoneToken); err != ErrInvalidToken {
+		t.Errorf("Issue with the unpaired token = %v, want ErrInvalidToken", err)
+	}
+	if _, err := a.Renew(Grant{DeviceID: "phone", User: "alice"}); err != ErrNotFound {
+		t.Errorf("Renew for the unpaired device = %v, want ErrNotFound", err)
+	}
+	if devices := a.Devices(); len(devices) != 1 || devices[0].ID != "tablet" {
+		t.Errorf("devices = %+v, want only the tablet", devices)
+	}
+
+	if err := a.Unpair("phone"); err != ErrNotFound {
+		t.Errorf("second Unpair = %v, want ErrNotFound", err)
+	}
+	if len(unpaired) != 1 {
+		t.Errorf("callback called for a device that was not paired")
+	}
+}
+
+func TestUnpairPersists(t *testing.T) {
+	a := newTestAuthority(t, Config{})
+	pairDevice(t, a, "phone", "alice")
+	if err := a.Unpair("phone"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewAuthority(a.config, a.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devices := reloaded.Devices(); len(devices) != 0 {
+		t.Errorf("unpaired device back after a restart: %+v", devices)
+	}
+}
+
+func TestNilAuthority(t *testing.T) {
+	var a *Authority
+	a.OnUnpair(func(string) { t.Error("callback called on a nil authority") })
+	if err := a.Unpair("phone"); err != ErrNotFound {
+		t.Errorf("Unpair = %v, want ErrNotFound", err)
+	}
+	if _, err := a.Verify("x.y"); err != ErrInvalidTicket {
+		t.Errorf("Verify = %v, want ErrInvalidTicket", err)
+	}
+	if len(a.Devices()) != 0 {
+		t.Error("nil authority has devices")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	a := newTestAuthority(t, Config{TicketTTL: time.Minute})
+	token := pairDevice(t, a, "phone", "alice")
+	ticket, err := a.Issue(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, _ := strings.Cut(ticket.Ticket, ".")
+
+	// The same claims with a later expiry, keeping the original signature
+	data, err := json.Marshal(ticketClaims{DeviceID: "phone", User: "alice", Expires: ticket.ExpiresAt.Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := b64.EncodeToString(data) + "." + sig
+
+	// A valid ticket from an authority with another key
+	other := newTestAuthority(t, Config{})
+	otherTicket, err := other.Issue(pairDevice(t, other, "phone", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ticket  string
+		wantErr bool
+	}{
+		{"valid", ticket.Ticket, false},
+		{"claims changed", forged, true},
+		{"signature changed", payload + "." + b64.EncodeToString([]byte("not a signature")), true},
+		{"signature missing", payload, true},
+		{"signed with another key", otherTicket.Ticket, true},
+		{"empty", "", true},
+		{"garbage", "not.a-ticket", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grant, err := a.Verify(tt.ticket)
+			if tt.wantErr {
+				if err != ErrInvalidTicket {
+					t.Errorf("Verify = %+v, %v, want ErrInvalidTicket", grant, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if grant.DeviceID != "phone" || grant.User != "alice" || !grant.ExpiresAt.Equal(ticket.ExpiresAt) {
+				t.Errorf("grant = %+v", grant)
+			}
+		})
+	}
+}
+
+func TestTicketExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a := newTestAuthority(t, Config{TicketTTL: time.Minute})
+	a.now = func() time.Time { return now }
+
+	ticket, err := a.Issue(pairDevice(t, a, "phone", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(time.Minute); !ticket.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v", ticket.ExpiresAt, want)
+	}
+
+	now = now.Add(time.Minute)
+	grant, err := a.Verify(ticket.Ticket)
+	if err != nil {
+		t.Fatalf("Verify at expiry: %v", err)
+	}
+
+	now = now.Add(time.Second)
+	if _, err := a.Verify(ticket.Ticket); err != ErrInvalidTicket {
+		t.Errorf("Verify after expiry = %v, want ErrInvalidTicket", err)
+	}
+
+	// An expired grant can be renewed while its device is still paired
+	renewed, err := a.Renew(grant)
+	if err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+	if _, err := a.Verify(renewed.Ticket); err != nil {
+		t.Errorf("Verify renewed ticket: %v", err)
+	}
+	if _, err := a.Renew(Grant{DeviceID: "phone", User: "bob"}); err != ErrNotFound {
+		t.Errorf("Renew for another user = %v, want ErrNotFound", err)
+	}
+}
+
+func TestPairingCode(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a := newTestAuthority(t, Config{CodeTTL: 10 * time.Minute})
+	a.now = func() time.Time { return now }
+
+	code, expires, err := a.NewCode("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(10 * time.Minute); !expires.Equal(want) {
+		t.Errorf("expires = %v, want %v", expires, want)
+	}
+	expired, _, err := a.NewCode("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := a.Pair("wrong-code", "phone", "Phone"); err != ErrInvalidCode {
+		t.Errorf("Pair with an unknown code = %v, want ErrInvalidCode", err)
+	}
+	if _, _, err := a.Pair(code, "bad id!", "Phone"); err != ErrInvalidDeviceID {
+		t.Errorf("Pair with an invalid device ID = %v, want ErrInvalidDeviceID", err)
+	}
+
+	device, token, err := a.Pair(code, "phone", "Phone")
+	if err != nil {
+		t.Fatalf("Pair: %v", err)
+	}
+	if device.User != "alice" || token == "" {
+		t.Errorf("Pair = %+v, %q", device, token)
+	}
+	if _, _, err := a.Pair(code, "tablet", "Tablet"); err != ErrInvalidCode {
+		t.Errorf("reusing a code = %v, want ErrInvalidCode", err)
+	}
+
+	now = now.Add(10*time.Minute + time.Second)
+	if _, _, err := a.Pair(expired, "tablet", "Tablet"); err != ErrInvalidCode {
+		t.Errorf("Pair with an expired code = %v, want ErrInvalidCode", err)
+	}
+}
+
+func TestPairExistingDevice(t *testing.T) {
+	a := newTestAuthority(t, Config{})
+	token := pairDevice(t, a, "phone", "alice")
+
+	code, _, err := a.NewCode("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Pair(code, "phone", "Phone"); err != ErrDeviceExists {
+		t.Fatalf("Pair of a paired device = %v, want ErrDeviceExists", err)
+	}
+
+	// The paired device keeps its token and user
+	ticket, err := a.Issue(token)
+	if err != nil {
+		t.Fatalf("Issue after a refused pairing: %v", err)
+	}
+	if ticket.User != "alice" {
+		t.Errorf("ticket user = %q, want alice", ticket.User)
+	}
+
+	// Once unpaired, the ID can pair again with the code that was refused
+	if err := a.Unpair("phone"); err != nil {
+		t.Fatal(err)
+	}
+	device, _, err := a.Pair(code, "phone", "Phone")
+	if err != nil {
+		t.Fatalf("Pair after unpairing: %v", err)
+	}
+	if device.User != "bob" {
+		t.Errorf("device user = %q, want bob", device.User)
+	}
+}
@@ -0,0 +1,494 @@
+package recording
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNotFound is returned by Open when no recording has the given ID
+var ErrNotFound = errors.New("recording not found")
+
+// fileExt is the extension of asciicast files
+const fileExt = ".cast"
+
+// validID matches the IDs generated by Start, so an ID can never escape Dir
+var validID = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}Z-[0-9a-f]{12}$`)
+
+// Config contains session recording settings
+type Config struct {
+	// Dir is the directory recordings are written to; it is created with mode 0700
+	Dir string
+
+	// RecordInput also records what the client typed ("i" events).
+	// Off by default because input includes passwords typed at prompts.
+	RecordInput bool
+
+	// MaxAge is how long recordings are kept (0 keeps them forever)
+	MaxAge time.Duration
+
+	// MaxTotalSize caps the size of all recordings in bytes; the oldest are
+	// deleted first (0 disables the cap)
+	MaxTotalSize int64
+
+	// MaxFileSize caps a single recording in bytes; recording stops once it is
+	// reached but the session continues (0 disables the cap)
+	MaxFileSize int64
+}
+
+// Info describes a recording
+type Info struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	RemoteIP  string    `json:"remoteIp"`
+	StartedAt time.Time `json:"startedAt"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Size      int64     `json:"size"`
+	Active    bool      `json:"active"`
+}
+
+// header is the first line of an asciicast v2 file. User and RemoteIP are
+// extra keys, which asciinema players ignore.
+type header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	User      string            `json:"user,omitempty"`
+	RemoteIP  string            `json:"remote_ip,omitempty"`
+}
+
+// Store manages the recordings directory.
+// A nil *Store disables recording.
+type Store struct {
+	config Config
+	log    *logrus.Logger
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+// NewStore creates the recordings directory and applies the retention policy once
+func NewStore(cfg Config, log *logrus.Logger) (*Store, error) {
+	if log == nil {
+		log = logrus.New()
+	}
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("recording directory is required")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	s := &Store{
+		config: cfg,
+		log:    log,
+		active: make(map[string]bool),
+	}
+	s.Prune()
+	return s, nil
+}
+
+// Start begins recording a PTY session of the given terminal size.
+// It returns nil when s is nil or the file cannot be created.
+func (s *Store) Start(user, remoteIP, term string, width, height int) *Recorder {
+	if s == nil {
+		return nil
+	}
+
+	s.Prune()
+
+	now := time.Now()
+	id, err := newID(now)
+	if err != nil {
+		s.log.WithError(err).Error("Failed to generate recording ID")
+		return nil
+	}
+
+	file, err := os.OpenFile(s.path(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		s.log.WithError(err).Error("Failed to create session recording")
+		return nil
+	}
+
+	r := &Recorder{
+		store:       s,
+		id:          id,
+		file:        file,
+		start:       now,
+		recordInput: s.config.RecordInput,
+		maxSize:     s.config.MaxFileSize,
+	}
+
+	hdr := header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: now.Unix(),
+		Title:     fmt.Sprintf("%s@%s", user, remoteIP),
+		Env:       map[string]string{"TERM": term},
+		User:      user,
+		RemoteIP:  remoteIP,
+	}
+	if err := r.writeLine(hdr); err != nil {
+		s.log.WithError(err).Error("Failed to write recording header")
+		file.Close()
+		os.Remove(s.path(id))
+		return nil
+	}
+
+	s.mu.Lock()
+	s.active[id] = true
+	s.mu.Unlock()
+
+	s.log.WithFields(logrus.Fields{
+		"recording": id,
+		"user":      user,
+		"remote_ip": remoteIP,
+	}).Info("Session recording started")
+	return r
+}
+
+// List returns all recordings, newest first
+func (s *Store) List() ([]Info, error) {
+	entries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recording directory: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := []Info{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), fileExt)
+		if !ok || !validID.MatchString(id) {
+			continue
+		}
+		info, err := s.stat(id)
+		if err != nil {
+			s.log.WithError(err).WithField("recording", id).Warn("Skipping unreadable recording")
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.After(infos[j].StartedAt)
+	})
+	return infos, nil
+}
+
+// Open opens a recording for reading. Recordings still in progress can be
+// opened; they contain everything flushed so far.
+func (s *Store) Open(id string) (*os.File, Info, error) {
+	if !validID.MatchString(id) {
+		return nil, Info{}, ErrNotFound
+	}
+
+	s.mu.Lock()
+	info, err := s.stat(id)
+	s.mu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, Info{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, Info{}, err
+	}
+
+	file, err := os.Open(s.path(id))
+	if err != nil {
+		return nil, Info{}, err
+	}
+	return file, info, nil
+}
+
+// Prune deletes recordings older than MaxAge, then the oldest recordings until
+// the directory fits in MaxTotalSize. Recordings in progress are never deleted.
+func (s *Store) Prune() {
+	if s == nil || (s.config.MaxAge <= 0 && s.config.MaxTotalSize <= 0) {
+		return
+	}
+
+	entries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		s.log.WithError(err).Warn("Failed to read recording directory")
+		return
+	}
+
+	type file struct {
+		id      string
+		size    int64
+		modTime time.Time
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var files []file
+	var total int64
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), fileExt)
+		if !ok || !validID.MatchString(id) {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{id: id, size: fi.Size(), modTime: fi.ModTime()})
+		total += fi.Size()
+	}
+
+	// IDs start with the UTC start time, so they sort oldest first
+	sort.Slice(files, func(i, j int) bool { return files[i].id < files[j].id })
+
+	now := time.Now()
+	for _, f := range files {
+		if s.active[f.id] {
+			continue
+		}
+		expired := s.config.MaxAge > 0 && now.Sub(f.modTime) > s.config.MaxAge
+		overCap := s.config.MaxTotalSize > 0 && total > s.config.MaxTotalSize
+		if !expired && !overCap {
+			continue
+		}
+		if err := os.Remove(s.path(f.id)); err != nil {
+			s.log.WithError(err).WithField("recording", f.id).Warn("Failed to delete recording")
+			continue
+		}
+		total -= f.size
+		s.log.WithFields(logrus.Fields{
+			"recording": f.id,
+			"expired":   expired,
+		}).Info("Deleted session recording by retention policy")
+	}
+}
+
+// stat reads the header of a recording. s.mu must be held.
+func (s *Store) stat(id string) (Info, error) {
+	file, err := os.Open(s.path(id))
+	if err != nil {
+		return Info{}, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return Info{}, err
+	}
+
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return Info{}, fmt.Errorf("failed to read header: %w", err)
+	}
+	var hdr header
+	if err := json.Unmarshal(line, &hdr); err != nil {
+		return Info{}, fmt.Errorf("invalid header: %w", err)
+	}
+
+	return Info{
+		ID:        id,
+		User:      hdr.User,
+		RemoteIP:  hdr.RemoteIP,
+		StartedAt: time.Unix(hdr.Timestamp, 0).UTC(),
+		Width:     hdr.Width,
+		Height:    hdr.Height,
+		Size:      fi.Size(),
+		Active:    s.active[id],
+	}, nil
+}
+
+// finish marks a recording as no longer in progress
+func (s *Store) finish(id string) {
+	s.mu.Lock()
+	delete(s.active, id)
+	s.mu.Unlock()
+}
+
+// path returns the file path of a recording
+func (s *Store) path(id string) string {
+	return filepath.Join(s.config.Dir, id+fileExt)
+}
+
+// newID returns "<UTC start time>-<random hex>"
+func newID(now time.Time) (string, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return now.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(buf), nil
+}
+
+// Recorder writes one session to an asciicast v2 file.
+// Its methods are safe for concurrent use and do nothing on a nil *Recorder.
+type Recorder struct {
+	store       *Store
+	id          string
+	start       time.Time
+	recordInput bool
+	maxSize     int64
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	stopped bool
+
+	// Trailing bytes of an incomplete UTF-8 sequence, per stream
+	pendingOut []byte
+	pendingIn  []byte
+}
+
+// ID returns the recording ID
+func (r *Recorder) ID() string {
+	if r == nil {
+		return ""
+	}
+	return r.id
+}
+
+// Write records terminal output. It never fails, so it can sit in an
+// io.MultiWriter next to the session without breaking it.
+func (r *Recorder) Write(p []byte) (int, error) {
+	if r == nil {
+		return len(p), nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pendingOut = r.event("o", r.pendingOut, p)
+	return len(p), nil
+}
+
+// Input returns a writer that records terminal input, or a no-op writer when
+// input recording is disabled
+func (r *Recorder) Input() *InputWriter {
+	return &InputWriter{r: r}
+}
+
+// Resize records a terminal size change
+func (r *Recorder) Resize(width, height int) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.emit("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+// Close flushes and closes the recording
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+	r.stopped = true
+	r.store.finish(r.id)
+
+	r.store.log.WithFields(logrus.Fields{
+		"recording": r.id,
+		"size":      r.size,
+	}).Info("Session recording finished")
+	return err
+}
+
+// InputWriter records terminal input of a Recorder
+type InputWriter struct {
+	r *Recorder
+}
+
+// Write records p as input; like Recorder.Write it never fails
+func (iw *InputWriter) Write(p []byte) (int, error) {
+	r := iw.r
+	if r == nil || !r.recordInput {
+		return len(p), nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pendingIn = r.event("i", r.pendingIn, p)
+	return len(p), nil
+}
+
+// event records data prefixed with the pending bytes of its stream, holding
+// back an incomplete UTF-8 sequence at the end. It returns the new pending bytes.
+// r.mu must be held.
+func (r *Recorder) event(kind string, pending, p []byte) []byte {
+	data := append(pending, p...)
+
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+
+	if cut > 0 {
+		r.emit(kind, string(data[:cut]))
+	}
+	return append([]byte(nil), data[cut:]...)
+}
+
+// emit writes one event line. r.mu must be held.
+func (r *Recorder) emit(kind, data string) {
+	if r.stopped {
+		return
+	}
+
+	elapsed := time.Since(r.start).Seconds()
+	if err := r.writeLine([]interface{}{elapsed, kind, data}); err != nil {
+		r.store.log.WithError(err).WithField("recording", r.id).Error("Failed to write session recording, stopping it")
+		r.stopped = true
+		return
+	}
+
+	if r.maxSize > 0 && r.size >= r.maxSize {
+		r.writeLine([]interface{}{elapsed, "m", "recording stopped: size limit reached"})
+		r.stopped = true
+		r.store.log.WithFields(logrus.Fields{
+			"recording": r.id,
+			"size":      r.size,
+		}).Warn("Session recording reached its size limit, recording stopped")
+	}
+}
+
+// writeLine appends v as one line of JSON. Lines go straight to the file so
+// that recordings in progress can be streamed.
+func (r *Recorder) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	return err
+}
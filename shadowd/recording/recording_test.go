@@ -0,0 +1,299 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestStore(t *testing.T, cfg Config) *Store {
+	t.Helper()
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	if cfg.Dir == "" {
+		cfg.Dir = t.TempDir()
+	}
+	s, err := NewStore(cfg, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// event is one decoded asciicast event line
+type event struct {
+	Time float64
+	Kind string
+	Data string
+}
+
+// readCast decodes the recording with the given ID
+func readCast(t *testing.T, s *Store, id string) (header, []event) {
+	t.Helper()
+
+	file, _, err := s.Open(id)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", id, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		t.Fatal("recording has no header")
+	}
+	var hdr header
+	if err := json.Unmarshal(scanner.Bytes(), &hdr); err != nil {
+		t.Fatalf("header: %v", err)
+	}
+
+	var events []event
+	for scanner.Scan() {
+		var raw []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil || len(raw) != 3 {
+			t.Fatalf("event %q: %v", scanner.Text(), err)
+		}
+		e := event{Kind: raw[1].(string), Data: raw[2].(string)}
+		e.Time, _ = raw[0].(float64)
+		events = append(events, e)
+	}
+	return hdr, events
+}
+
+func TestRecording(t *testing.T) {
+	s := newTestStore(t, Config{})
+
+	r := s.Start("alice", "203.0.113.1", "xterm-256color", 80, 24)
+	if r == nil {
+		t.Fatal("Start returned nil")
+	}
+	if !validID.MatchString(r.ID()) {
+		t.Errorf("ID %q does not match validID", r.ID())
+	}
+
+	r.Write([]byte("hello "))
+	r.Write([]byte{0xc3}) // first byte of "é", held back until the rest arrives
+	r.Write([]byte{0xa9, '!'})
+	r.Resize(100, 30)
+	r.Input().Write([]byte("typed")) // input is not recorded by default
+
+	infos, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || !infos[0].Active {
+		t.Errorf("List during the session = %+v, want one active recording", infos)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("after close"))
+
+	hdr, events := readCast(t, s, r.ID())
+	if hdr.Version != 2 || hdr.Width != 80 || hdr.Height != 24 {
+		t.Errorf("header = %+v, want version 2, 80x24", hdr)
+	}
+	if hdr.User != "alice" || hdr.RemoteIP != "203.0.113.1" || hdr.Title != "alice@203.0.113.1" {
+		t.Errorf("header = %+v, want alice from 203.0.113.1", hdr)
+	}
+	if hdr.Env["TERM"] != "xterm-256color" {
+		t.Errorf("header env = %v, want TERM", hdr.Env)
+	}
+	if since := time.Since(time.Unix(hdr.Timestamp, 0)); since < 0 || since > time.Minute {
+		t.Errorf("header timestamp %d is not the start time", hdr.Timestamp)
+	}
+
+	want := []event{{Kind: "o", Data: "hello "}, {Kind: "o", Data: "é!"}, {Kind: "r", Data: "100x30"}}
+	if len(events) != len(want) {
+		t.Fatalf("events = %+v, want %+v", events, want)
+	}
+	last := 0.0
+	for i, e := range events {
+		if e.Kind != want[i].Kind || e.Data != want[i].Data {
+			t.Errorf("event %d = %+v, want %+v", i, e, want[i])
+		}
+		if e.Time < last {
+			t.Errorf("event %d at %f goes back in time", i, e.Time)
+		}
+		last = e.Time
+	}
+
+	infos, err = s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Active || infos[0].User != "alice" || infos[0].Width != 80 {
+		t.Errorf("List after the session = %+v", infos)
+	}
+}
+
+func TestRecordInput(t *testing.T) {
+	s := newTestStore(t, Config{RecordInput: true})
+
+	r := s.Start("alice", "203.0.113.1", "xterm", 80, 24)
+	r.Input().Write([]byte("ls\r"))
+	r.Write([]byte("file.txt\r\n"))
+	r.Close()
+
+	_, events := readCast(t, s, r.ID())
+	if len(events) != 2 || events[0].Kind != "i" || events[0].Data != "ls\r" || events[1].Kind != "o" {
+		t.Errorf("events = %+v, want the input then the output", events)
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	s := newTestStore(t, Config{MaxFileSize: 200})
+
+	r := s.Start("alice", "203.0.113.1", "xterm", 80, 24)
+	for i := 0; i < 20; i++ {
+		r.Write([]byte(strings.Repeat("x", 20)))
+	}
+	r.Close()
+
+	_, events := readCast(t, s, r.ID())
+	if len(events) == 0 || len(events) >= 20 {
+		t.Fatalf("%d events, want recording to stop early", len(events))
+	}
+	if last := events[len(events)-1]; last.Kind != "m" || !strings.Contains(last.Data, "size limit") {
+		t.Errorf("last event = %+v, want the size limit marker", last)
+	}
+}
+
+// writeRecording writes a finished recording with the given ID and size,
+// last modified at modTime
+func writeRecording(t *testing.T, s *Store, id string, size int, modTime time.Time) {
+	t.Helper()
+
+	hdr, err := json.Marshal(header{Version: 2, Width: 80, Height: 24, Timestamp: modTime.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(hdr, '\n')
+	if pad := size - len(data); pad > 0 {
+		data = append(data, strings.Repeat(" ", pad)...)
+	}
+	if err := os.WriteFile(s.path(id), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(s.path(id), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// remaining returns the IDs of the recordings left in the store
+func remaining(t *testing.T, s *Store) map[string]bool {
+	t.Helper()
+
+	infos, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool)
+	for _, info := range infos {
+		ids[info.ID] = true
+	}
+	return ids
+}
+
+func TestPruneMaxAge(t *testing.T) {
+	s := newTestStore(t, Config{})
+	old := time.Now().Add(-48 * time.Hour)
+	writeRecording(t, s, "20200101T000000Z-000000000001", 100, old)
+	writeRecording(t, s, "20200102T000000Z-000000000002", 100, time.Now())
+
+	// A session that has been running since before the cutoff is kept
+	active := s.Start("alice", "203.0.113.1", "xterm", 80, 24)
+	defer active.Close()
+	if err := os.Chtimes(s.path(active.ID()), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not pruned without a retention policy
+	s.Prune()
+	if ids := remaining(t, s); len(ids) != 3 {
+		t.Fatalf("Prune without limits left %v, want all 3", ids)
+	}
+
+	s.config.MaxAge = 24 * time.Hour
+	s.Prune()
+	ids := remaining(t, s)
+	if ids["20200101T000000Z-000000000001"] {
+		t.Error("expired recording kept")
+	}
+	if !ids["20200102T000000Z-000000000002"] {
+		t.Error("recent recording deleted")
+	}
+	if !ids[active.ID()] {
+		t.Error("active recording deleted")
+	}
+}
+
+func TestPruneMaxTotalSize(t *testing.T) {
+	s := newTestStore(t, Config{})
+	now := time.Now()
+	writeRecording(t, s, "20200101T000000Z-000000000001", 400, now)
+	writeRecording(t, s, "20200102T000000Z-000000000002", 400, now)
+	writeRecording(t, s, "20200103T000000Z-000000000003", 400, now)
+
+	// The oldest go first, until the rest fits
+	s.config.MaxTotalSize = 900
+	s.Prune()
+	ids := remaining(t, s)
+	if len(ids) != 2 || ids["20200101T000000Z-000000000001"] {
+		t.Errorf("Prune left %v, want the two newest", ids)
+	}
+
+	// An active recording counts towards the total but is never deleted
+	active := s.Start("alice", "203.0.113.1", "xterm", 80, 24)
+	defer active.Close()
+	s.config.MaxTotalSize = 1
+	s.Prune()
+	ids = remaining(t, s)
+	if len(ids) != 1 || !ids[active.ID()] {
+		t.Errorf("Prune left %v, want only the active recording", ids)
+	}
+}
+
+func TestOpenInvalidID(t *testing.T) {
+	s := newTestStore(t, Config{})
+	outside := filepath.Join(filepath.Dir(s.config.Dir), "outside.cast")
+	if err := os.WriteFile(outside, []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.config.Dir, "notes.cast"), []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{
+		"",
+		"notes",
+		"../outside",
+		"20200101T000000Z-000000000001/../../outside",
+		"20200101T000000Z-00000000000G",
+		"20200101T000000Z-000000000001", // valid, but no such recording
+	} {
+		if file, _, err := s.Open(id); !errors.Is(err, ErrNotFound) {
+			if file != nil {
+				file.Close()
+			}
+			t.Errorf("Open(%q) = %v, want ErrNotFound", id, err)
+		}
+	}
+
+	infos, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Errorf("List = %+v, want files with invalid IDs skipped", infos)
+	}
+}
@@ -0,0 +1,373 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNotFound is returned when no live session has the given ID
+var ErrNotFound = errors.New("session not found")
+
+// Transports a session can arrive over
+const (
+	TransportSSH       = "ssh"
+	TransportWebSocket = "websocket"
+)
+
+// Info describes a live session
+type Info struct {
+	ID             string    `json:"id"`
+	User           string    `json:"user"`
+	KeyFingerprint string    `json:"keyFingerprint,omitempty"`
+	RemoteIP       string    `json:"remoteIp"`
+	Transport      string    `json:"transport"`
+	StartedAt      time.Time `json:"startedAt"`
+	BytesIn        int64     `json:"bytesIn"`
+	BytesOut       int64     `json:"bytesOut"`
+	PtyCols        int       `json:"ptyCols,omitempty"`
+	PtyRows        int       `json:"ptyRows,omitempty"`
+	Foreground     string    `json:"foreground,omitempty"` // command of the foreground process
+}
+
+// Controls are how the registry acts on a session on behalf of an administrator
+type Controls struct {
+	// Notify shows a message to the session's client
+	Notify func(message string)
+
+	// Terminate disconnects the session; reason is shown to the client
+	Terminate func(reason string)
+}
+
+// Registry tracks the live sessions of all transports. A nil *Registry tracks nothing.
+type Registry struct {
+	log *logrus.Logger
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	proxies  map[string]string // proxy connection address -> real client IP
+}
+
+// NewRegistry creates an empty session registry
+func NewRegistry(log *logrus.Logger) *Registry {
+	if log == nil {
+		log = logrus.New()
+	}
+
+	return &Registry{
+		log:      log,
+		sessions: make(map[string]*Session),
+		proxies:  make(map[string]string),
+	}
+}
+
+// Register adds a session for user from remoteIP over transport. The session
+// must be closed with Close when it ends.
+func (r *Registry) Register(user, remoteIP, transport string, controls Controls) *Session {
+	if r == nil {
+		return nil
+	}
+
+	id, err := newID()
+	if err != nil {
+		r.log.WithError(err).Error("Failed to generate session ID")
+		return nil
+	}
+
+	s := &Session{
+		registry:  r,
+		id:        id,
+		user:      user,
+		remoteIP:  remoteIP,
+		transport: transport,
+		started:   time.Now(),
+		controls:  controls,
+	}
+
+	r.mu.Lock()
+	r.sessions[id] = s
+	r.mu.Unlock()
+
+	r.log.WithFields(logrus.Fields{
+		"session":   id,
+		"user":      user,
+		"remote_ip": remoteIP,
+		"transport": transport,
+	}).Debug("Session registered")
+	return s
+}
+
+// List returns the live sessions, oldest first
+func (r *Registry) List() []Info {
+	if r == nil {
+		return []Info{}
+	}
+
+	r.mu.Lock()
+	list := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		list = append(list, s)
+	}
+	r.mu.Unlock()
+
+	infos := make([]Info, 0, len(list))
+	for _, s := range list {
+		infos = append(infos, s.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.Before(infos[j].StartedAt)
+	})
+	return infos
+}
+
+// Get returns the live session with the given ID, or ErrNotFound
+func (r *Registry) Get(id string) (Info, error) {
+	s := r.lookup(id)
+	if s == nil {
+		return Info{}, ErrNotFound
+	}
+	return s.Info(), nil
+}
+
+// Terminate disconnects the session with the given ID. A non-empty message is
+// shown to the client first.
+func (r *Registry) Terminate(id, message string) error {
+	s := r.lookup(id)
+	if s == nil {
+		return ErrNotFound
+	}
+
+	r.log.WithFields(logrus.Fields{
+		"session":   id,
+		"user":      s.user,
+		"remote_ip": s.remoteIP,
+		"message":   message,
+	}).Warn("Terminating session on administrator request")
+
+	s.mu.Lock()
+	controls := s.controls
+	s.mu.Unlock()
+
+	if message != "" && controls.Notify != nil {
+		controls.Notify(message)
+	}
+	if controls.Terminate != nil {
+		controls.Terminate("terminated by administrator")
+	}
+	return nil
+}
+
+// Proxied returns the session whose proxy connects to the SSH server from
+// addr, or nil. The WebSocket proxy registers its sessions with the real
+// client address; the SSH server uses this to fill in what only it knows.
+func (r *Registry) Proxied(addr string) *Session {
+	if r == nil || addr == "" {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		if s.proxyAddr.Load() == addr {
+			return s
+		}
+	}
+	return nil
+}
+
+// ExpectProxy records that the proxy's connection to the SSH server from addr
+// carries a login from clientIP, so the SSH server can count failures against
+// the real client rather than loopback. The returned func forgets it again.
+func (r *Registry) ExpectProxy(addr, clientIP string) func() {
+	if r == nil || addr == "" {
+		return func() {}
+	}
+
+	r.mu.Lock()
+	r.proxies[addr] = clientIP
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.proxies, addr)
+		r.mu.Unlock()
+	}
+}
+
+// ProxyClient returns the real client IP of a proxy connection from addr
+// that is logging in, or "" if addr is not such a connection
+func (r *Registry) ProxyClient(addr string) string {
+	if r == nil || addr == "" {
+		return ""
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.proxies[addr]
+}
+
+// lookup returns the live session with the given ID, or nil
+func (r *Registry) lookup(id string) *Session {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// Session is one registered session. A nil *Session records nothing.
+type Session struct {
+	registry  *Registry
+	id        string
+	user      string
+	remoteIP  string
+	transport string
+	started   time.Time
+
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	proxyAddr atomic.Value // string
+
+	mu          sync.Mutex
+	fingerprint string
+	cols, rows  int
+	foreground  func() string
+	controls    Controls
+	closed      bool
+}
+
+// ID returns the session's ID, or "" for a nil session
+func (s *Session) ID() string {
+	if s == nil {
+		return ""
+	}
+	return s.id
+}
+
+// Info returns a snapshot of the session
+func (s *Session) Info() Info {
+	s.mu.Lock()
+	info := Info{
+		ID:             s.id,
+		User:           s.user,
+		KeyFingerprint: s.fingerprint,
+		RemoteIP:       s.remoteIP,
+		Transport:      s.transport,
+		StartedAt:      s.started,
+		BytesIn:        s.bytesIn.Load(),
+		BytesOut:       s.bytesOut.Load(),
+		PtyCols:        s.cols,
+		PtyRows:        s.rows,
+	}
+	foreground := s.foreground
+	s.mu.Unlock()
+
+	if foreground != nil {
+		info.Foreground = foreground()
+	}
+	return info
+}
+
+// CountIn adds n bytes received from the client
+func (s *Session) CountIn(n int) {
+	if s != nil && n > 0 {
+		s.bytesIn.Add(int64(n))
+	}
+}
+
+// CountOut adds n bytes sent to the client
+func (s *Session) CountOut(n int) {
+	if s != nil && n > 0 {
+		s.bytesOut.Add(int64(n))
+	}
+}
+
+// SetKeyFingerprint records the fingerprint of the key the user logged in with
+func (s *Session) SetKeyFingerprint(fingerprint string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.fingerprint = fingerprint
+	s.mu.Unlock()
+}
+
+// SetPtySize records the size of the session's terminal
+func (s *Session) SetPtySize(cols, rows int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.cols, s.rows = cols, rows
+	s.mu.Unlock()
+}
+
+// SetForeground sets how to look up the session's foreground process; nil clears it
+func (s *Session) SetForeground(foreground func() string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.foreground = foreground
+	s.mu.Unlock()
+}
+
+// SetControls replaces the session's controls, for transports that can only
+// act on the session once it is fully set up
+func (s *Session) SetControls(controls Controls) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.controls = controls
+	s.mu.Unlock()
+}
+
+// SetProxyAddr records the local address of the proxy's connection to the SSH server
+func (s *Session) SetProxyAddr(addr string) {
+	if s == nil {
+		return
+	}
+	s.proxyAddr.Store(addr)
+}
+
+// Close removes the session from the registry. It is safe to call more than once.
+func (s *Session) Close() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	s.registry.mu.Lock()
+	delete(s.registry.sessions, s.id)
+	s.registry.mu.Unlock()
+
+	s.registry.log.WithFields(logrus.Fields{
+		"session":   s.id,
+		"bytes_in":  s.bytesIn.Load(),
+		"bytes_out": s.bytesOut.Load(),
+	}).Debug("Session unregistered")
+}
+
+// newID returns a random session ID
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,70 @@
+package ssh
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/sirupsen/logrus"
+)
+
+// forwardAgent sets up agent forwarding when the client asked for it
+// (auth-agent-req@openssh.com). It returns the socket path for SSH_AUTH_SOCK
+// and a function that removes the socket, or "" when there is nothing to forward.
+func (s *Server) forwardAgent(sess ssh.Session, acct *loginAccount) (string, func()) {
+	if !ssh.AgentRequested(sess) {
+		return "", nil
+	}
+
+	fields := logrus.Fields{
+		"user":      acct.Username,
+		"remote_ip": remoteIP(sess.RemoteAddr()),
+	}
+
+	if key := sessionKey(sess.Context()); key != nil && key.NoAgentForwarding {
+		s.log.WithFields(fields).Info("Agent forwarding denied by no-agent-forwarding key option")
+		return "", nil
+	}
+
+	// A private directory per session, like sshd's /tmp/ssh-XXXX/agent.<pid>
+	dir, err := os.MkdirTemp("", "shadowd-agent-")
+	if err != nil {
+		s.log.WithError(err).WithFields(fields).Warn("Failed to create agent socket directory")
+		return "", nil
+	}
+	path := filepath.Join(dir, "agent.sock")
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		s.log.WithError(err).WithFields(fields).Warn("Failed to create agent socket")
+		return "", nil
+	}
+
+	cleanup := func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+
+	// Only the session's account may use the socket
+	if err := os.Chmod(path, 0600); err != nil {
+		cleanup()
+		s.log.WithError(err).WithFields(fields).Warn("Failed to restrict agent socket")
+		return "", nil
+	}
+	if !acct.isDaemonUser() {
+		for _, p := range []string{dir, path} {
+			if err := os.Chown(p, int(acct.UID), int(acct.GID)); err != nil {
+				cleanup()
+				s.log.WithError(err).WithFields(fields).Warn("Failed to hand agent socket to the session account")
+				return "", nil
+			}
+		}
+	}
+
+	go ssh.ForwardAgentConnections(listener, sess)
+
+	s.log.WithFields(fields).WithField("socket", path).Info("Agent forwarding enabled")
+	return path, cleanup
+}
@@ -0,0 +1,343 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// contextKey is the type for values stored on the SSH connection context
+type contextKey string
+
+// Permission extensions carrying the options of the key a connection logged
+// in with from its authentication callback to the session. x/crypto keeps the
+// permissions a callback returns together with that key's cached result and
+// uses those of the key finally signed with, so offering other keys in between
+// cannot change them, as it could a value on the connection context.
+const (
+	extAuthorizedKey     = "shadowd-authorized-key" // the key in wire format, marks key logins
+	extCommand           = "shadowd-command"
+	extEnvironment       = "shadowd-environment" // NAME=value lines
+	extNoPTY             = "shadowd-no-pty"
+	extNoPortForwarding  = "shadowd-no-port-forwarding"
+	extNoAgentForwarding = "shadowd-no-agent-forwarding"
+)
+
+// authorizedKey is an authorized_keys entry together with its OpenSSH options
+// (see AUTHORIZED_KEYS FILE FORMAT in sshd(8))
+type authorizedKey struct {
+	Key     gossh.PublicKey
+	Comment string
+
+	// Principals are the accounts the key may log in as. The file is shared by
+	// all users, so every entry must name them.
+	Principals []string
+
+	// Command is a forced command run instead of whatever the client asked for
+	Command string
+
+	// From is the source address pattern list the key may be used from
+	From []string
+
+	// Environment holds NAME=value pairs added to the session environment
+	Environment []string
+
+	// ExpiresAt is when the key stops being accepted (zero means never)
+	ExpiresAt time.Time
+
+	NoPTY             bool
+	NoPortForwarding  bool
+	NoAgentForwarding bool
+}
+
+// parseAuthorizedKeys parses an authorized_keys file.
+// Bad lines are reported with their line number and skipped, so one typo
+// does not lock out every key after it.
+func parseAuthorizedKeys(data []byte) ([]*authorizedKey, []error) {
+	var keys []*authorizedKey
+	var errs []error
+
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		pubKey, comment, options, _, err := gossh.ParseAuthorizedKey(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", i+1, err))
+			continue
+		}
+
+		entry := &authorizedKey{Key: pubKey, Comment: comment}
+		if err := entry.applyOptions(options); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", i+1, err))
+			continue
+		}
+		if len(entry.Principals) == 0 {
+			errs = append(errs, fmt.Errorf("line %d: no principals= option naming the users the key may log in as", i+1))
+			continue
+		}
+
+		keys = append(keys, entry)
+	}
+
+	return keys, errs
+}
+
+// applyOptions parses the option list returned by gossh.ParseAuthorizedKey
+func (k *authorizedKey) applyOptions(options []string) error {
+	for _, opt := range options {
+		name, value, hasValue := strings.Cut(opt, "=")
+		name = strings.ToLower(name)
+		if hasValue {
+			unquoted, err := unquoteOption(value)
+			if err != nil {
+				return fmt.Errorf("option %s: %w", name, err)
+			}
+			value = unquoted
+		}
+
+		switch name {
+		case "command":
+			k.Command = value
+		case "from":
+			k.From = strings.Split(value, ",")
+		case "principals":
+			for _, name := range strings.Split(value, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					k.Principals = append(k.Principals, name)
+				}
+			}
+		case "environment":
+			if !strings.Contains(value, "=") {
+				return fmt.Errorf("option environment: expected NAME=value, got %q", value)
+			}
+			k.Environment = append(k.Environment, value)
+		case "expiry-time":
+			expires, err := parseExpiryTime(value)
+			if err != nil {
+				return fmt.Errorf("option expiry-time: %w", err)
+			}
+			k.ExpiresAt = expires
+		case "restrict":
+			k.NoPTY = true
+			k.NoPortForwarding = true
+			k.NoAgentForwarding = true
+		case "no-pty":
+			k.NoPTY = true
+		case "pty":
+			k.NoPTY = false
+		case "no-port-forwarding":
+			k.NoPortForwarding = true
+		case "port-forwarding":
+			k.NoPortForwarding = false
+		case "no-agent-forwarding":
+			k.NoAgentForwarding = true
+		case "agent-forwarding":
+			k.NoAgentForwarding = false
+		case "no-x11-forwarding", "x11-forwarding", "no-user-rc", "user-rc":
+			// X11 and ~/.ssh/rc are never supported, nothing to enforce
+		default:
+			return fmt.Errorf("unsupported option %q", name)
+		}
+
+		if hasValue != optionTakesValue(name) {
+			return fmt.Errorf("option %s: malformed", name)
+		}
+	}
+
+	return nil
+}
+
+// optionTakesValue reports whether an option is written as name="value"
+func optionTakesValue(name string) bool {
+	switch name {
+	case "command", "from", "environment", "expiry-time", "principals":
+		return true
+	}
+	return false
+}
+
+// unquoteOption strips the double quotes around an option value.
+// Inside the quotes, \" stands for a literal quote.
+func unquoteOption(value string) (string, error) {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return "", fmt.Errorf("value must be double-quoted")
+	}
+	return strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`), nil
+}
+
+// parseExpiryTime parses YYYYMMDD[HHMM[SS]] in local time, or UTC with a trailing Z
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") || strings.HasSuffix(value, "z") {
+		loc = time.UTC
+		value = value[:len(value)-1]
+	}
+
+	var layout string
+	switch len(value) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+
+	return time.ParseInLocation(layout, value, loc)
+}
+
+// expired reports whether the key's expiry-time has passed
+func (k *authorizedKey) expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// allowsAddress checks a remote address against the from= pattern list.
+// Any matching negated pattern rejects; otherwise one positive match is needed.
+func (k *authorizedKey) allowsAddress(addr net.Addr) bool {
+	if len(k.From) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	matched := false
+	for _, pattern := range k.From {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		if !matchAddressPattern(pattern, ip) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+
+	return matched
+}
+
+// matchAddressPattern matches an IP against a CIDR or a wildcard (*, ?) pattern
+func matchAddressPattern(pattern string, ip net.IP) bool {
+	if strings.Contains(pattern, "/") {
+		_, network, err := net.ParseCIDR(pattern)
+		return err == nil && network.Contains(ip)
+	}
+	return matchWildcard(pattern, ip.String())
+}
+
+// matchWildcard implements the ssh_config(5) pattern syntax: * and ?
+func matchWildcard(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || !strings.EqualFold(pattern[:1], s[:1]) {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+// allowsUser reports whether the key may log in as the named account
+func (k *authorizedKey) allowsUser(name string) bool {
+	for _, principal := range k.Principals {
+		if principal == name {
+			return true
+		}
+	}
+	return false
+}
+
+// permissions returns the permissions of a connection authenticated with k
+func (k *authorizedKey) permissions() *gossh.Permissions {
+	extensions := map[string]string{
+		extAuthorizedKey: string(k.Key.Marshal()),
+	}
+	if k.Command != "" {
+		extensions[extCommand] = k.Command
+	}
+	if len(k.Environment) > 0 {
+		extensions[extEnvironment] = strings.Join(k.Environment, "\n")
+	}
+	if k.NoPTY {
+		extensions[extNoPTY] = ""
+	}
+	if k.NoPortForwarding {
+		extensions[extNoPortForwarding] = ""
+	}
+	if k.NoAgentForwarding {
+		extensions[extNoAgentForwarding] = ""
+	}
+	return &gossh.Permissions{Extensions: extensions}
+}
+
+// permittedKey returns the key and options recorded in perms by permissions,
+// or nil if the connection did not log in with a key
+func permittedKey(perms *gossh.Permissions) *authorizedKey {
+	if perms == nil {
+		return nil
+	}
+	blob, ok := perms.Extensions[extAuthorizedKey]
+	if !ok {
+		return nil
+	}
+	key, err := gossh.ParsePublicKey([]byte(blob))
+	if err != nil {
+		return nil
+	}
+
+	entry := &authorizedKey{
+		Key:     key,
+		Command: perms.Extensions[extCommand],
+	}
+	if env := perms.Extensions[extEnvironment]; env != "" {
+		entry.Environment = strings.Split(env, "\n")
+	}
+	_, entry.NoPTY = perms.Extensions[extNoPTY]
+	_, entry.NoPortForwarding = perms.Extensions[extNoPortForwarding]
+	_, entry.NoAgentForwarding = perms.Extensions[extNoAgentForwarding]
+	return entry
+}
+
+// sessionKey returns the key and options the connection authenticated with,
+// or nil if it logged in some other way. They come from the permissions of the
+// authentication that succeeded, which x/crypto stores on the connection;
+// gliderlabs' ctx.Permissions() is shared by every callback and is not used.
+func sessionKey(ctx ssh.Context) *authorizedKey {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	if !ok {
+		return nil
+	}
+	return permittedKey(conn.Permissions)
+}
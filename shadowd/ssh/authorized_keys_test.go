@@ -0,0 +1,438 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// newTestSigner returns a new ed25519 key
+func newTestSigner(t *testing.T) gossh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestParseAuthorizedKeysOptions(t *testing.T) {
+	key := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(newTestSigner(t).PublicKey())))
+
+	tests := []struct {
+		name    string
+		options string
+		wantErr bool
+		check   func(t *testing.T, k *authorizedKey)
+	}{
+		{
+			name:    "principals only",
+			options: `principals="alice"`,
+			check: func(t *testing.T, k *authorizedKey) {
+				if k.Command != "" || k.NoPTY || k.NoPortForwarding || k.NoAgentForwarding || len(k.From) != 0 {
+					t.Errorf("unexpected options: %+v", k)
+				}
+				if !k.allowsUser("alice") || k.allowsUser("root") {
+					t.Errorf("principals = %q, want only alice", k.Principals)
+				}
+			},
+		},
+		{
+			name:    "several principals",
+			options: `principals="alice, bob",no-pty`,
+			check: func(t *testing.T, k *authorizedKey) {
+				if strings.Join(k.Principals, " ") != "alice bob" || !k.NoPTY {
+					t.Errorf("principals = %q, no-pty = %v", k.Principals, k.NoPTY)
+				}
+			},
+		},
+		{
+			name:    "command with escaped quote",
+			options: `principals="alice",command="echo \"hi\""`,
+			check: func(t *testing.T, k *authorizedKey) {
+				if k.Command != `echo "hi"` {
+					t.Errorf("command = %q", k.Command)
+				}
+			},
+		},
+		{
+			name:    "restrict then re-allow pty",
+			options: `principals="alice",restrict,pty`,
+			check: func(t *testing.T, k *authorizedKey) {
+				if k.NoPTY || !k.NoPortForwarding || !k.NoAgentForwarding {
+					t.Errorf("restrict,pty = %+v", k)
+				}
+			},
+		},
+		{
+			name:    "individual restrictions",
+			options: `principals="alice",no-pty,no-port-forwarding,no-agent-forwarding,no-x11-forwarding`,
+			check: func(t *testing.T, k *authorizedKey) {
+				if !k.NoPTY || !k.NoPortForwarding || !k.NoAgentForwarding {
+					t.Errorf("restrictions = %+v", k)
+				}
+			},
+		},
+		{
+			name:    "from and environment",
+			options: `principals="alice",from="10.0.0.0/8,!10.1.2.3",environment="A=1",environment="B=two words"`,
+			check: func(t *testing.T, k *authorizedKey) {
+				if strings.Join(k.From, " ") != "10.0.0.0/8 !10.1.2.3" {
+					t.Errorf("from = %q", k.From)
+				}
+				if strings.Join(k.Environment, ";") != "A=1;B=two words" {
+					t.Errorf("environment = %q", k.Environment)
+				}
+			},
+		},
+		{
+			name:    "expiry time in UTC",
+			options: `principals="alice",expiry-time="20300102Z"`,
+			check: func(t *testing.T, k *authorizedKey) {
+				want := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+				if !k.ExpiresAt.Equal(want) {
+					t.Errorf("expires at %v, want %v", k.ExpiresAt, want)
+				}
+			},
+		},
+		{name: "no principals", options: "no-pty", wantErr: true},
+		{name: "empty principals", options: `principals=""`, wantErr: true},
+		{name: "unsupported option", options: "principals=\"alice\",tunnel=\"1\"", wantErr: true},
+		{name: "unquoted value", options: "principals=\"alice\",command=ls", wantErr: true},
+		{name: "flag with value", options: `principals="alice",no-pty="yes"`, wantErr: true},
+		{name: "environment without equals", options: `principals="alice",environment="A"`, wantErr: true},
+		{name: "bad expiry", options: `principals="alice",expiry-time="2030"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := key
+			if tt.options != "" {
+				line = tt.options + " " + key
+			}
+			keys, errs := parseAuthorizedKeys([]byte("# comment\n\n" + line + "\n"))
+			if tt.wantErr {
+				if len(errs) != 1 || len(keys) != 0 {
+					t.Fatalf("got %d keys and errors %v, want one error", len(keys), errs)
+				}
+				if !strings.HasPrefix(errs[0].Error(), "line 3:") {
+					t.Errorf("error %q does not name line 3", errs[0])
+				}
+				return
+			}
+			if len(errs) != 0 || len(keys) != 1 {
+				t.Fatalf("got %d keys and errors %v, want one key", len(keys), errs)
+			}
+			tt.check(t, keys[0])
+		})
+	}
+}
+
+func TestParseAuthorizedKeysSkipsBadLines(t *testing.T) {
+	good := `principals="alice" ` + string(gossh.MarshalAuthorizedKey(newTestSigner(t).PublicKey()))
+	keys, errs := parseAuthorizedKeys([]byte("not a key\n" + good + "bogus-option," + good))
+	if len(keys) != 1 || len(errs) != 2 {
+		t.Errorf("got %d keys and %d errors, want 1 and 2", len(keys), len(errs))
+	}
+}
+
+func TestAllowsAddress(t *testing.T) {
+	tests := []struct {
+		from []string
+		addr string
+		want bool
+	}{
+		{nil, "203.0.113.7:22", true},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3:22", true},
+		{[]string{"10.0.0.0/8"}, "11.1.2.3:22", false},
+		{[]string{"10.0.0.0/8", "!10.1.2.3"}, "10.1.2.3:22", false},
+		{[]string{"10.0.0.0/8", "!10.1.2.3"}, "10.1.2.4:22", true},
+		{[]string{"192.168.1.*"}, "192.168.1.50:22", true},
+		{[]string{"192.168.1.?"}, "192.168.1.50:22", false},
+		{[]string{"!10.1.2.3"}, "10.9.9.9:22", false},
+		{[]string{"::1"}, "[::1]:22", true},
+	}
+
+	for _, tt := range tests {
+		addr, err := net.ResolveTCPAddr("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := &authorizedKey{From: tt.from}
+		if got := k.allowsAddress(addr); got != tt.want {
+			t.Errorf("from=%q allowsAddress(%s) = %v, want %v", tt.from, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestKeyPermissionsRoundTrip(t *testing.T) {
+	signer := newTestSigner(t)
+	tests := []*authorizedKey{
+		{Key: signer.PublicKey()},
+		{
+			Key:               signer.PublicKey(),
+			Command:           "echo forced",
+			Environment:       []string{"A=1", "B=x=y"},
+			NoPTY:             true,
+			NoPortForwarding:  true,
+			NoAgentForwarding: true,
+		},
+	}
+
+	for _, want := range tests {
+		got := permittedKey(want.permissions())
+		if got == nil {
+			t.Fatalf("no key in permissions of %+v", want)
+		}
+		if string(got.Key.Marshal()) != string(want.Key.Marshal()) ||
+			got.Command != want.Command ||
+			strings.Join(got.Environment, "\n") != strings.Join(want.Environment, "\n") ||
+			got.NoPTY != want.NoPTY ||
+			got.NoPortForwarding != want.NoPortForwarding ||
+			got.NoAgentForwarding != want.NoAgentForwarding {
+			t.Errorf("round trip of %+v = %+v", want, got)
+		}
+	}
+
+	if permittedKey(&gossh.Permissions{}) != nil {
+		t.Error("permissions of a password login carry a key")
+	}
+}
+
+// testContext is a minimal ssh.Context for calling the authentication
+// callbacks directly
+type testContext struct {
+	context.Context
+	sync.Mutex
+	values map[interface{}]interface{}
+	perms  *ssh.Permissions
+}
+
+func newTestContext() *testContext {
+	return &testContext{
+		Context: context.Background(),
+		values:  make(map[interface{}]interface{}),
+		perms:   &ssh.Permissions{Permissions: &gossh.Permissions{}},
+	}
+}
+
+func (c *testContext) Value(key interface{}) interface{} {
+	if v, ok := c.values[key]; ok {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+func (c *testContext) SetValue(key, value interface{}) { c.values[key] = value }
+func (c *testContext) User() string                    { return c.stringValue(ssh.ContextKeyUser) }
+func (c *testContext) SessionID() string               { return c.stringValue(ssh.ContextKeySessionID) }
+func (c *testContext) ClientVersion() string           { return c.stringValue(ssh.ContextKeyClientVersion) }
+func (c *testContext) ServerVersion() string           { return c.stringValue(ssh.ContextKeyServerVersion) }
+func (c *testContext) RemoteAddr() net.Addr            { return c.Value(ssh.ContextKeyRemoteAddr).(net.Addr) }
+func (c *testContext) LocalAddr() net.Addr             { return c.Value(ssh.ContextKeyLocalAddr).(net.Addr) }
+func (c *testContext) Permissions() *ssh.Permissions   { return c.perms }
+
+func (c *testContext) stringValue(key interface{}) string {
+	s, _ := c.Value(key).(string)
+	return s
+}
+
+// testConnMetadata is the metadata of a client connecting from remote, or
+// from loopback if it is nil
+type testConnMetadata struct {
+	user   string
+	remote net.Addr
+}
+
+func (m testConnMetadata) User() string          { return m.user }
+func (m testConnMetadata) SessionID() []byte     { return []byte("session") }
+func (m testConnMetadata) ClientVersion() []byte { return []byte("SSH-2.0-test") }
+func (m testConnMetadata) ServerVersion() []byte { return []byte("SSH-2.0-shadowd") }
+func (m testConnMetadata) RemoteAddr() net.Addr {
+	if m.remote != nil {
+		return m.remote
+	}
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+func (m testConnMetadata) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+}
+
+// TestKeyOptionsFollowSignedKey replays what x/crypto's server does when a
+// client queries a restricted key, offers an unknown one and then signs with
+// the restricted key: the cached result of the query, permissions included,
+// becomes the connection's. The restrictions must survive the unknown offer.
+func TestKeyOptionsFollowSignedKey(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	s, err := NewServer(Config{
+		MeshIP:      "127.0.0.1",
+		Port:        2222,
+		HostKeyPath: "unused",
+		Users:       map[string]string{"alice": "secret"},
+	}, Services{}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restricted := newTestSigner(t).PublicKey()
+	unknown := newTestSigner(t).PublicKey()
+	s.authorizedKeys.add(&authorizedKey{
+		Key:               restricted,
+		Principals:        []string{"alice"},
+		Command:           "echo restricted",
+		NoPTY:             true,
+		NoPortForwarding:  true,
+		NoAgentForwarding: true,
+	})
+
+	ctx := newTestContext()
+	config := s.serverConfig(ctx)
+	conn := testConnMetadata{user: "alice"}
+
+	queried, err := config.PublicKeyCallback(conn, restricted)
+	if err != nil {
+		t.Fatalf("restricted key refused: %v", err)
+	}
+	if _, err := config.PublicKeyCallback(conn, unknown); err == nil {
+		t.Fatal("unknown key accepted")
+	}
+
+	// Signing with the restricted key authenticates with the cached permissions
+	ctx.SetValue(ssh.ContextKeyConn, &gossh.ServerConn{Permissions: queried})
+
+	key := sessionKey(ctx)
+	if key == nil {
+		t.Fatal("session has no key after a key login")
+	}
+	if key.Command != "echo restricted" || !key.NoPTY || !key.NoPortForwarding || !key.NoAgentForwarding {
+		t.Errorf("session key options = %+v, want the restricted key's", key)
+	}
+	if s.ptyCallback(ctx, ssh.Pty{}) {
+		t.Error("PTY allowed for a no-pty key")
+	}
+	if s.forwardRulesFor(ctx) != nil {
+		t.Error("port forwarding allowed for a no-port-forwarding key")
+	}
+
+	// A password login after querying the key carries no key options
+	byPassword, err := config.PasswordCallback(conn, []byte("secret"))
+	if err != nil {
+		t.Fatalf("password refused: %v", err)
+	}
+	ctx.SetValue(ssh.ContextKeyConn, &gossh.ServerConn{Permissions: byPassword})
+	if key := sessionKey(ctx); key != nil {
+		t.Errorf("password login has key options %+v", key)
+	}
+}
+
+// TestKeyBoundToUsers checks that a key only logs in as the accounts it
+// names, and that root is refused unless PermitRootLogin is set
+func TestKeyBoundToUsers(t *testing.T) {
+	if acct, err := lookupAccount("root"); err != nil || !acct.isSuperuser() {
+		t.Skip("no root account on this system")
+	}
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	newServer := func(permitRoot bool) *Server {
+		s, err := NewServer(Config{
+			MeshIP:          "127.0.0.1",
+			Port:            2222,
+			HostKeyPath:     "unused",
+			Users:           map[string]string{"root": "secret"},
+			PermitRootLogin: permitRoot,
+		}, Services{}, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	alicesKey := newTestSigner(t).PublicKey()
+	rootsKey := newTestSigner(t).PublicKey()
+
+	tests := []struct {
+		name       string
+		permitRoot bool
+		user       string
+		key        gossh.PublicKey
+		want       bool
+	}{
+		{"key as its user", false, "alice", alicesKey, true},
+		{"key as root", true, "root", alicesKey, false},
+		{"key as another user", false, "bob", alicesKey, false},
+		{"root key without PermitRootLogin", false, "root", rootsKey, false},
+		{"root key with PermitRootLogin", true, "root", rootsKey, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(tt.permitRoot)
+			s.authorizedKeys.add(&authorizedKey{Key: alicesKey, Principals: []string{"alice"}})
+			s.authorizedKeys.add(&authorizedKey{Key: rootsKey, Principals: []string{"root"}})
+
+			config := s.serverConfig(newTestContext())
+			_, err := config.PublicKeyCallback(testConnMetadata{user: tt.user}, tt.key)
+			if got := err == nil; got != tt.want {
+				t.Errorf("logged in = %v (%v), want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	// A configured password for root is refused too
+	config := newServer(false).serverConfig(newTestContext())
+	if _, err := config.PasswordCallback(testConnMetadata{user: "root"}, []byte("secret")); err == nil {
+		t.Error("root logged in with a password without PermitRootLogin")
+	}
+}
+
+// TestForcedCommandOverConnection checks end to end that a key's forced
+// command replaces the command the client asks for
+func TestForcedCommandOverConnection(t *testing.T) {
+	username := currentLoginUser(t)
+	server, addr := startServer(t, Config{})
+
+	signer := newTestSigner(t)
+	server.authorizedKeys.add(&authorizedKey{Key: signer.PublicKey(), Principals: []string{username}, Command: "echo forced"})
+
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            username,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("ssh dial: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	out, err := session.Output("echo requested")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if strings.TrimSpace(string(out)) != "forced" {
+		t.Errorf("output = %q, want the forced command's", out)
+	}
+}
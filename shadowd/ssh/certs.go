@@ -0,0 +1,107 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Critical options and extensions defined by OpenSSH's PROTOCOL.certkeys
+const (
+	certOptionForceCommand  = "force-command"
+	certOptionSourceAddress = "source-address"
+
+	certExtPermitPTY            = "permit-pty"
+	certExtPermitPortForwarding = "permit-port-forwarding"
+	certExtPermitAgent          = "permit-agent-forwarding"
+)
+
+// loadTrustedUserCAKeys reads CA public keys, one per line, in authorized_keys format
+func loadTrustedUserCAKeys(path string) ([]gossh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted user CA keys: %w", err)
+	}
+
+	entries, errs := parseAuthorizedKeys(data)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to parse trusted user CA keys: %w", errs[0])
+	}
+
+	keys := make([]gossh.PublicKey, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys, nil
+}
+
+// isUserAuthority reports whether key is one of the trusted user CAs
+func (s *Server) isUserAuthority(key gossh.PublicKey) bool {
+	for _, ca := range s.userCAKeys {
+		if ssh.KeysEqual(ca, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRevokedCert reports whether the certificate's serial is on the revocation list
+func (s *Server) isRevokedCert(cert *gossh.Certificate) bool {
+	for _, serial := range s.config.RevokedCertSerials {
+		if cert.Serial == serial {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUserCert validates a user certificate for the given login name and
+// translates its critical options and extensions into key options
+func (s *Server) checkUserCert(user string, cert *gossh.Certificate) (*authorizedKey, error) {
+	if cert.CertType != gossh.UserCert {
+		return nil, fmt.Errorf("certificate is not a user certificate")
+	}
+	if !s.isUserAuthority(cert.SignatureKey) {
+		return nil, fmt.Errorf("certificate signed by untrusted authority %s", gossh.FingerprintSHA256(cert.SignatureKey))
+	}
+
+	// Unlike authorized_keys CAs, sshd refuses certificates without principals
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("certificate has no principals")
+	}
+
+	checker := gossh.CertChecker{
+		IsRevoked:                s.isRevokedCert,
+		SupportedCriticalOptions: []string{certOptionForceCommand, certOptionSourceAddress},
+	}
+	if err := checker.CheckCert(user, cert); err != nil {
+		return nil, err
+	}
+
+	entry := &authorizedKey{
+		Key:               cert,
+		Comment:           cert.KeyId,
+		Command:           cert.CriticalOptions[certOptionForceCommand],
+		NoPTY:             !hasExtension(cert, certExtPermitPTY),
+		NoPortForwarding:  !hasExtension(cert, certExtPermitPortForwarding),
+		NoAgentForwarding: !hasExtension(cert, certExtPermitAgent),
+	}
+	if addrs, ok := cert.CriticalOptions[certOptionSourceAddress]; ok {
+		entry.From = strings.Split(addrs, ",")
+	}
+	if cert.ValidBefore != gossh.CertTimeInfinity {
+		entry.ExpiresAt = time.Unix(int64(cert.ValidBefore), 0)
+	}
+
+	return entry, nil
+}
+
+// hasExtension reports whether the certificate grants an extension
+func hasExtension(cert *gossh.Certificate, name string) bool {
+	_, ok := cert.Extensions[name]
+	return ok
+}
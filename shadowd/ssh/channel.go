@@ -0,0 +1,115 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ttyOpEnd ends the encoded terminal modes of a pty-req (RFC 4254 section 8)
+const ttyOpEnd = 0
+
+// channelContext is the context of one session channel. gliderlabs shares one
+// context between all channels of a connection and drops what it does not
+// parse, so the raw channel and the requested terminal modes are kept here.
+type channelContext struct {
+	ssh.Context
+	channel gossh.Channel
+
+	mu    sync.Mutex
+	modes gossh.TerminalModes
+}
+
+// terminalModes returns the modes of the channel's last pty-req
+func (c *channelContext) terminalModes() gossh.TerminalModes {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.modes
+}
+
+// channelContextFor returns the channel context of a session, or nil
+func channelContextFor(sess ssh.Session) *channelContext {
+	cc, _ := sess.Context().(*channelContext)
+	return cc
+}
+
+// withChannelContext wraps a session channel handler to give each channel its
+// own context and to record the terminal modes of its pty-req
+func (s *Server) withChannelContext(next ssh.ChannelHandler) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		cc := &channelContext{Context: ctx}
+		next(srv, conn, &interceptedChannel{NewChannel: newChan, cc: cc}, cc)
+	}
+}
+
+// interceptedChannel inspects a channel's requests on their way to gliderlabs
+type interceptedChannel struct {
+	gossh.NewChannel
+	cc *channelContext
+}
+
+func (n *interceptedChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	ch, reqs, err := n.NewChannel.Accept()
+	if err != nil {
+		return ch, reqs, err
+	}
+	n.cc.channel = ch
+
+	out := make(chan *gossh.Request)
+	go func() {
+		defer close(out)
+		for req := range reqs {
+			if req.Type == "pty-req" {
+				n.cc.mu.Lock()
+				n.cc.modes = parsePtyModes(req.Payload)
+				n.cc.mu.Unlock()
+			}
+			out <- req
+		}
+	}()
+	return ch, out, nil
+}
+
+// ptyRequestMsg is the payload of a pty-req (RFC 4254 section 6.2)
+type ptyRequestMsg struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+// parsePtyModes decodes the terminal modes of a pty-req payload. Malformed
+// requests yield no modes; gliderlabs rejects them on its own.
+func parsePtyModes(payload []byte) gossh.TerminalModes {
+	var msg ptyRequestMsg
+	if err := gossh.Unmarshal(payload, &msg); err != nil {
+		return nil
+	}
+
+	modes := gossh.TerminalModes{}
+	list := []byte(msg.Modelist)
+	for len(list) >= 5 && list[0] != ttyOpEnd {
+		modes[list[0]] = binary.BigEndian.Uint32(list[1:5])
+		list = list[5:]
+	}
+	return modes
+}
+
+// ptyOutput returns where to copy PTY output. The raw channel is used when
+// known, because the session's Write turns every \n into \r\n, which breaks
+// full-screen programs that turn output processing off.
+func ptyOutput(sess ssh.Session) io.Writer {
+	cc := channelContextFor(sess)
+	if cc == nil || cc.channel == nil {
+		return sess
+	}
+	if tracked, ok := sess.(*trackedSession); ok {
+		return &countingWriter{ReadWriter: cc.channel, sess: tracked}
+	}
+	return cc.channel
+}
@@ -0,0 +1,33 @@
+package ssh
+
+import (
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/shadow-shuttle/shadowd/acceptenv"
+	"github.com/sirupsen/logrus"
+)
+
+// acceptedEnv returns the client's env requests whose names match AcceptEnv
+func (s *Server) acceptedEnv(sess ssh.Session) []string {
+	var env, refused []string
+	for _, kv := range sess.Environ() {
+		name, _, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			continue
+		}
+		if acceptenv.Match(s.config.AcceptEnv, name) {
+			env = append(env, kv)
+		} else {
+			refused = append(refused, name)
+		}
+	}
+
+	if len(refused) > 0 {
+		s.log.WithFields(logrus.Fields{
+			"user":      sess.User(),
+			"variables": refused,
+		}).Debug("Ignoring client environment variables not in AcceptEnv")
+	}
+	return env
+}
@@ -0,0 +1,457 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/shadow-shuttle/shadowd/jump"
+	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// forwardPolicyDefault is the PortForwarding entry applied to users without their own entry
+const forwardPolicyDefault = "*"
+
+// privilegedPortLimit is the first port any account may listen on; like sshd,
+// remote forwards below it need an account that could bind them itself
+const privilegedPortLimit = 1024
+
+// ForwardPolicy lists where a user may forward ports to, as "host:ports" rules.
+// host is "*", an IP address, a CIDR, "localhost" or a hostname; IPv6 addresses
+// are bracketed ("[::1]:22"). ports is "*", a port or a range ("3000-9000").
+type ForwardPolicy struct {
+	// Local are the destinations allowed for local forwarding (ssh -L, direct-tcpip)
+	Local []string
+
+	// Remote are the bind addresses allowed for remote forwarding (ssh -R, tcpip-forward).
+	// An empty or "localhost" bind address means loopback, so "127.0.0.1:..." covers it.
+	Remote []string
+}
+
+// forwardRule is one parsed "host:ports" rule
+type forwardRule struct {
+	anyHost  bool
+	name     string
+	networks []*net.IPNet
+	portLo   uint32
+	portHi   uint32
+}
+
+// forwardRules holds a user's parsed policy
+type forwardRules struct {
+	local  []forwardRule
+	remote []forwardRule
+}
+
+// direct-tcpip channel data (RFC 4254, section 7.2)
+type directTCPIPData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// tcpip-forward and cancel-tcpip-forward request data (RFC 4254, section 7.1)
+type remoteForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// tcpip-forward reply when the server picked the port
+type remoteForwardSuccess struct {
+	BindPort uint32
+}
+
+// forwarded-tcpip channel data (RFC 4254, section 7.2)
+type forwardedTCPIPData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// remoteForwards tracks the listeners opened for tcpip-forward requests
+type remoteForwards struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+// newRemoteForwards creates an empty listener registry
+func newRemoteForwards() *remoteForwards {
+	return &remoteForwards{listeners: make(map[string]net.Listener)}
+}
+
+// parseForwardPolicies parses every user's policy
+func parseForwardPolicies(policies map[string]ForwardPolicy) (map[string]*forwardRules, error) {
+	parsed := make(map[string]*forwardRules, len(policies))
+	for user, policy := range policies {
+		rules := &forwardRules{}
+		for _, entry := range policy.Local {
+			rule, err := parseForwardRule(entry)
+			if err != nil {
+				return nil, fmt.Errorf("port forwarding policy for %q: %w", user, err)
+			}
+			rules.local = append(rules.local, rule)
+		}
+		for _, entry := range policy.Remote {
+			rule, err := parseForwardRule(entry)
+			if err != nil {
+				return nil, fmt.Errorf("port forwarding policy for %q: %w", user, err)
+			}
+			rules.remote = append(rules.remote, rule)
+		}
+		parsed[user] = rules
+	}
+	return parsed, nil
+}
+
+// parseForwardRule parses a "host:ports" rule
+func parseForwardRule(entry string) (forwardRule, error) {
+	var rule forwardRule
+
+	host, ports, err := net.SplitHostPort(strings.TrimSpace(entry))
+	if err != nil {
+		return rule, fmt.Errorf("invalid rule %q: want host:ports", entry)
+	}
+
+	rule.portLo, rule.portHi, err = parsePortRange(ports)
+	if err != nil {
+		return rule, fmt.Errorf("invalid rule %q: %w", entry, err)
+	}
+
+	switch {
+	case host == "*":
+		rule.anyHost = true
+	case strings.EqualFold(host, "localhost"):
+		rule.networks = loopbackNetworks()
+	case strings.Contains(host, "/"):
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return rule, fmt.Errorf("invalid rule %q: %w", entry, err)
+		}
+		rule.networks = []*net.IPNet{network}
+	case net.ParseIP(host) != nil:
+		rule.networks = []*net.IPNet{hostNetwork(net.ParseIP(host))}
+	default:
+		rule.name = strings.ToLower(host)
+	}
+
+	return rule, nil
+}
+
+// parsePortRange parses "*", "22" or "3000-9000"
+func parsePortRange(ports string) (uint32, uint32, error) {
+	if ports == "*" {
+		return 0, 65535, nil
+	}
+
+	lo, hi, isRange := strings.Cut(ports, "-")
+	low, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", lo)
+	}
+	high := low
+	if isRange {
+		high, err = strconv.ParseUint(hi, 10, 16)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid port %q", hi)
+		}
+	}
+	if low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q", ports)
+	}
+	return uint32(low), uint32(high), nil
+}
+
+// loopbackNetworks returns the IPv4 and IPv6 loopback networks
+func loopbackNetworks() []*net.IPNet {
+	_, v4, _ := net.ParseCIDR("127.0.0.0/8")
+	_, v6, _ := net.ParseCIDR("::1/128")
+	return []*net.IPNet{v4, v6}
+}
+
+// containsIP reports whether ip is in any of the rule's networks
+func (r forwardRule) containsIP(ip net.IP) bool {
+	for _, network := range r.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permitDestination checks a direct-tcpip destination against the rules and returns
+// the address to dial. Hostnames matched by an address rule are resolved here and
+// the checked address is dialed, so a second lookup cannot lead somewhere else.
+func permitDestination(ctx context.Context, rules []forwardRule, host string, port uint32) (string, bool) {
+	var resolved []net.IP
+	resolvedDone := false
+
+	for _, rule := range rules {
+		if port < rule.portLo || port > rule.portHi {
+			continue
+		}
+		if rule.anyHost || (rule.name != "" && strings.EqualFold(rule.name, host)) {
+			return host, true
+		}
+		if len(rule.networks) == 0 {
+			continue
+		}
+
+		if !resolvedDone {
+			resolvedDone = true
+			if ip := parseRemoteIP(host); ip != nil {
+				resolved = []net.IP{ip}
+			} else if addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host); err == nil {
+				for _, addr := range addrs {
+					resolved = append(resolved, addr.IP)
+				}
+			}
+		}
+		for _, ip := range resolved {
+			if rule.containsIP(ip) {
+				return ip.String(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// permitBind checks a tcpip-forward bind address against the rules and returns the
+// address to listen on. As with sshd's default GatewayPorts, an empty or "localhost"
+// bind address listens on loopback only; "*" listens on all addresses.
+func permitBind(rules []forwardRule, host string, port uint32) (string, bool) {
+	switch strings.ToLower(host) {
+	case "", "localhost":
+		host = "127.0.0.1"
+	case "*":
+		host = "0.0.0.0"
+	}
+	ip := parseRemoteIP(host)
+
+	for _, rule := range rules {
+		if port < rule.portLo || port > rule.portHi {
+			continue
+		}
+		if rule.anyHost || (rule.name != "" && strings.EqualFold(rule.name, host)) {
+			return host, true
+		}
+		if ip != nil && rule.containsIP(ip) {
+			return host, true
+		}
+	}
+	return "", false
+}
+
+// forwardRulesFor returns the user's forwarding rules, or nil if the user may not forward.
+// Keys with no-port-forwarding (or certificates without permit-port-forwarding) never may.
+func (s *Server) forwardRulesFor(ctx ssh.Context) *forwardRules {
+	if key := sessionKey(ctx); key != nil && key.NoPortForwarding {
+		return nil
+	}
+	if rules, ok := s.forwardPolicies[ctx.User()]; ok {
+		return rules
+	}
+	return s.forwardPolicies[forwardPolicyDefault]
+}
+
+// directTCPIPHandler handles local port forwarding (ssh -L) channels
+func (s *Server) directTCPIPHandler(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	var data directTCPIPData
+	if err := gossh.Unmarshal(newChan.ExtraData(), &data); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	fields := logrus.Fields{
+		"user":        ctx.User(),
+		"remote_ip":   remoteIP(ctx.RemoteAddr()),
+		"destination": net.JoinHostPort(data.DestAddr, strconv.Itoa(int(data.DestPort))),
+	}
+
+	// Users and keys that may not forward cannot jump either
+	rules := s.forwardRulesFor(ctx)
+	if rules == nil {
+		s.log.WithFields(fields).Warn("Local port forwarding denied: not permitted for this user or key")
+		newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
+		return
+	}
+
+	// Jumps to mesh peers (ssh -J) are allowed by the jump policy, other
+	// destinations by the user's local forwarding rules
+	addr, err := s.jumps.Permit(ctx, data.DestAddr, int(data.DestPort))
+	if err == nil {
+		s.openForward(newChan, ctx, addr, fields, "Jump to mesh peer")
+		return
+	}
+	if !errors.Is(err, jump.ErrNotPermitted) {
+		s.log.WithError(err).WithFields(fields).Warn("Jump to mesh peer failed")
+		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+
+	host, ok := permitDestination(ctx, rules.local, data.DestAddr, data.DestPort)
+	if !ok {
+		s.log.WithFields(fields).Warn("Local port forwarding denied by policy")
+		newChan.Reject(gossh.Prohibited, "destination not permitted")
+		return
+	}
+
+	s.openForward(newChan, ctx, net.JoinHostPort(host, strconv.Itoa(int(data.DestPort))), fields, "Local port forwarding")
+}
+
+// openForward dials addr and connects it to a direct-tcpip channel; kind names
+// the forward in log messages
+func (s *Server) openForward(newChan gossh.NewChannel, ctx ssh.Context, addr string, fields logrus.Fields, kind string) {
+	var dialer net.Dialer
+	dconn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		s.log.WithError(err).WithFields(fields).Warn(kind + " failed to connect")
+		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	s.log.WithFields(fields).Info(kind + " opened")
+	proxyForward(ch, dconn)
+}
+
+// remoteForwardHandler handles tcpip-forward and cancel-tcpip-forward (ssh -R)
+func (s *Server) remoteForwardHandler(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	var payload remoteForwardRequest
+	if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+		return false, nil
+	}
+
+	fields := logrus.Fields{
+		"user":      ctx.User(),
+		"remote_ip": remoteIP(ctx.RemoteAddr()),
+		"bind":      net.JoinHostPort(payload.BindAddr, strconv.Itoa(int(payload.BindPort))),
+	}
+
+	// Listeners are keyed per connection, so clients cannot cancel each other's forwards
+	key := func(port uint32) string {
+		return ctx.SessionID() + "|" + net.JoinHostPort(payload.BindAddr, strconv.Itoa(int(port)))
+	}
+
+	if req.Type == "cancel-tcpip-forward" {
+		s.remoteForwards.mu.Lock()
+		ln, ok := s.remoteForwards.listeners[key(payload.BindPort)]
+		s.remoteForwards.mu.Unlock()
+		if ok {
+			ln.Close()
+		}
+		return ok, nil
+	}
+
+	rules := s.forwardRulesFor(ctx)
+	if rules == nil {
+		s.log.WithFields(fields).Warn("Remote port forwarding denied: not permitted for this user or key")
+		return false, nil
+	}
+
+	bindHost, ok := permitBind(rules.remote, payload.BindAddr, payload.BindPort)
+	if !ok {
+		s.log.WithFields(fields).Warn("Remote port forwarding denied by policy")
+		return false, nil
+	}
+
+	// The daemon may be able to bind ports the account could not
+	if payload.BindPort != 0 && payload.BindPort < privilegedPortLimit {
+		acct, err := lookupAccount(ctx.User())
+		if err != nil || !acct.mayBindPrivilegedPorts() {
+			s.log.WithFields(fields).Warn("Remote port forwarding denied: privileged port")
+			return false, nil
+		}
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(bindHost, strconv.Itoa(int(payload.BindPort))))
+	if err != nil {
+		s.log.WithError(err).WithFields(fields).Warn("Remote port forwarding failed to listen")
+		return false, nil
+	}
+	port := uint32(ln.Addr().(*net.TCPAddr).Port)
+	id := key(port)
+
+	s.remoteForwards.mu.Lock()
+	s.remoteForwards.listeners[id] = ln
+	s.remoteForwards.mu.Unlock()
+
+	fields["listen"] = ln.Addr().String()
+	s.log.WithFields(fields).Info("Remote port forwarding opened")
+
+	conn := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+
+	// Stop listening when the client disconnects
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	go func() {
+		defer func() {
+			s.remoteForwards.mu.Lock()
+			delete(s.remoteForwards.listeners, id)
+			s.remoteForwards.mu.Unlock()
+			s.log.WithFields(fields).Info("Remote port forwarding closed")
+		}()
+
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			origin := c.RemoteAddr().(*net.TCPAddr)
+			data := gossh.Marshal(&forwardedTCPIPData{
+				DestAddr:   payload.BindAddr,
+				DestPort:   port,
+				OriginAddr: origin.IP.String(),
+				OriginPort: uint32(origin.Port),
+			})
+
+			go func() {
+				ch, reqs, err := conn.OpenChannel("forwarded-tcpip", data)
+				if err != nil {
+					s.log.WithError(err).WithFields(fields).Debug("Client refused forwarded connection")
+					c.Close()
+					return
+				}
+				go gossh.DiscardRequests(reqs)
+				proxyForward(ch, c)
+			}()
+		}
+	}()
+
+	if payload.BindPort == 0 {
+		return true, gossh.Marshal(&remoteForwardSuccess{BindPort: port})
+	}
+	return true, nil
+}
+
+// proxyForward copies data both ways between a forwarding channel and a TCP connection
+func proxyForward(ch gossh.Channel, conn net.Conn) {
+	go func() {
+		defer ch.Close()
+		defer conn.Close()
+		io.Copy(ch, conn)
+	}()
+	go func() {
+		defer ch.Close()
+		defer conn.Close()
+		io.Copy(conn, ch)
+	}()
+}
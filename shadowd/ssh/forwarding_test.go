@@ -0,0 +1,307 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shadow-shuttle/shadowd/jump"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		ports   string
+		lo, hi  uint32
+		wantErr bool
+	}{
+		{ports: "*", lo: 0, hi: 65535},
+		{ports: "22", lo: 22, hi: 22},
+		{ports: "3000-9000", lo: 3000, hi: 9000},
+		{ports: "9000-3000", wantErr: true},
+		{ports: "65536", wantErr: true},
+		{ports: "-1", wantErr: true},
+		{ports: "http", wantErr: true},
+		{ports: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		lo, hi, err := parsePortRange(tt.ports)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePortRange(%q) error = %v, want error %v", tt.ports, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (lo != tt.lo || hi != tt.hi) {
+			t.Errorf("parsePortRange(%q) = %d-%d, want %d-%d", tt.ports, lo, hi, tt.lo, tt.hi)
+		}
+	}
+}
+
+func TestParseForwardRule(t *testing.T) {
+	tests := []struct {
+		entry   string
+		wantErr bool
+		check   func(r forwardRule) bool
+	}{
+		{entry: "*:*", check: func(r forwardRule) bool { return r.anyHost }},
+		{entry: "localhost:22", check: func(r forwardRule) bool {
+			return r.containsIP(net.ParseIP("127.0.0.5")) && r.containsIP(net.ParseIP("::1"))
+		}},
+		{entry: "10.0.0.0/8:80", check: func(r forwardRule) bool {
+			return r.containsIP(net.ParseIP("10.1.2.3")) && !r.containsIP(net.ParseIP("11.0.0.1"))
+		}},
+		{entry: "[::1]:22", check: func(r forwardRule) bool { return r.containsIP(net.ParseIP("::1")) }},
+		{entry: "DB.Internal:5432", check: func(r forwardRule) bool { return r.name == "db.internal" }},
+		{entry: "localhost", wantErr: true},
+		{entry: "10.0.0.0/33:80", wantErr: true},
+		{entry: "host:99999", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		rule, err := parseForwardRule(tt.entry)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseForwardRule(%q) error = %v, want error %v", tt.entry, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !tt.check(rule) {
+			t.Errorf("parseForwardRule(%q) = %+v", tt.entry, rule)
+		}
+	}
+}
+
+// mustForwardRules parses rules or fails the test
+func mustForwardRules(t *testing.T, entries ...string) []forwardRule {
+	t.Helper()
+
+	var rules []forwardRule
+	for _, entry := range entries {
+		rule, err := parseForwardRule(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func TestPermitDestination(t *testing.T) {
+	rules := mustForwardRules(t, "localhost:3000-9000", "10.0.0.0/8:22", "db.internal:5432")
+
+	tests := []struct {
+		host   string
+		port   uint32
+		want   string
+		wantOK bool
+	}{
+		{"127.0.0.1", 8080, "127.0.0.1", true},
+		{"::1", 3000, "::1", true},
+		{"127.0.0.1", 22, "", false},
+		{"10.9.8.7", 22, "10.9.8.7", true},
+		{"10.9.8.7", 80, "", false},
+		{"DB.internal", 5432, "DB.internal", true},
+		{"db.internal", 5433, "", false},
+		{"192.0.2.1", 8080, "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := permitDestination(context.Background(), rules, tt.host, tt.port)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("permitDestination(%s, %d) = %q, %v, want %q, %v", tt.host, tt.port, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	if _, ok := permitDestination(context.Background(), nil, "127.0.0.1", 8080); ok {
+		t.Error("destination permitted without rules")
+	}
+}
+
+func TestPermitBind(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []string
+		host   string
+		port   uint32
+		want   string
+		wantOK bool
+	}{
+		{"empty means loopback", []string{"127.0.0.1:8080"}, "", 8080, "127.0.0.1", true},
+		{"localhost means loopback", []string{"localhost:*"}, "localhost", 8080, "127.0.0.1", true},
+		{"loopback rule", []string{"localhost:*"}, "::1", 8080, "::1", true},
+		{"all interfaces refused", []string{"localhost:*"}, "*", 8080, "", false},
+		{"LAN address refused", []string{"localhost:*"}, "192.168.1.10", 8080, "", false},
+		{"all interfaces allowed", []string{"*:8080"}, "*", 8080, "0.0.0.0", true},
+		{"LAN network", []string{"192.168.1.0/24:*"}, "192.168.1.10", 80, "192.168.1.10", true},
+		{"port outside range", []string{"localhost:3000-9000"}, "", 2999, "", false},
+		{"server picks port", []string{"localhost:*"}, "", 0, "127.0.0.1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := permitBind(mustForwardRules(t, tt.rules...), tt.host, tt.port)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("permitBind(%q, %d) = %q, %v, want %q, %v", tt.host, tt.port, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseForwardPolicies(t *testing.T) {
+	policies, err := parseForwardPolicies(map[string]ForwardPolicy{
+		"alice": {Local: []string{"*:*"}},
+		"*":     {Remote: []string{"localhost:3000-9000"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies["alice"].local) != 1 || len(policies["*"].remote) != 1 {
+		t.Errorf("policies = %+v", policies)
+	}
+
+	_, err = parseForwardPolicies(map[string]ForwardPolicy{"bob": {Remote: []string{"nope"}}})
+	if err == nil || !strings.Contains(err.Error(), `"bob"`) {
+		t.Errorf("error = %v, want one naming the user", err)
+	}
+}
+
+func TestMayBindPrivilegedPorts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no privileged ports")
+	}
+	if !(&loginAccount{UID: 0}).mayBindPrivilegedPorts() {
+		t.Error("root may not bind privileged ports")
+	}
+	if (&loginAccount{UID: 1000}).mayBindPrivilegedPorts() {
+		t.Error("an unprivileged account may bind privileged ports")
+	}
+}
+
+// TestRemoteForwardPrivilegedPort checks that a policy allowing every port
+// still cannot open a privileged port for an account that could not itself
+func TestRemoteForwardPrivilegedPort(t *testing.T) {
+	username := currentLoginUser(t)
+	acct, err := lookupAccount(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startServer(t, Config{
+		Users:          map[string]string{username: testPassword},
+		PortForwarding: map[string]ForwardPolicy{"*": {Remote: []string{"localhost:*"}}},
+	})
+
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            username,
+		Auth:            []gossh.AuthMethod{gossh.Password(testPassword)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("ssh dial: %v", err)
+	}
+	defer client.Close()
+
+	ln, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unprivileged forward refused: %v", err)
+	}
+	ln.Close()
+
+	ln, err = client.Listen("tcp", "127.0.0.1:1023")
+	if acct.mayBindPrivilegedPorts() {
+		if err != nil {
+			t.Errorf("privileged forward refused for %s: %v", username, err)
+		} else {
+			ln.Close()
+		}
+	} else if err == nil {
+		ln.Close()
+		t.Errorf("privileged forward opened for %s", username)
+	}
+}
+
+// TestJumpRespectsForwardingPolicy checks that ssh -J to a permitted peer is
+// refused to users without a port forwarding entry and to keys with
+// no-port-forwarding
+func TestJumpRespectsForwardingPolicy(t *testing.T) {
+	username := currentLoginUser(t)
+
+	peer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	go func() {
+		for {
+			conn, err := peer.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "SSH-2.0-peer\r\n")
+			conn.Close()
+		}
+	}()
+	port := peer.Addr().(*net.TCPAddr).Port
+	jumps, err := jump.NewPolicy(jump.Config{Targets: []string{"127.0.0.1"}, Ports: []int{port}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		policies map[string]ForwardPolicy
+		keyOnly  bool // log in with a no-port-forwarding key
+		wantJump bool
+	}{
+		{"no forwarding entry", nil, false, false},
+		{"entry without local rules", map[string]ForwardPolicy{username: {}}, false, true},
+		{"default entry", map[string]ForwardPolicy{"*": {}}, false, true},
+		{"no-port-forwarding key", map[string]ForwardPolicy{"*": {Local: []string{"*:*"}}}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, addr := startServerWith(t, Config{
+				Users:          map[string]string{username: testPassword},
+				PortForwarding: tt.policies,
+			}, Services{Jumps: jumps})
+
+			auth := gossh.Password(testPassword)
+			if tt.keyOnly {
+				signer := newTestSigner(t)
+				server.authorizedKeys.add(&authorizedKey{Key: signer.PublicKey(), Principals: []string{username}, NoPortForwarding: true})
+				auth = gossh.PublicKeys(signer)
+			}
+			client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+				User:            username,
+				Auth:            []gossh.AuthMethod{auth},
+				HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+				Timeout:         5 * time.Second,
+			})
+			if err != nil {
+				t.Fatalf("ssh dial: %v", err)
+			}
+			defer client.Close()
+
+			conn, err := client.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+			if !tt.wantJump {
+				if err == nil {
+					conn.Close()
+					t.Fatal("jump allowed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("jump refused: %v", err)
+			}
+			defer conn.Close()
+			banner, _ := io.ReadAll(conn)
+			if !strings.HasPrefix(string(banner), "SSH-2.0-peer") {
+				t.Errorf("read %q from the peer", banner)
+			}
+		})
+	}
+}
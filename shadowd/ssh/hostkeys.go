@@ -0,0 +1,419 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// OpenSSH host key update extension (see PROTOCOL in OpenSSH)
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// Host key types accepted by GenerateHostKey and RotateHostKeys
+const (
+	HostKeyEd25519 = "ed25519"
+	HostKeyECDSA   = "ecdsa"
+	HostKeyRSA     = "rsa"
+)
+
+// hostKeysAnnouncedKey marks a connection whose client was sent the host keys
+const hostKeysAnnouncedKey contextKey = "shadowd-host-keys-announced"
+
+// hostKey is a loaded host key. Only the first key of each algorithm is used
+// in the handshake; later ones are announced to clients so they can learn
+// them before they become active.
+type hostKey struct {
+	Path   string
+	Signer gossh.Signer
+	Active bool
+}
+
+// hostKeyRing holds the loaded host keys
+type hostKeyRing struct {
+	mu   sync.RWMutex
+	keys []*hostKey
+}
+
+// set replaces the loaded keys
+func (r *hostKeyRing) set(keys []*hostKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = keys
+}
+
+// all returns the loaded keys
+func (r *hostKeyRing) all() []*hostKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys
+}
+
+// find returns the key whose wire-format public key is blob
+func (r *hostKeyRing) find(blob []byte) *hostKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, key := range r.keys {
+		if string(key.Signer.PublicKey().Marshal()) == string(blob) {
+			return key
+		}
+	}
+	return nil
+}
+
+// HostKeyPaths returns the host key files of cfg, in order
+func HostKeyPaths(cfg Config) []string {
+	if len(cfg.HostKeyPaths) > 0 {
+		return cfg.HostKeyPaths
+	}
+	return []string{cfg.HostKeyPath}
+}
+
+// loadHostKeys loads every host key in paths, generating missing ones
+func (s *Server) loadHostKeys(paths []string) ([]*hostKey, error) {
+	var keys []*hostKey
+	seen := make(map[string]bool)
+
+	for _, path := range paths {
+		signer, err := ReadHostKey(path)
+		if errors.Is(err, os.ErrNotExist) {
+			keyType := hostKeyTypeFromPath(path)
+			s.log.WithFields(logrus.Fields{
+				"path": path,
+				"type": keyType,
+			}).Info("Generating new host key")
+			_, err = GenerateHostKey(path, keyType)
+			if err == nil {
+				signer, err = ReadHostKey(path)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		algo := signer.PublicKey().Type()
+		key := &hostKey{Path: path, Signer: signer, Active: !seen[algo]}
+		seen[algo] = true
+		keys = append(keys, key)
+
+		s.log.WithFields(logrus.Fields{
+			"path":        path,
+			"type":        algo,
+			"fingerprint": gossh.FingerprintSHA256(signer.PublicKey()),
+			"active":      key.Active,
+		}).Info("Loaded host key")
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no host keys configured")
+	}
+	return keys, nil
+}
+
+// ReloadHostKeys loads the host keys in paths and starts using them.
+// Keys of an algorithm that is no longer configured stay in use until restart.
+func (s *Server) ReloadHostKeys(paths []string) error {
+	keys, err := s.loadHostKeys(paths)
+	if err != nil {
+		return err
+	}
+
+	s.hostKeys.set(keys)
+	if s.server != nil {
+		for _, key := range keys {
+			if key.Active {
+				s.server.AddHostKey(key.Signer)
+			}
+		}
+	}
+	return nil
+}
+
+// announceHostKeys sends the client all host keys once per connection, so
+// OpenSSH clients with UpdateHostKeys can learn keys before they become active
+func (s *Server) announceHostKeys(ctx ssh.Context) {
+	ctx.Lock()
+	announced := ctx.Value(hostKeysAnnouncedKey) != nil
+	ctx.SetValue(hostKeysAnnouncedKey, true)
+	ctx.Unlock()
+	if announced {
+		return
+	}
+
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok {
+		return
+	}
+
+	var payload []byte
+	for _, key := range s.hostKeys.all() {
+		payload = appendString(payload, key.Signer.PublicKey().Marshal())
+	}
+	if _, _, err := conn.SendRequest(hostKeysRequest, false, payload); err != nil {
+		s.log.WithError(err).Debug("Failed to announce host keys")
+	}
+}
+
+// withHostKeyAnnouncement wraps a channel handler to announce the host keys
+// when the client opens its first channel, i.e. after authentication
+func (s *Server) withHostKeyAnnouncement(next ssh.ChannelHandler) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		s.announceHostKeys(ctx)
+		next(srv, conn, newChan, ctx)
+	}
+}
+
+// hostKeysProveHandler answers hostkeys-prove-00@openssh.com by signing each
+// requested host key together with the session ID
+func (s *Server) hostKeysProveHandler(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	sessionID, err := hex.DecodeString(ctx.SessionID())
+	if err != nil {
+		return false, nil
+	}
+
+	var reply []byte
+	rest := req.Payload
+	for len(rest) > 0 {
+		var blob []byte
+		blob, rest, err = readString(rest)
+		if err != nil {
+			s.log.WithError(err).Warn("Malformed host key proof request")
+			return false, nil
+		}
+
+		key := s.hostKeys.find(blob)
+		if key == nil {
+			s.log.Warn("Client asked to prove an unknown host key")
+			return false, nil
+		}
+
+		var data []byte
+		data = appendString(data, []byte(hostKeysProveRequest))
+		data = appendString(data, sessionID)
+		data = appendString(data, blob)
+
+		sig, err := signHostKeyProof(key.Signer, data)
+		if err != nil {
+			s.log.WithError(err).WithField("path", key.Path).Error("Failed to sign host key proof")
+			return false, nil
+		}
+		reply = appendString(reply, gossh.Marshal(sig))
+	}
+
+	return true, reply
+}
+
+// signHostKeyProof signs data, using SHA-512 for RSA keys as OpenSSH does
+func signHostKeyProof(signer gossh.Signer, data []byte) (*gossh.Signature, error) {
+	if algSigner, ok := signer.(gossh.AlgorithmSigner); ok && signer.PublicKey().Type() == gossh.KeyAlgoRSA {
+		return algSigner.SignWithAlgorithm(rand.Reader, data, gossh.KeyAlgoRSASHA512)
+	}
+	return signer.Sign(rand.Reader, data)
+}
+
+// ReadHostKey reads a host private key in OpenSSH, PKCS#1, PKCS#8 or SEC 1 format
+func ReadHostKey(path string) (gossh.Signer, error) {
+	keyData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := gossh.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// GenerateHostKey writes a new host key of keyType ("ed25519", "ecdsa" or "rsa")
+// to path in OpenSSH format, with its public key in path + ".pub"
+func GenerateHostKey(path, keyType string) (gossh.PublicKey, error) {
+	var privateKey crypto.Signer
+	var err error
+	switch keyType {
+	case HostKeyEd25519:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	case HostKeyECDSA:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case HostKeyRSA:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, fmt.Errorf("unsupported host key type %q (use ed25519, ecdsa or rsa)", keyType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate %s key: %w", keyType, err)
+	}
+
+	hostname, _ := os.Hostname()
+	block, err := gossh.MarshalPrivateKey(privateKey, "shadowd@"+hostname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode host key: %w", err)
+	}
+
+	publicKey, err := gossh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode host public key: %w", err)
+	}
+
+	keyFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host key file: %w", err)
+	}
+	defer keyFile.Close()
+
+	if err := pem.Encode(keyFile, block); err != nil {
+		return nil, fmt.Errorf("failed to write host key: %w", err)
+	}
+
+	if err := os.WriteFile(path+".pub", gossh.MarshalAuthorizedKey(publicKey), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write host public key: %w", err)
+	}
+
+	return publicKey, nil
+}
+
+// hostKeyTypeFromPath picks the type of a missing host key from its file name,
+// like ssh_host_ecdsa_key; the default is ed25519
+func hostKeyTypeFromPath(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	switch {
+	case strings.Contains(name, "ecdsa"):
+		return HostKeyECDSA
+	case strings.Contains(name, "rsa"):
+		return HostKeyRSA
+	default:
+		return HostKeyEd25519
+	}
+}
+
+// hostKeyTypeMatches reports whether a public key is of keyType
+func hostKeyTypeMatches(key gossh.PublicKey, keyType string) bool {
+	switch keyType {
+	case HostKeyEd25519:
+		return key.Type() == gossh.KeyAlgoED25519
+	case HostKeyECDSA:
+		return strings.HasPrefix(key.Type(), "ecdsa-sha2-")
+	case HostKeyRSA:
+		return key.Type() == gossh.KeyAlgoRSA
+	}
+	return false
+}
+
+// HostKeyRotation describes one step of RotateHostKeys
+type HostKeyRotation struct {
+	// Paths is the new host key list
+	Paths []string
+
+	// Added is the key generated by a phase-in step
+	Added string
+
+	// AddedKey is the public key of Added
+	AddedKey gossh.PublicKey
+
+	// Retired are the keys dropped by a phase-out step; their files were renamed to <path>.retired
+	Retired []string
+}
+
+// RotateHostKeys performs the next step of rotating the keyType host key.
+//
+// With at most one key of that type, it phases a new key in: the key is
+// generated next to the existing ones and appended to the list, so it is
+// announced to clients but the current key stays active. Run again once
+// clients have connected, it phases the old key out: the older keys of that
+// type are removed and the newest becomes active.
+func RotateHostKeys(paths []string, keyType string) (*HostKeyRotation, error) {
+	var matching []int
+	for i, path := range paths {
+		signer, err := ReadHostKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if hostKeyTypeMatches(signer.PublicKey(), keyType) {
+			matching = append(matching, i)
+		}
+	}
+
+	// Phase out: keep only the newest key of this type
+	if len(matching) >= 2 {
+		rotation := &HostKeyRotation{}
+		retired := make(map[int]bool)
+		for _, i := range matching[:len(matching)-1] {
+			retired[i] = true
+		}
+		for i, path := range paths {
+			if !retired[i] {
+				rotation.Paths = append(rotation.Paths, path)
+				continue
+			}
+			if err := os.Rename(path, path+".retired"); err != nil {
+				return nil, fmt.Errorf("failed to retire host key: %w", err)
+			}
+			// Keys installed without a public key file have nothing more to retire
+			if err := os.Rename(path+".pub", path+".pub.retired"); err != nil && !errors.Is(err, os.ErrNotExist) {
+				os.Rename(path+".retired", path)
+				return nil, fmt.Errorf("failed to retire host public key: %w", err)
+			}
+			rotation.Retired = append(rotation.Retired, path)
+		}
+		return rotation, nil
+	}
+
+	// Phase in: add a new key after the existing ones
+	dir := filepath.Dir(paths[0])
+	base := filepath.Join(dir, fmt.Sprintf("ssh_host_%s_key-%s", keyType, time.Now().Format("20060102")))
+	path := base
+	for n := 2; ; n++ {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		path = fmt.Sprintf("%s.%d", base, n)
+	}
+
+	publicKey, err := GenerateHostKey(path, keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HostKeyRotation{
+		Paths:    append(append([]string(nil), paths...), path),
+		Added:    path,
+		AddedKey: publicKey,
+	}, nil
+}
+
+// appendString appends b in SSH wire format (uint32 length, then bytes)
+func appendString(buf, b []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b)))
+	return append(buf, b...)
+}
+
+// readString reads one SSH wire format string
+func readString(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 4 {
+		return nil, nil, fmt.Errorf("short string")
+	}
+	n := binary.BigEndian.Uint32(buf)
+	if uint64(len(buf)-4) < uint64(n) {
+		return nil, nil, fmt.Errorf("string length %d exceeds payload", n)
+	}
+	return buf[4 : 4+n], buf[4+n:], nil
+}
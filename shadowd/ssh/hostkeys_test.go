@@ -0,0 +1,162 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// generateHostKeys writes host keys of the given types into dir and returns their paths
+func generateHostKeys(t *testing.T, dir string, keyTypes ...string) []string {
+	t.Helper()
+
+	var paths []string
+	for _, keyType := range keyTypes {
+		path := filepath.Join(dir, "ssh_host_"+keyType+"_key")
+		if _, err := GenerateHostKey(path, keyType); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestRotateHostKeys(t *testing.T) {
+	dir := t.TempDir()
+	paths := generateHostKeys(t, dir, HostKeyEd25519, HostKeyECDSA)
+	oldKey, ecdsaKey := paths[0], paths[1]
+
+	// Phase in: a new key is appended, the current one stays first
+	in, err := RotateHostKeys(paths, HostKeyEd25519)
+	if err != nil {
+		t.Fatalf("phase in: %v", err)
+	}
+	if in.Added == "" || len(in.Retired) != 0 {
+		t.Fatalf("phase in = %+v, want one added key", in)
+	}
+	if len(in.Paths) != 3 || in.Paths[0] != oldKey || in.Paths[1] != ecdsaKey || in.Paths[2] != in.Added {
+		t.Errorf("phase in paths = %v, want the new key after %v", in.Paths, paths)
+	}
+	signer, err := ReadHostKey(in.Added)
+	if err != nil {
+		t.Fatalf("added key: %v", err)
+	}
+	if string(signer.PublicKey().Marshal()) != string(in.AddedKey.Marshal()) {
+		t.Error("AddedKey is not the key written to disk")
+	}
+	if _, err := os.Stat(in.Added + ".pub"); err != nil {
+		t.Errorf("added public key: %v", err)
+	}
+
+	// Phase out: the old key is retired and the new one takes its place
+	out, err := RotateHostKeys(in.Paths, HostKeyEd25519)
+	if err != nil {
+		t.Fatalf("phase out: %v", err)
+	}
+	if out.Added != "" || len(out.Retired) != 1 || out.Retired[0] != oldKey {
+		t.Fatalf("phase out = %+v, want %s retired", out, oldKey)
+	}
+	if len(out.Paths) != 2 || out.Paths[0] != ecdsaKey || out.Paths[1] != in.Added {
+		t.Errorf("phase out paths = %v, want [%s %s]", out.Paths, ecdsaKey, in.Added)
+	}
+	for _, path := range []string{oldKey, oldKey + ".pub"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still present: %v", path, err)
+		}
+		if _, err := os.Stat(path + ".retired"); err != nil {
+			t.Errorf("%s not retired: %v", path, err)
+		}
+	}
+}
+
+func TestRotateHostKeysWithoutPublicKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	paths := generateHostKeys(t, dir, HostKeyEd25519)
+	in, err := RotateHostKeys(paths, HostKeyEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(paths[0] + ".pub"); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := RotateHostKeys(in.Paths, HostKeyEd25519)
+	if err != nil {
+		t.Fatalf("phase out without a .pub file: %v", err)
+	}
+	if len(out.Retired) != 1 {
+		t.Errorf("retired = %v, want the old key", out.Retired)
+	}
+}
+
+// TestHostKeysProve checks over a connection that the proof of each host key
+// verifies with that key, as OpenSSH clients check it
+func TestHostKeysProve(t *testing.T) {
+	paths := generateHostKeys(t, t.TempDir(), HostKeyEd25519, HostKeyECDSA, HostKeyRSA)
+	_, addr := startServer(t, Config{
+		HostKeyPaths: paths,
+		Users:        map[string]string{"alice": "secret"},
+	})
+
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            "alice",
+		Auth:            []gossh.AuthMethod{gossh.Password("secret")},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("ssh dial: %v", err)
+	}
+	defer client.Close()
+
+	var keys []gossh.PublicKey
+	var payload []byte
+	for _, path := range paths {
+		signer, err := ReadHostKey(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, signer.PublicKey())
+		payload = appendString(payload, signer.PublicKey().Marshal())
+	}
+
+	ok, reply, err := client.SendRequest(hostKeysProveRequest, true, payload)
+	if err != nil || !ok {
+		t.Fatalf("prove request = %v, %v", ok, err)
+	}
+
+	rest := reply
+	for _, key := range keys {
+		var blob []byte
+		if blob, rest, err = readString(rest); err != nil {
+			t.Fatalf("reply for %s: %v", key.Type(), err)
+		}
+		var sig gossh.Signature
+		if err := gossh.Unmarshal(blob, &sig); err != nil {
+			t.Fatalf("signature for %s: %v", key.Type(), err)
+		}
+
+		var data []byte
+		data = appendString(data, []byte(hostKeysProveRequest))
+		data = appendString(data, client.SessionID())
+		data = appendString(data, key.Marshal())
+		if err := key.Verify(data, &sig); err != nil {
+			t.Errorf("proof for %s does not verify: %v", key.Type(), err)
+		}
+		if key.Type() == gossh.KeyAlgoRSA && sig.Format != gossh.KeyAlgoRSASHA512 {
+			t.Errorf("RSA proof format = %s, want %s", sig.Format, gossh.KeyAlgoRSASHA512)
+		}
+	}
+	if len(rest) != 0 {
+		t.Errorf("%d bytes left over in the reply", len(rest))
+	}
+
+	// A key the server does not hold cannot be proven
+	unknown := newTestSigner(t).PublicKey()
+	if ok, _, err := client.SendRequest(hostKeysProveRequest, true, appendString(nil, unknown.Marshal())); err != nil || ok {
+		t.Errorf("proving an unknown key = %v, %v, want refused", ok, err)
+	}
+}
@@ -0,0 +1,74 @@
+package ssh
+
+import (
+	"net"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Defaults for dead-peer detection
+const (
+	defaultKeepAliveInterval = 15 * time.Second
+	defaultKeepAliveCountMax = 3
+)
+
+// keepAliveRequest is the global request OpenSSH's sshd sends as ClientAliveInterval.
+// Clients answer it, usually with a failure, which is all that is needed.
+const keepAliveRequest = "keepalive@openssh.com"
+
+// keepAlive probes the client of a connection every KeepAliveInterval and
+// closes the connection after KeepAliveCountMax probes in a row go
+// unanswered, so sessions of clients that vanished without closing the TCP
+// connection are torn down. It returns when the connection closes.
+func (s *Server) keepAlive(ctx ssh.Context, conn net.Conn) {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+
+	replies := make(chan struct{}, 1)
+	pending := false // a probe is waiting for its reply
+	missed := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-replies:
+			pending = false
+			missed = 0
+
+		case <-ticker.C:
+			sshConn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+			if !ok {
+				continue // handshake still in progress
+			}
+
+			if pending {
+				missed++
+				if missed < s.config.KeepAliveCountMax {
+					continue
+				}
+				s.log.WithFields(logrus.Fields{
+					"remote_addr": conn.RemoteAddr().String(),
+					"user":        sshConn.User(),
+					"missed":      missed,
+					"reason":      "keepalive timeout",
+				}).Warn("Client stopped answering keepalives, closing connection")
+				conn.Close()
+				return
+			}
+
+			// Replies are awaited in the background: SendRequest blocks
+			// until the peer answers, which a dead peer never does
+			pending = true
+			go func() {
+				if _, _, err := sshConn.SendRequest(keepAliveRequest, true, nil); err == nil {
+					replies <- struct{}{}
+				}
+			}()
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package ssh
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestKeepAlive(t *testing.T) {
+	_, addr := startServer(t, Config{
+		Users:             map[string]string{"alice": "secret"},
+		KeepAliveInterval: 50 * time.Millisecond,
+		KeepAliveCountMax: 2,
+	})
+
+	tests := []struct {
+		name    string
+		answer  bool // the client replies to global requests
+		wantEnd bool
+	}{
+		{"responsive client", true, false},
+		{"unresponsive client", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp, err := net.DialTimeout("tcp", addr, 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tcp.Close()
+
+			conn, chans, reqs, err := gossh.NewClientConn(tcp, addr, &gossh.ClientConfig{
+				User:            "alice",
+				Auth:            []gossh.AuthMethod{gossh.Password("secret")},
+				HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+				Timeout:         5 * time.Second,
+			})
+			if err != nil {
+				t.Fatalf("ssh handshake: %v", err)
+			}
+			defer conn.Close()
+
+			// Without a Client nothing reads the server's requests, so the
+			// keepalives go unanswered
+			if tt.answer {
+				client := gossh.NewClient(conn, chans, reqs)
+				defer client.Close()
+			}
+
+			done := make(chan error, 1)
+			go func() { done <- conn.Wait() }()
+
+			select {
+			case err := <-done:
+				if !tt.wantEnd {
+					t.Fatalf("connection closed (%v) while the client answered keepalives", err)
+				}
+			case <-time.After(time.Second):
+				if tt.wantEnd {
+					t.Fatal("unresponsive client not disconnected")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// defaultKeysReloadInterval is how often the authorized_keys file is checked for changes
+const defaultKeysReloadInterval = 5 * time.Second
+
+// keyStore is a concurrency-safe set of authorized keys.
+// Reloads build a new map and swap it in whole, so readers never see a half-loaded file.
+type keyStore struct {
+	mu   sync.RWMutex
+	keys map[string]*authorizedKey
+}
+
+// newKeyStore creates an empty key store
+func newKeyStore() *keyStore {
+	return &keyStore{keys: make(map[string]*authorizedKey)}
+}
+
+// keyID returns the map key for a public key
+func keyID(key gossh.PublicKey) string {
+	return string(key.Marshal())
+}
+
+// lookup returns the entry for key, or nil if it is not authorized
+func (ks *keyStore) lookup(key gossh.PublicKey) *authorizedKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[keyID(key)]
+}
+
+// add inserts or replaces a single entry
+func (ks *keyStore) add(entry *authorizedKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[keyID(entry.Key)] = entry
+}
+
+// remove deletes the entry for key
+func (ks *keyStore) remove(key gossh.PublicKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	delete(ks.keys, keyID(key))
+}
+
+// count returns the number of authorized keys
+func (ks *keyStore) count() int {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return len(ks.keys)
+}
+
+// replace swaps in a new key set and returns the fingerprints that were added and removed
+func (ks *keyStore) replace(entries []*authorizedKey) (added, removed []string) {
+	keys := make(map[string]*authorizedKey, len(entries))
+	for _, entry := range entries {
+		id := keyID(entry.Key)
+		if _, exists := keys[id]; exists {
+			// Like sshd, the first entry for a key wins
+			continue
+		}
+		keys[id] = entry
+	}
+
+	ks.mu.Lock()
+	old := ks.keys
+	ks.keys = keys
+	ks.mu.Unlock()
+
+	for id, entry := range keys {
+		if _, ok := old[id]; !ok {
+			added = append(added, gossh.FingerprintSHA256(entry.Key))
+		}
+	}
+	for id, entry := range old {
+		if _, ok := keys[id]; !ok {
+			removed = append(removed, gossh.FingerprintSHA256(entry.Key))
+		}
+	}
+
+	return added, removed
+}
+
+// ReloadAuthorizedKeys re-reads the authorized_keys file and swaps it into the key store.
+// A missing file is an empty key set, so deleting it revokes every key; on any
+// other read error the current keys are kept.
+func (s *Server) ReloadAuthorizedKeys() error {
+	if s.config.AuthorizedKeysPath == "" {
+		return fmt.Errorf("authorized keys path not configured")
+	}
+
+	data, err := os.ReadFile(s.config.AuthorizedKeysPath)
+	if errors.Is(err, os.ErrNotExist) {
+		s.log.WithField("path", s.config.AuthorizedKeysPath).Warn("Authorized keys file does not exist, no keys are authorized")
+		data = nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read authorized keys: %w", err)
+	}
+
+	keys, errs := parseAuthorizedKeys(data)
+	for _, err := range errs {
+		s.log.WithError(err).WithField("path", s.config.AuthorizedKeysPath).Warn("Failed to parse authorized key, skipping")
+	}
+
+	added, removed := s.authorizedKeys.replace(keys)
+	for _, fp := range added {
+		s.log.WithField("fingerprint", fp).Info("Authorized key added")
+	}
+	for _, fp := range removed {
+		s.log.WithField("fingerprint", fp).Info("Authorized key removed")
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"count":   len(keys),
+		"added":   len(added),
+		"removed": len(removed),
+	}).Info("Loaded authorized keys")
+	return nil
+}
+
+// watchAuthorizedKeys polls the authorized_keys file and reloads it when it changes
+func (s *Server) watchAuthorizedKeys() {
+	defer s.wg.Done()
+
+	interval := s.config.AuthorizedKeysReloadInterval
+	if interval <= 0 {
+		interval = defaultKeysReloadInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastMod, lastSize := s.statAuthorizedKeys()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			mod, size := s.statAuthorizedKeys()
+			if mod.Equal(lastMod) && size == lastSize {
+				continue
+			}
+			lastMod, lastSize = mod, size
+
+			if err := s.ReloadAuthorizedKeys(); err != nil {
+				s.log.WithError(err).Warn("Failed to reload authorized keys, keeping current keys")
+			}
+		}
+	}
+}
+
+// statAuthorizedKeys returns the modification time and size of the authorized_keys file
+func (s *Server) statAuthorizedKeys() (time.Time, int64) {
+	info, err := os.Stat(s.config.AuthorizedKeysPath)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return info.ModTime(), info.Size()
+}
@@ -0,0 +1,62 @@
+package ssh
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestReloadAuthorizedKeys(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	s, err := NewServer(Config{
+		MeshIP:             "127.0.0.1",
+		Port:               2222,
+		HostKeyPath:        "unused",
+		AuthorizedKeysPath: path,
+	}, Services{}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := newTestSigner(t).PublicKey()
+	if err := os.WriteFile(path, append([]byte(`principals="alice" `), gossh.MarshalAuthorizedKey(key)...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadAuthorizedKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if s.authorizedKeys.lookup(key) == nil {
+		t.Fatal("key not loaded")
+	}
+
+	// A file that cannot be read keeps the current keys
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadAuthorizedKeys(); err == nil {
+		t.Error("reading a directory succeeded")
+	}
+	if s.authorizedKeys.lookup(key) == nil {
+		t.Error("keys dropped on a read error")
+	}
+
+	// A deleted file revokes every key
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadAuthorizedKeys(); err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	if s.authorizedKeys.count() != 0 {
+		t.Errorf("%d keys still authorized after the file was deleted", s.authorizedKeys.count())
+	}
+}
@@ -0,0 +1,44 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// loginAccount describes the OS account a session runs as
+type loginAccount struct {
+	Username string
+	UID      uint32
+	GID      uint32
+	Groups   []uint32
+	HomeDir  string
+	Shell    string
+}
+
+// loginEnv builds a clean login environment for the account.
+// Nothing is inherited from the daemon's own environment.
+func loginEnv(acct *loginAccount, sess ssh.Session) []string {
+	env := []string{
+		"HOME=" + acct.HomeDir,
+		"USER=" + acct.Username,
+		"LOGNAME=" + acct.Username,
+		"SHELL=" + acct.Shell,
+		"PATH=" + loginPath(),
+	}
+
+	// SSH_CLIENT / SSH_CONNECTION mirror what OpenSSH exports
+	remoteHost, remotePort, err := net.SplitHostPort(sess.RemoteAddr().String())
+	if err == nil {
+		localHost, localPort, err := net.SplitHostPort(sess.LocalAddr().String())
+		if err == nil {
+			env = append(env,
+				fmt.Sprintf("SSH_CLIENT=%s %s %s", remoteHost, remotePort, localPort),
+				fmt.Sprintf("SSH_CONNECTION=%s %s %s %s", remoteHost, remotePort, localHost, localPort),
+			)
+		}
+	}
+
+	return env
+}
@@ -0,0 +1,150 @@
+//go:build !windows
+// +build !windows
+
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultLoginPath is the PATH given to sessions, matching OpenSSH's default
+const defaultLoginPath = "/usr/local/bin:/usr/bin:/bin:/usr/local/sbin:/usr/sbin:/sbin"
+
+// lookupAccount resolves a login name to an OS account
+func lookupAccount(name string) (*loginAccount, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %q: %w", name, err)
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %q for user %q", u.Uid, name)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid %q for user %q", u.Gid, name)
+	}
+
+	acct := &loginAccount{
+		Username: u.Username,
+		UID:      uint32(uid),
+		GID:      uint32(gid),
+		HomeDir:  u.HomeDir,
+		Shell:    lookupShell(u.Username),
+	}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups for user %q: %w", name, err)
+	}
+	for _, g := range groupIDs {
+		id, err := strconv.ParseUint(g, 10, 32)
+		if err != nil {
+			continue
+		}
+		acct.Groups = append(acct.Groups, uint32(id))
+	}
+
+	if acct.HomeDir == "" {
+		acct.HomeDir = "/"
+	}
+
+	return acct, nil
+}
+
+// lookupShell returns the login shell from the passwd database, or /bin/sh
+func lookupShell(username string) string {
+	if shell := shellFromPasswd("/etc/passwd", username); shell != "" {
+		return shell
+	}
+
+	// macOS keeps regular accounts in Directory Services, not /etc/passwd
+	if runtime.GOOS == "darwin" {
+		out, err := exec.Command("dscl", ".", "-read", "/Users/"+username, "UserShell").Output()
+		if err == nil {
+			fields := strings.Fields(string(out))
+			if len(fields) == 2 && fields[0] == "UserShell:" {
+				return fields[1]
+			}
+		}
+	}
+
+	return "/bin/sh"
+}
+
+// shellFromPasswd reads the shell field for username from a passwd(5) file
+func shellFromPasswd(path, username string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == username {
+			return fields[6]
+		}
+	}
+	return ""
+}
+
+// loginPath returns the PATH for a fresh login environment
+func loginPath() string {
+	return defaultLoginPath
+}
+
+// loginArgv0 returns the argv[0] that marks a login shell ("-bash" for /bin/bash)
+func loginArgv0(shell string) string {
+	return "-" + filepath.Base(shell)
+}
+
+// applyCredentials makes cmd run as the account.
+// Switching to another account requires the daemon to run as root.
+func (a *loginAccount) applyCredentials(cmd *exec.Cmd) error {
+	if a.isDaemonUser() {
+		return nil
+	}
+	if os.Getuid() != 0 {
+		return fmt.Errorf("cannot run session as %q: shadowd is not running as root", a.Username)
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    a.UID,
+		Gid:    a.GID,
+		Groups: a.Groups,
+	}
+	return nil
+}
+
+// isDaemonUser reports whether the account is the one shadowd runs as
+func (a *loginAccount) isDaemonUser() bool {
+	return uint32(os.Getuid()) == a.UID
+}
+
+// isSuperuser reports whether the account is root
+func (a *loginAccount) isSuperuser() bool {
+	return a.UID == 0
+}
+
+// mayBindPrivilegedPorts reports whether the account may listen on ports below 1024
+func (a *loginAccount) mayBindPrivilegedPorts() bool {
+	return a.UID == 0
+}
+
+// shellCommandFlag makes the shell run a command string ("$SHELL -c command")
+const shellCommandFlag = "-c"
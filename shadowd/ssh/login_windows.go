@@ -0,0 +1,78 @@
+//go:build windows
+// +build windows
+
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// lookupAccount resolves a login name to an OS account.
+// Windows cannot switch users for a child process, so only the daemon's own account is accepted.
+func lookupAccount(name string) (*loginAccount, error) {
+	current, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current user: %w", err)
+	}
+
+	// Windows usernames are reported as DOMAIN\user
+	username := current.Username
+	if i := strings.LastIndex(username, `\`); i >= 0 {
+		username = username[i+1:]
+	}
+	if !strings.EqualFold(username, name) {
+		return nil, fmt.Errorf("cannot run session as %q: only %q is supported on Windows", name, username)
+	}
+
+	shell := os.Getenv("COMSPEC")
+	if shell == "" {
+		shell = `C:\Windows\System32\cmd.exe`
+	}
+
+	return &loginAccount{
+		Username: username,
+		HomeDir:  current.HomeDir,
+		Shell:    shell,
+	}, nil
+}
+
+// loginPath returns the PATH for a fresh login environment.
+// Windows has no fixed system PATH, so the daemon's own is reused.
+func loginPath() string {
+	return os.Getenv("PATH")
+}
+
+// loginArgv0 returns the shell's argv[0]; Windows has no login-shell convention
+func loginArgv0(shell string) string {
+	return filepath.Base(shell)
+}
+
+// applyCredentials is a no-op on Windows; sessions run as the daemon's account
+func (a *loginAccount) applyCredentials(cmd *exec.Cmd) error {
+	return nil
+}
+
+// isDaemonUser reports whether the account is the one shadowd runs as
+func (a *loginAccount) isDaemonUser() bool {
+	return true
+}
+
+// isSuperuser reports whether the account is root. Sessions run as the
+// daemon's account on Windows, so there is no other one to guard.
+func (a *loginAccount) isSuperuser() bool {
+	return false
+}
+
+// mayBindPrivilegedPorts reports whether the account may listen on ports below 1024.
+// Windows has no privileged ports.
+func (a *loginAccount) mayBindPrivilegedPorts() bool {
+	return true
+}
+
+// shellCommandFlag makes cmd.exe run a command string ("cmd.exe /C command")
+const shellCommandFlag = "/C"
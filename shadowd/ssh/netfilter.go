@@ -0,0 +1,61 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseAllowedNetworks turns AllowedNetworks entries into IP networks.
+// Entries may be IPv4/IPv6 CIDRs, bare IP addresses, or hostnames; hostnames
+// are resolved once here and each address becomes a single-host network.
+func parseAllowedNetworks(entries []string, lookupIP func(host string) ([]net.IP, error)) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q in allowed networks: %w", entry, err)
+			}
+			networks = append(networks, network)
+			continue
+		}
+
+		if ip := net.ParseIP(entry); ip != nil {
+			networks = append(networks, hostNetwork(ip))
+			continue
+		}
+
+		ips, err := lookupIP(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %q in allowed networks: %w", entry, err)
+		}
+		for _, ip := range ips {
+			networks = append(networks, hostNetwork(ip))
+		}
+	}
+
+	return networks, nil
+}
+
+// hostNetwork returns the /32 or /128 network containing only ip
+func hostNetwork(ip net.IP) *net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// parseRemoteIP parses the host part of an address, dropping any IPv6 zone
+func parseRemoteIP(host string) net.IP {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
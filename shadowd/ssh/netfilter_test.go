@@ -0,0 +1,109 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// fakeLookup resolves a fixed set of names
+func fakeLookup(host string) ([]net.IP, error) {
+	switch host {
+	case "laptop.mesh":
+		return []net.IP{net.ParseIP("100.64.1.2"), net.ParseIP("fd7a:115c:a1e0::2")}, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestParseAllowedNetworks(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []string
+		wantErr string
+	}{
+		{name: "IPv4 CIDR", entries: []string{"100.64.0.0/10"}, want: []string{"100.64.0.0/10"}},
+		{name: "IPv6 CIDR", entries: []string{"fd7a:115c:a1e0::/48"}, want: []string{"fd7a:115c:a1e0::/48"}},
+		{name: "bare addresses", entries: []string{"192.0.2.1", "2001:db8::1"}, want: []string{"192.0.2.1/32", "2001:db8::1/128"}},
+		{name: "hostname", entries: []string{"laptop.mesh"}, want: []string{"100.64.1.2/32", "fd7a:115c:a1e0::2/128"}},
+		{name: "blank entries skipped", entries: []string{" ", " 10.0.0.0/8 "}, want: []string{"10.0.0.0/8"}},
+		{name: "bad CIDR", entries: []string{"10.0.0.0/33"}, wantErr: "invalid CIDR"},
+		{name: "unknown host", entries: []string{"nowhere.mesh"}, wantErr: "failed to resolve"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			networks, err := parseAllowedNetworks(tt.entries, fakeLookup)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, network := range networks {
+				got = append(got, network.String())
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("networks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAllowedIP(t *testing.T) {
+	networks, err := parseAllowedNetworks([]string{"100.64.0.0/10", "fd7a:115c:a1e0::/48", "192.0.2.1"}, fakeLookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{allowedNets: networks}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"100.64.0.1", true},
+		{"100.127.255.255", true},
+		{"100.128.0.1", false},
+		{"::ffff:100.64.0.1", true}, // IPv4-mapped, as dual-stack listeners report it
+		{"fd7a:115c:a1e0::1", true},
+		{"fd7a:115c:a1e0::1%eth0", true},
+		{"fd7a:115c:a1e1::1", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"127.0.0.1", false},
+		{"", false},
+		{"not-an-ip", false},
+	}
+	for _, tt := range tests {
+		if got := s.isAllowedIP(tt.ip); got != tt.want {
+			t.Errorf("isAllowedIP(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// TestConnectionOutsideAllowedNetworks checks that a client outside the
+// allowed networks is dropped before the SSH handshake
+func TestConnectionOutsideAllowedNetworks(t *testing.T) {
+	_, addr := startServer(t, Config{AllowedNetworks: []string{"10.0.0.0/8"}})
+
+	_, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            "nobody",
+		Auth:            []gossh.AuthMethod{gossh.Password("x")},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		t.Fatal("handshake succeeded from outside the allowed networks")
+	}
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		t.Errorf("client got as far as authentication: %v", err)
+	}
+}
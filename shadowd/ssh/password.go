@@ -0,0 +1,192 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Argon2id parameters used by HashPassword (RFC 9106, second recommended option)
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// Bounds on the argon2id parameters of a configured hash. A hash outside them
+// is rejected before deriving a key, since argon2 panics on t=0 or p=0 and m
+// decides how much memory a single login attempt allocates.
+const (
+	argon2MaxTime   = 16
+	argon2MaxMemory = 1024 * 1024 // KiB
+	argon2MinKeyLen = 4
+)
+
+// Bounds on the scrypt parameters of a configured hash. scrypt allocates
+// 128·r·2^ln bytes per check and its work grows with p as well, so a hash
+// outside them is rejected rather than run on every login attempt.
+const (
+	scryptMaxR      = 32
+	scryptMaxP      = 16
+	scryptMaxMemory = 1 << 30 // bytes, the same as argon2MaxMemory
+)
+
+// maxConcurrentVerifications bounds how many hashed passwords are checked at
+// once. Each argon2id check allocates m KiB (64 MiB by default), and unknown
+// users are checked against the dummy hash too, so without a bound a burst
+// of login attempts could exhaust memory.
+const maxConcurrentVerifications = 4
+
+// verifySlots holds one token per password check in progress
+var verifySlots = make(chan struct{}, maxConcurrentVerifications)
+
+// dummyPasswordHash is compared against when the user does not exist,
+// so unknown and known users take the same time to reject
+const dummyPasswordHash = "$argon2id$v=19$m=65536,t=3,p=4$YseI7Mh4+ryt6CuKIRRHMg$H9MPE6V0JjVIcbH6EOjcYHADpuDzbghYYjel3i50gzA"
+
+// b64 is the unpadded standard base64 used by PHC strings
+var b64 = base64.RawStdEncoding
+
+// HashPassword hashes a password with argon2id in PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	hash := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		b64.EncodeToString(salt), b64.EncodeToString(hash)), nil
+}
+
+// isPasswordHash reports whether a configured password is a recognized hash
+func isPasswordHash(stored string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$", "$scrypt$"} {
+		if strings.HasPrefix(stored, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPassword checks a password against a configured value.
+// The scheme is detected by prefix: bcrypt ($2a$/$2b$/$2y$), argon2id ($argon2id$),
+// scrypt ($scrypt$ln=..,r=..,p=..$salt$hash); anything else is a legacy plaintext password.
+func verifyPassword(stored, password string) (bool, error) {
+	if isPasswordHash(stored) {
+		verifySlots <- struct{}{}
+		defer func() { <-verifySlots }()
+	}
+
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return verifyArgon2id(stored, password)
+
+	case strings.HasPrefix(stored, "$scrypt$"):
+		return verifyScrypt(stored, password)
+
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, nil
+	}
+}
+
+// verifyArgon2id checks a $argon2id$v=19$m=..,t=..,p=..$salt$hash string
+func verifyArgon2id(stored, password string) (bool, error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+	if iterations < 1 || iterations > argon2MaxTime {
+		return false, fmt.Errorf("invalid argon2id time cost t=%d", iterations)
+	}
+	if threads < 1 {
+		return false, fmt.Errorf("invalid argon2id parallelism p=%d", threads)
+	}
+	if memory < 8*uint32(threads) || memory > argon2MaxMemory {
+		return false, fmt.Errorf("invalid argon2id memory cost m=%d", memory)
+	}
+
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	want, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2id hash: %w", err)
+	}
+	if len(want) < argon2MinKeyLen {
+		return false, fmt.Errorf("argon2id hash is too short")
+	}
+
+	got := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// verifyScrypt checks a $scrypt$ln=..,r=..,p=..$salt$hash string (passlib format)
+func verifyScrypt(stored, password string) (bool, error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 5 {
+		return false, fmt.Errorf("malformed scrypt hash")
+	}
+
+	var logN, r, p int
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil {
+		return false, fmt.Errorf("malformed scrypt parameters: %w", err)
+	}
+	if logN <= 0 || logN > 30 {
+		return false, fmt.Errorf("invalid scrypt cost ln=%d", logN)
+	}
+	if r < 1 || r > scryptMaxR {
+		return false, fmt.Errorf("invalid scrypt block size r=%d", r)
+	}
+	if p < 1 || p > scryptMaxP {
+		return false, fmt.Errorf("invalid scrypt parallelism p=%d", p)
+	}
+	if 128*int64(r)<<logN > scryptMaxMemory {
+		return false, fmt.Errorf("scrypt parameters ln=%d,r=%d need too much memory", logN, r)
+	}
+
+	salt, err := b64.DecodeString(parts[3])
+	if err != nil {
+		return false, fmt.Errorf("malformed scrypt salt: %w", err)
+	}
+	want, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("malformed scrypt hash: %w", err)
+	}
+
+	got, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, len(want))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
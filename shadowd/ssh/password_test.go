@@ -0,0 +1,131 @@
+package ssh
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// cheapArgon2id hashes a password with parameters small enough for tests
+func cheapArgon2id(password string) string {
+	salt := []byte("0123456789abcdef")
+	hash := argon2.IDKey([]byte(password), salt, 1, 64, 1, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=19$m=64,t=1,p=1$%s$%s", b64.EncodeToString(salt), b64.EncodeToString(hash))
+}
+
+func TestVerifyPassword(t *testing.T) {
+	hashed, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("saltsalt")
+	scrypted, err := scrypt.Key([]byte("hunter2"), salt, 1<<4, 8, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scryptHash := fmt.Sprintf("$scrypt$ln=4,r=8,p=1$%s$%s", b64.EncodeToString(salt), b64.EncodeToString(scrypted))
+	cheap := cheapArgon2id("hunter2")
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		want     bool
+		wantErr  bool
+	}{
+		{name: "argon2id", stored: hashed, password: "hunter2", want: true},
+		{name: "argon2id wrong password", stored: hashed, password: "hunter3"},
+		{name: "argon2id small parameters", stored: cheap, password: "hunter2", want: true},
+		{name: "bcrypt", stored: string(bcrypted), password: "hunter2", want: true},
+		{name: "bcrypt wrong password", stored: string(bcrypted), password: "nope"},
+		{name: "scrypt", stored: scryptHash, password: "hunter2", want: true},
+		{name: "scrypt wrong password", stored: scryptHash, password: "nope"},
+		{name: "plaintext", stored: "hunter2", password: "hunter2", want: true},
+		{name: "plaintext wrong password", stored: "hunter2", password: "hunter"},
+		{name: "dummy hash", stored: dummyPasswordHash, password: ""},
+
+		{name: "argon2id missing field", stored: "$argon2id$v=19$m=64,t=1,p=1$c2FsdA", wantErr: true},
+		{name: "argon2id other version", stored: "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "argon2id garbled parameters", stored: "$argon2id$v=19$t=1,m=64,p=1$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "argon2id zero time", stored: "$argon2id$v=19$m=64,t=0,p=1$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "argon2id huge time", stored: "$argon2id$v=19$m=64,t=4000000000,p=1$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "argon2id zero threads", stored: "$argon2id$v=19$m=64,t=1,p=0$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "argon2id threads overflow", stored: "$argon2id$v=19$m=64,t=1,p=256$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "argon2id memory below 8p", stored: "$argon2id$v=19$m=7,t=1,p=1$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "argon2id huge memory", stored: "$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "argon2id bad salt", stored: "$argon2id$v=19$m=64,t=1,p=1$!!$aGFzaGhhc2g", wantErr: true},
+		{name: "argon2id bad hash", stored: "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$!!", wantErr: true},
+		{name: "argon2id empty hash", stored: "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$", wantErr: true},
+		{name: "scrypt zero cost", stored: "$scrypt$ln=0,r=8,p=1$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "scrypt huge cost", stored: "$scrypt$ln=31,r=8,p=1$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "scrypt zero block size", stored: "$scrypt$ln=4,r=0,p=1$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "scrypt huge block size", stored: "$scrypt$ln=4,r=1000000,p=1$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "scrypt zero parallelism", stored: "$scrypt$ln=4,r=8,p=0$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "scrypt huge parallelism", stored: "$scrypt$ln=4,r=8,p=100000$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "scrypt too much memory", stored: "$scrypt$ln=24,r=8,p=1$c2FsdA$aGFzaGhhc2g", wantErr: true},
+		{name: "scrypt missing field", stored: "$scrypt$ln=4,r=8,p=1$c2FsdA", wantErr: true},
+		{name: "bcrypt truncated", stored: "$2a$04$short", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyPassword(tt.stored, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyPassword error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("verifyPassword = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPasswordHash(t *testing.T) {
+	tests := []struct {
+		stored string
+		want   bool
+	}{
+		{dummyPasswordHash, true},
+		{"$2b$10$abcdefghijklmnopqrstuv", true},
+		{"$scrypt$ln=4,r=8,p=1$a$b", true},
+		{"$argon2i$v=19$m=64,t=1,p=1$a$b", false},
+		{"hunter2", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := isPasswordHash(tt.stored); got != tt.want {
+			t.Errorf("isPasswordHash(%q) = %v, want %v", tt.stored, got, tt.want)
+		}
+	}
+}
+
+// TestVerifyPasswordConcurrency checks that concurrent checks share the
+// bounded slots without deadlocking, and release them afterwards
+func TestVerifyPasswordConcurrency(t *testing.T) {
+	stored := cheapArgon2id("pw")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4*maxConcurrentVerifications; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, err := verifyPassword(stored, "pw"); !ok || err != nil {
+				t.Errorf("verifyPassword = %v, %v", ok, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(verifySlots); n != 0 {
+		t.Errorf("%d verification slots still held", n)
+	}
+}
@@ -0,0 +1,150 @@
+package ssh
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/shadow-shuttle/shadowd/sessions"
+	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// killGracePeriod is how long a hung-up session's processes get to exit before they are killed
+const killGracePeriod = 5 * time.Second
+
+// sessionProcess supervises the process started for a session: it forwards the
+// client's signals, hangs up the process group when the client goes away, and
+// reports how the process ended.
+type sessionProcess struct {
+	cmd   *exec.Cmd
+	tty   *os.File          // PTY master, nil without a PTY
+	done  chan struct{}     // closed once the process has been waited for
+	entry *sessions.Session // session registry entry, may be nil
+	log   *logrus.Logger
+}
+
+// superviseProcess starts supervising cmd, which must already be started, and
+// reports its foreground process to the session registry
+func (s *Server) superviseProcess(sess ssh.Session, cmd *exec.Cmd, tty *os.File) *sessionProcess {
+	p := &sessionProcess{
+		cmd:   cmd,
+		tty:   tty,
+		done:  make(chan struct{}),
+		entry: sessionEntry(sess),
+		log:   s.log,
+	}
+	p.entry.SetForeground(func() string { return foregroundCommand(p) })
+
+	signals := make(chan ssh.Signal, 16)
+	sess.Signals(signals)
+	gone := sessionDone(sess)
+
+	go func() {
+		defer sess.Signals(nil)
+		for {
+			select {
+			case <-p.done:
+				return
+			case sig := <-signals:
+				if err := signalProcess(p, sig); err != nil {
+					p.log.WithError(err).WithField("signal", sig).Warn("Failed to deliver signal")
+				} else {
+					p.log.WithField("signal", sig).Debug("Delivered signal from client")
+				}
+			case <-gone:
+				gone = nil
+				p.hangUp()
+			}
+		}
+	}()
+
+	return p
+}
+
+// hangUp tells the session's processes that the client is gone, as closing a
+// terminal would, and kills them if they are still running after killGracePeriod
+func (p *sessionProcess) hangUp() {
+	p.log.WithField("pid", p.cmd.Process.Pid).Info("Client disconnected, hanging up session processes")
+	hangUpProcess(p)
+
+	time.AfterFunc(killGracePeriod, func() {
+		select {
+		case <-p.done:
+		default:
+			p.log.WithField("pid", p.cmd.Process.Pid).Warn("Session processes ignored hangup, killing them")
+			killProcess(p)
+		}
+	})
+}
+
+// wait waits for the process to exit and reports its exit status to the client
+func (p *sessionProcess) wait(sess ssh.Session) error {
+	err := p.cmd.Wait()
+	close(p.done)
+	p.entry.SetForeground(nil)
+	exitSession(sess, p.cmd.ProcessState)
+	return err
+}
+
+// exitSignalMsg is the payload of an exit-signal request (RFC 4254 section 6.10)
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+// exitSession reports how the session's process ended and closes the session.
+// A process killed by a signal is reported with exit-signal, as sshd does.
+func exitSession(sess ssh.Session, state *os.ProcessState) {
+	if state == nil {
+		sess.Exit(1)
+		return
+	}
+
+	code, signal, coreDumped := exitStatus(state)
+	if signal == "" {
+		sess.Exit(code)
+		return
+	}
+
+	sess.SendRequest("exit-signal", false, gossh.Marshal(&exitSignalMsg{
+		Signal:     string(signal),
+		CoreDumped: coreDumped,
+	}))
+	sess.Close()
+}
+
+// runPiped runs cmd without a PTY, connected to the session's stdin, stdout and
+// stderr, and reports its exit status to the client. It returns the error from
+// starting or waiting for the command.
+func (s *Server) runPiped(sess ssh.Session, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	cmd.Stdout = sess
+	cmd.Stderr = sess.Stderr()
+
+	// Copy stdin ourselves: with cmd.Stdin = sess, Wait would block until the
+	// client sends more input even though the process has exited
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		sess.Exit(1)
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		io.WriteString(sess.Stderr(), err.Error()+"\n")
+		sess.Exit(127)
+		return err
+	}
+	proc := s.superviseProcess(sess, cmd, nil)
+
+	go func() {
+		io.Copy(stdin, sess)
+		stdin.Close()
+	}()
+
+	return proc.wait(sess)
+}
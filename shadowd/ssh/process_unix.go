@@ -0,0 +1,138 @@
+//go:build !windows
+// +build !windows
+
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/gliderlabs/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// signals maps SSH signal names (RFC 4254 section 6.10) to OS signals
+var signals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGABRT: syscall.SIGABRT,
+	ssh.SIGALRM: syscall.SIGALRM,
+	ssh.SIGFPE:  syscall.SIGFPE,
+	ssh.SIGHUP:  syscall.SIGHUP,
+	ssh.SIGILL:  syscall.SIGILL,
+	ssh.SIGINT:  syscall.SIGINT,
+	ssh.SIGKILL: syscall.SIGKILL,
+	ssh.SIGPIPE: syscall.SIGPIPE,
+	ssh.SIGQUIT: syscall.SIGQUIT,
+	ssh.SIGSEGV: syscall.SIGSEGV,
+	ssh.SIGTERM: syscall.SIGTERM,
+	ssh.SIGUSR1: syscall.SIGUSR1,
+	ssh.SIGUSR2: syscall.SIGUSR2,
+}
+
+// setProcessGroup makes cmd the leader of a new process group, so signals
+// reach the children it starts as well
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcess delivers a client signal. With a PTY it goes to the terminal's
+// foreground process group, like a key press would; otherwise to the command's
+// process group.
+func signalProcess(p *sessionProcess, sig ssh.Signal) error {
+	osSig, ok := signals[sig]
+	if !ok {
+		return fmt.Errorf("unsupported signal %q", sig)
+	}
+
+	pgid := p.cmd.Process.Pid
+	if p.tty != nil {
+		if fg := foregroundGroup(p.tty); fg > 0 {
+			pgid = fg
+		}
+	}
+	return syscall.Kill(-pgid, osSig)
+}
+
+// hangUpProcess sends SIGHUP to the session's process group and, with a PTY,
+// to the terminal's foreground process group
+func hangUpProcess(p *sessionProcess) {
+	signalGroups(p, syscall.SIGHUP)
+}
+
+// killProcess sends SIGKILL to the session's process groups
+func killProcess(p *sessionProcess) {
+	signalGroups(p, syscall.SIGKILL)
+}
+
+// signalGroups sends sig to the process group led by the session's process and
+// to the terminal's foreground process group, if different
+func signalGroups(p *sessionProcess, sig syscall.Signal) {
+	pgid := p.cmd.Process.Pid
+	syscall.Kill(-pgid, sig)
+	if p.tty != nil {
+		if fg := foregroundGroup(p.tty); fg > 0 && fg != pgid {
+			syscall.Kill(-fg, sig)
+		}
+	}
+}
+
+// foregroundGroup returns the foreground process group of the terminal, or 0
+func foregroundGroup(tty *os.File) int {
+	// Going through SyscallConn keeps the file in non-blocking mode, unlike Fd
+	conn, err := tty.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	pgid := 0
+	conn.Control(func(fd uintptr) {
+		if fg, err := unix.IoctlGetInt(int(fd), unix.TIOCGPGRP); err == nil {
+			pgid = fg
+		}
+	})
+	return pgid
+}
+
+// foregroundCommand returns the command line of the session's foreground
+// process: the terminal's foreground process group leader with a PTY, the
+// session's process otherwise
+func foregroundCommand(p *sessionProcess) string {
+	pid := p.cmd.Process.Pid
+	if p.tty != nil {
+		if fg := foregroundGroup(p.tty); fg > 0 {
+			pid = fg
+		}
+	}
+
+	// Linux exposes the arguments in /proc; elsewhere ask ps
+	if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		return strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+	out, err := exec.Command("ps", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// exitStatus returns the exit code of a finished process or, if it was killed
+// by a signal with an SSH name, that name and whether it dumped core. Other
+// signals are reported as exit code 128+n, like shells do.
+func exitStatus(state *os.ProcessState) (int, ssh.Signal, bool) {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return state.ExitCode(), "", false
+	}
+
+	for name, sig := range signals {
+		if sig == status.Signal() {
+			return 0, name, status.CoreDump()
+		}
+	}
+	return 128 + int(status.Signal()), "", false
+}
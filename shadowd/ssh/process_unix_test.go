@@ -0,0 +1,84 @@
+//go:build !windows
+// +build !windows
+
+package ssh
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// TestExitStatusAndSignal checks over a connection how a command's end is
+// reported: its exit code as exit-status, and a signal that killed it,
+// whether raised by itself or sent by the client, as exit-signal
+func TestExitStatusAndSignal(t *testing.T) {
+	addr, username := startTestServer(t, nil)
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            username,
+		Auth:            []gossh.AuthMethod{gossh.Password(testPassword)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("ssh dial: %v", err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		name       string
+		command    string
+		send       gossh.Signal // sent by the client once the command runs
+		wantStatus int          // the client reports a signal as 128+n
+		wantSignal string
+	}{
+		{"success", "true", "", 0, ""},
+		{"exit code", "exit 3", "", 3, ""},
+		{"killed by itself", "kill -TERM $$", "", 128 + 15, "TERM"},
+		{"signal from client", "exec sleep 10", gossh.SIGINT, 128 + 2, "INT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+
+			if err := session.Start(tt.command); err != nil {
+				t.Fatal(err)
+			}
+			if tt.send != "" {
+				if err := session.Signal(tt.send); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			done := make(chan error, 1)
+			go func() { done <- session.Wait() }()
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("command did not end")
+			}
+
+			if tt.wantStatus == 0 && tt.wantSignal == "" {
+				if err != nil {
+					t.Errorf("err = %v, want success", err)
+				}
+				return
+			}
+			var exitErr *gossh.ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("err = %v, want an exit error", err)
+			}
+			if exitErr.ExitStatus() != tt.wantStatus || exitErr.Signal() != tt.wantSignal {
+				t.Errorf("exit = status %d, signal %q, want status %d, signal %q",
+					exitErr.ExitStatus(), exitErr.Signal(), tt.wantStatus, tt.wantSignal)
+			}
+		})
+	}
+}
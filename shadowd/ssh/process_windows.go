@@ -0,0 +1,46 @@
+//go:build windows
+// +build windows
+
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// setProcessGroup is a no-op on Windows, which has no process groups to signal
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcess delivers a client signal. Windows can only terminate the
+// process, so signals that do not normally end it are refused.
+func signalProcess(p *sessionProcess, sig ssh.Signal) error {
+	switch sig {
+	case ssh.SIGINT, ssh.SIGTERM, ssh.SIGKILL, ssh.SIGHUP, ssh.SIGQUIT:
+		return p.cmd.Process.Kill()
+	}
+	return fmt.Errorf("unsupported signal %q", sig)
+}
+
+// hangUpProcess terminates the session's process
+func hangUpProcess(p *sessionProcess) {
+	p.cmd.Process.Kill()
+}
+
+// killProcess terminates the session's process
+func killProcess(p *sessionProcess) {
+	p.cmd.Process.Kill()
+}
+
+// foregroundCommand returns the command line of the session's process
+func foregroundCommand(p *sessionProcess) string {
+	return strings.Join(p.cmd.Args, " ")
+}
+
+// exitStatus returns the exit code of a finished process; Windows has no exit signals
+func exitStatus(state *os.ProcessState) (int, ssh.Signal, bool) {
+	return state.ExitCode(), "", false
+}
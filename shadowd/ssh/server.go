@@ -2,19 +2,23 @@ package ssh
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"os/exec"
 	"sync"
+	"time"
 
 	"github.com/creack/pty"
 	"github.com/gliderlabs/ssh"
+	"github.com/shadow-shuttle/shadowd/acceptenv"
+	"github.com/shadow-shuttle/shadowd/jump"
+	"github.com/shadow-shuttle/shadowd/limits"
+	"github.com/shadow-shuttle/shadowd/lockout"
+	"github.com/shadow-shuttle/shadowd/pairing"
+	"github.com/shadow-shuttle/shadowd/recording"
+	"github.com/shadow-shuttle/shadowd/sessions"
 	"github.com/sirupsen/logrus"
 	gossh "golang.org/x/crypto/ssh"
 )
@@ -30,8 +34,45 @@ type Server struct {
 	running   bool
 	mu        sync.RWMutex
 	
-	// Authorized keys for authentication
-	authorizedKeys map[string]gossh.PublicKey
+	// Authorized keys (with their authorized_keys options) for authentication
+	authorizedKeys *keyStore
+	
+	// Trusted CAs for OpenSSH user certificates
+	userCAKeys []gossh.PublicKey
+	
+	// Brute-force protection shared with the WebSocket proxy (nil disables it)
+	guard *lockout.Guard
+	
+	// Session limits shared with the WebSocket proxy (nil disables them)
+	limiter *limits.Limiter
+	
+	// Live sessions of all transports (nil tracks none)
+	sessions *sessions.Registry
+	
+	// Mesh peers clients may jump to, shared with the WebSocket proxy (nil allows none)
+	jumps *jump.Policy
+	
+	// Tickets of paired devices, accepted in place of a password from the
+	// WebSocket proxy (nil accepts none)
+	tickets *pairing.Authority
+	
+	// Parsed AllowedNetworks, with hostnames resolved at load time
+	allowedNets []*net.IPNet
+	
+	// Parsed PortForwarding policies by username
+	forwardPolicies map[string]*forwardRules
+	
+	// Listeners opened for remote port forwarding
+	remoteForwards *remoteForwards
+	
+	// Session recordings (nil disables recording)
+	recordings *recording.Store
+	
+	// Loaded host keys, announced to clients with hostkeys-00@openssh.com
+	hostKeys *hostKeyRing
+	
+	// Last accepted TOTP step per user
+	totpReplay *totpReplay
 }
 
 // Config contains SSH server configuration
@@ -42,28 +83,84 @@ type Config struct {
 	// Port is the SSH port to listen on
 	Port int
 	
-	// HostKeyPath is the path to the SSH host key
+	// HostKeyPath is the path to the SSH host key, used when HostKeyPaths is empty
 	HostKeyPath string
 	
-	// AllowedNetworks are the CIDR ranges allowed to connect (Mesh network only)
+	// HostKeyPaths are the host key files, in order. The first key of each
+	// algorithm is used for the handshake; all of them are announced to clients.
+	// Missing files are generated, as ed25519 unless the name says ecdsa or rsa.
+	HostKeyPaths []string
+	
+	// AllowedNetworks are the CIDR ranges (IPv4 or IPv6), IP addresses or
+	// hostnames allowed to connect (Mesh network only). Hostnames are resolved on Start.
 	AllowedNetworks []string
 	
 	// AuthorizedKeysPath is the path to the authorized_keys file
 	AuthorizedKeysPath string
 	
+	// AuthorizedKeysReloadInterval is how often the authorized_keys file is checked for changes
+	AuthorizedKeysReloadInterval time.Duration
+	
 	// Users contains username -> password mappings for password authentication
 	Users map[string]string
+	
+	// PermitRootLogin lets clients log in as root (uid 0). When off, root is
+	// refused whatever the credentials, like sshd's PermitRootLogin no.
+	PermitRootLogin bool
+	
+	// TOTPSecrets maps usernames to base32 TOTP secrets. These users must enter
+	// a code (keyboard-interactive) after their password or key is accepted.
+	TOTPSecrets map[string]string
+	
+	// TrustedUserCAKeysPath is the path to CA public keys accepted for user certificates
+	TrustedUserCAKeysPath string
+	
+	// RevokedCertSerials are certificate serial numbers that are always refused
+	RevokedCertSerials []uint64
+	
+	// SFTPRoots maps usernames to the directory their SFTP sessions are confined to.
+	// The "*" entry applies to users without their own; "%h" expands to the home
+	// directory and "%u" to the username. Users without a root see the whole filesystem.
+	SFTPRoots map[string]string
+	
+	// AcceptEnv are the names of client environment variables (env requests)
+	// passed to sessions; "*" and "?" match as in sshd_config. Defaults to
+	// LANG, LC_* and TERM.
+	AcceptEnv []string
+	
+	// PortForwarding maps usernames to their port forwarding policy; the "*" entry
+	// applies to users without their own. Users without a policy cannot forward.
+	PortForwarding map[string]ForwardPolicy
+	
+	// KeepAliveInterval is how often clients are probed with keepalive@openssh.com
+	// (default: 15s); a negative value disables the probes
+	KeepAliveInterval time.Duration
+	
+	// KeepAliveCountMax is how many probes in a row may go unanswered before
+	// the connection is dropped (default: 3)
+	KeepAliveCountMax int
+}
+
+// Services are the shared services a Server uses. Any of them may be nil to
+// turn its feature off.
+type Services struct {
+	Guard      *lockout.Guard     // brute-force protection
+	Limiter    *limits.Limiter    // session limits
+	Sessions   *sessions.Registry // live sessions for the admin API
+	Jumps      *jump.Policy       // hosts ssh -J may reach; nil refuses jumps
+	Tickets    *pairing.Authority // paired devices' ticket logins
+	Recordings *recording.Store   // session recording
 }
 
 // NewServer creates a new SSH server instance
-func NewServer(cfg Config, log *logrus.Logger) (*Server, error) {
+func NewServer(cfg Config, services Services, log *logrus.Logger) (*Server, error) {
 	if cfg.MeshIP == "" {
 		return nil, fmt.Errorf("mesh IP is required")
 	}
 	if cfg.Port <= 0 || cfg.Port > 65535 {
 		return nil, fmt.Errorf("invalid port: %d", cfg.Port)
 	}
-	if cfg.HostKeyPath == "" {
+	if cfg.HostKeyPath == "" && len(cfg.HostKeyPaths) == 0 {
 		return nil, fmt.Errorf("host key path is required")
 	}
 	
@@ -72,6 +169,17 @@ func NewServer(cfg Config, log *logrus.Logger) (*Server, error) {
 		cfg.AllowedNetworks = []string{"100.64.0.0/10"}
 	}
 	
+	if cfg.AcceptEnv == nil {
+		cfg.AcceptEnv = acceptenv.Default
+	}
+	
+	if cfg.KeepAliveInterval == 0 {
+		cfg.KeepAliveInterval = defaultKeepAliveInterval
+	}
+	if cfg.KeepAliveCountMax <= 0 {
+		cfg.KeepAliveCountMax = defaultKeepAliveCountMax
+	}
+	
 	ctx, cancel := context.WithCancel(context.Background())
 	
 	s := &Server{
@@ -79,7 +187,16 @@ func NewServer(cfg Config, log *logrus.Logger) (*Server, error) {
 		log:            log,
 		ctx:            ctx,
 		cancel:         cancel,
-		authorizedKeys: make(map[string]gossh.PublicKey),
+		authorizedKeys: newKeyStore(),
+		guard:          services.Guard,
+		limiter:        services.Limiter,
+		sessions:       services.Sessions,
+		jumps:          services.Jumps,
+		tickets:        services.Tickets,
+		remoteForwards: newRemoteForwards(),
+		recordings:     services.Recordings,
+		hostKeys:       &hostKeyRing{},
+		totpReplay:     &totpReplay{lastStep: make(map[string]int64)},
 	}
 	
 	return s, nil
@@ -96,28 +213,85 @@ func (s *Server) Start() error {
 	
 	s.log.Info("Starting SSH server")
 	
-	// Load or generate host key
-	hostKey, err := s.loadOrGenerateHostKey()
+	// Resolve allowed networks once, up front
+	allowedNets, err := parseAllowedNetworks(s.config.AllowedNetworks, net.LookupIP)
+	if err != nil {
+		return fmt.Errorf("failed to load allowed networks: %w", err)
+	}
+	s.allowedNets = allowedNets
+	
+	// Parse port forwarding policies
+	forwardPolicies, err := parseForwardPolicies(s.config.PortForwarding)
+	if err != nil {
+		return fmt.Errorf("failed to load port forwarding policy: %w", err)
+	}
+	s.forwardPolicies = forwardPolicies
+	
+	// Load or generate host keys
+	hostKeys, err := s.loadHostKeys(HostKeyPaths(s.config))
 	if err != nil {
-		return fmt.Errorf("failed to load host key: %w", err)
+		return fmt.Errorf("failed to load host keys: %w", err)
 	}
+	s.hostKeys.set(hostKeys)
 	
 	// Load authorized keys
-	if err := s.loadAuthorizedKeys(); err != nil {
+	if err := s.ReloadAuthorizedKeys(); err != nil {
 		s.log.WithError(err).Warn("Failed to load authorized keys, continuing without key-based auth")
 	}
 	
+	// Pick up edits to authorized_keys without a restart
+	if s.config.AuthorizedKeysPath != "" {
+		s.wg.Add(1)
+		go s.watchAuthorizedKeys()
+	}
+	
+	// Load trusted user CA keys
+	if s.config.TrustedUserCAKeysPath != "" {
+		caKeys, err := loadTrustedUserCAKeys(s.config.TrustedUserCAKeysPath)
+		if err != nil {
+			return fmt.Errorf("failed to load trusted user CA keys: %w", err)
+		}
+		s.userCAKeys = caKeys
+		s.log.WithField("count", len(caKeys)).Info("Loaded trusted user CA keys")
+	}
+	
+	// Plaintext passwords still work but should be migrated to hashes
+	for username, stored := range s.config.Users {
+		if !isPasswordHash(stored) {
+			s.log.WithField("user", username).Warn("Password for user is stored in plaintext, run 'shadowd passwd " + username + "' to hash it")
+		}
+	}
+	
 	// Create SSH server
 	s.server = &ssh.Server{
 		Addr: fmt.Sprintf("%s:%d", s.config.MeshIP, s.config.Port),
-		Handler: s.sessionHandler,
-		PublicKeyHandler: s.publicKeyHandler,
-		PasswordHandler: s.passwordHandler, // Always deny passwords
+		Handler: s.withTracking(s.sessionHandler),
+		// Password and public key callbacks are installed by serverConfig
+		ServerConfigCallback: s.serverConfig,
+		KeyboardInteractiveHandler: s.keyboardInteractiveHandler,
+		PtyCallback: s.ptyCallback,
+		ConnCallback: s.connCallback,
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": ssh.SubsystemHandler(s.withTracking(s.sftpHandler)),
+		},
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session":      s.withHostKeyAnnouncement(s.withChannelContext(ssh.DefaultSessionHandler)),
+			"direct-tcpip": s.withHostKeyAnnouncement(s.directTCPIPHandler),
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":        s.remoteForwardHandler,
+			"cancel-tcpip-forward": s.remoteForwardHandler,
+			hostKeysProveRequest:   s.hostKeysProveHandler,
+		},
+	}
+	
+	// Add the active host key of each algorithm
+	for _, key := range hostKeys {
+		if key.Active {
+			s.server.AddHostKey(key.Signer)
+		}
 	}
 	
-	// Add host key
-	s.server.AddHostKey(hostKey)
-	
 	// Start server in goroutine
 	s.wg.Add(1)
 	go func() {
@@ -170,27 +344,21 @@ func (s *Server) IsRunning() bool {
 
 // sessionHandler handles SSH sessions
 func (s *Server) sessionHandler(sess ssh.Session) {
-	// Check if connection is from allowed network
-	remoteAddr := sess.RemoteAddr().String()
-	host, _, err := net.SplitHostPort(remoteAddr)
-	if err != nil {
-		s.log.WithError(err).Warn("Failed to parse remote address")
-		io.WriteString(sess, "Access denied\n")
-		sess.Exit(1)
-		return
-	}
+	// Allowed networks were already enforced in connCallback, before the handshake
+	host := remoteIP(sess.RemoteAddr())
 	
-	if !s.isAllowedIP(host) {
-		s.log.WithFields(logrus.Fields{
-			"remote_ip": host,
-		}).Warn("Connection attempt from unauthorized network")
-		io.WriteString(sess, "Access denied: not from Mesh network\n")
+	// Map the login name to an OS account
+	acct, err := lookupAccount(sess.User())
+	if err != nil {
+		s.log.WithError(err).WithField("user", sess.User()).Warn("Failed to resolve login account")
+		io.WriteString(sess, "Access denied: unknown user\n")
 		sess.Exit(1)
 		return
 	}
 	
 	s.log.WithFields(logrus.Fields{
 		"user":      sess.User(),
+		"uid":       acct.UID,
 		"remote_ip": host,
 	}).Info("SSH session started")
 	
@@ -205,56 +373,76 @@ func (s *Server) sessionHandler(sess ssh.Session) {
 	}
 	
 	// Handle shell or command execution
-	cmd := sess.Command()
-	if len(cmd) == 0 {
+	if key := sessionKey(sess.Context()); key != nil && key.Command != "" {
+		// Forced command from authorized_keys replaces whatever was requested
+		s.log.WithFields(logrus.Fields{
+			"user":             sess.User(),
+			"forced_command":   key.Command,
+			"original_command": sess.RawCommand(),
+		}).Info("Running forced command")
+		s.handleShell(sess, acct, key.Command, isPty, winCh)
+	} else if sess.RawCommand() == "" {
 		// Interactive shell
-		s.handleShell(sess, isPty, winCh)
+		s.handleShell(sess, acct, "", isPty, winCh)
 	} else {
-		// Command execution
-		s.handleCommand(sess, cmd)
+		// Command execution, through the account's shell as sshd does
+		s.log.WithFields(logrus.Fields{
+			"user":    acct.Username,
+			"command": sess.RawCommand(),
+		}).Info("Executing command")
+		s.handleShell(sess, acct, sess.RawCommand(), isPty, winCh)
 	}
 	
 	s.log.WithField("user", sess.User()).Info("SSH session ended")
 }
 
-// handleShell handles interactive shell sessions
-func (s *Server) handleShell(sess ssh.Session, isPty bool, winCh <-chan ssh.Window) {
-	// Spawn a real shell process
-	shell := os.Getenv("SHELL")
-	if shell == "" {
-		shell = "/bin/sh"
-	}
-	
-	cmd := exec.Command(shell)
-	
-	// Set working directory to user's home directory
-	// Try multiple methods to get home directory
-	homeDir := os.Getenv("HOME")
-	if homeDir == "" {
-		var err error
-		homeDir, err = os.UserHomeDir()
-		if err != nil {
-			s.log.WithError(err).Warn("Failed to get user home directory, using current directory")
-		}
+// handleShell runs the account's login shell, or command with "$SHELL -c"
+// when it is not empty, with or without a PTY.
+func (s *Server) handleShell(sess ssh.Session, acct *loginAccount, command string, isPty bool, winCh <-chan ssh.Window) {
+	// Spawn the account's login shell in its home directory
+	cmd := exec.Command(acct.Shell)
+	cmd.Args[0] = loginArgv0(acct.Shell)
+	if command != "" {
+		cmd = exec.Command(acct.Shell, shellCommandFlag, command)
 	}
+	cmd.Dir = acct.HomeDir
+	cmd.Env = s.sessionEnv(sess, acct)
 	
-	if homeDir != "" {
-		cmd.Dir = homeDir
-		s.log.WithFields(logrus.Fields{
-			"home_dir": homeDir,
-			"shell":    shell,
-		}).Info("Setting shell working directory to home")
-	} else {
-		s.log.Warn("Home directory is empty, using current directory")
+	if key := sessionKey(sess.Context()); key != nil && key.Command != "" {
+		cmd.Env = append(cmd.Env, "SSH_ORIGINAL_COMMAND="+sess.RawCommand())
+	}
+	
+	// Forward the client's agent for the lifetime of the session
+	if sock, stopAgent := s.forwardAgent(sess, acct); sock != "" {
+		defer stopAgent()
+		cmd.Env = append(cmd.Env, "SSH_AUTH_SOCK="+sock)
 	}
 	
+	if err := acct.applyCredentials(cmd); err != nil {
+		s.log.WithError(err).Error("Failed to set session credentials")
+		io.WriteString(sess, fmt.Sprintf("Failed to start shell: %v\n", err))
+		sess.Exit(1)
+		return
+	}
+	
+	s.log.WithFields(logrus.Fields{
+		"user":     acct.Username,
+		"home_dir": acct.HomeDir,
+		"shell":    acct.Shell,
+		"command":  command != "",
+	}).Info("Starting login shell")
+	
 	// Set up PTY if requested
 	if isPty {
 		ptyReq, _, _ := sess.Pty()
-		cmd.Env = append(os.Environ(), fmt.Sprintf("TERM=%s", ptyReq.Term))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
 		
-		// Create PTY
-		ptmx, err := pty.Start(cmd)
+		// Create PTY with the client's terminal modes
+		var modes gossh.TerminalModes
+		if cc := channelContextFor(sess); cc != nil {
+			modes = cc.terminalModes()
+		}
+		ptmx, err := startPty(cmd, modes)
 		if err != nil {
 			s.log.WithError(err).Error("Failed to start PTY")
 			io.WriteString(sess, fmt.Sprintf("Failed to start shell: %v\n", err))
@@ -262,6 +450,13 @@ func (s *Server) handleShell(sess ssh.Session, isPty bool, winCh <-chan ssh.Wind
 			return
 		}
 		defer ptmx.Close()
+		proc := s.superviseProcess(sess, cmd, ptmx)
+		entry := sessionEntry(sess)
+		entry.SetPtySize(ptyReq.Window.Width, ptyReq.Window.Height)
+		
+		// Record the session if enabled; a nil recorder records nothing
+		rec := s.recordings.Start(acct.Username, remoteIP(sess.RemoteAddr()), ptyReq.Term, ptyReq.Window.Width, ptyReq.Window.Height)
+		defer rec.Close()
 		
 		// Handle window size changes
 		go func() {
@@ -270,82 +465,148 @@ func (s *Server) handleShell(sess ssh.Session, isPty bool, winCh <-chan ssh.Wind
 					Rows: uint16(win.Height),
 					Cols: uint16(win.Width),
 				})
+				rec.Resize(win.Width, win.Height)
+				entry.SetPtySize(win.Width, win.Height)
 			}
 		}()
 		
 		// Copy data between SSH session and PTY
 		go func() {
-			io.Copy(ptmx, sess)
+			io.Copy(ptmx, io.TeeReader(sess, rec.Input()))
 		}()
-		io.Copy(sess, ptmx)
+		io.Copy(io.MultiWriter(ptyOutput(sess), rec), ptmx)
 		
-		cmd.Wait()
+		if err := proc.wait(sess); err != nil {
+			s.log.WithError(err).WithField("user", acct.Username).Debug("Shell exited with error")
+		}
 	} else {
 		// No PTY, use pipes
-		cmd.Stdin = sess
-		cmd.Stdout = sess
-		cmd.Stderr = sess.Stderr()
-		
-		if err := cmd.Run(); err != nil {
+		err := s.runPiped(sess, cmd)
+		if _, exited := err.(*exec.ExitError); err != nil && !exited {
 			s.log.WithError(err).Error("Shell execution failed")
-			sess.Exit(1)
-			return
 		}
 	}
 }
 
-// handleCommand handles command execution
-func (s *Server) handleCommand(sess ssh.Session, cmd []string) {
-	// Execute the command
-	command := exec.Command(cmd[0], cmd[1:]...)
-	command.Stdin = sess
-	command.Stdout = sess
-	command.Stderr = sess.Stderr()
-	
-	// Set working directory to user's home directory
-	homeDir := os.Getenv("HOME")
-	if homeDir == "" {
-		var err error
-		homeDir, err = os.UserHomeDir()
-		if err != nil {
-			s.log.WithError(err).Warn("Failed to get user home directory for command execution")
-		}
+// sessionEnv returns the login environment, the client's variables allowed by
+// AcceptEnv, and any environment= options of the session's key
+func (s *Server) sessionEnv(sess ssh.Session, acct *loginAccount) []string {
+	env := loginEnv(acct, sess)
+	env = append(env, s.acceptedEnv(sess)...)
+	if key := sessionKey(sess.Context()); key != nil {
+		env = append(env, key.Environment...)
+	}
+	return env
+}
+
+// ptyCallback refuses PTY allocation for keys carrying no-pty
+func (s *Server) ptyCallback(ctx ssh.Context, pty ssh.Pty) bool {
+	if key := sessionKey(ctx); key != nil && key.NoPTY {
+		s.log.WithField("user", ctx.User()).Info("PTY request denied by no-pty key option")
+		return false
 	}
-	
-	if homeDir != "" {
-		command.Dir = homeDir
-		s.log.WithFields(logrus.Fields{
-			"home_dir": homeDir,
-			"command":  cmd,
-		}).Info("Setting command working directory to home")
+	return true
+}
+
+// serverConfig builds the SSH configuration of a connection. The password and
+// public key callbacks are set here instead of through gliderlabs' handlers so
+// that they can return a partial success and ask for a TOTP code.
+func (s *Server) serverConfig(ctx ssh.Context) *gossh.ServerConfig {
+	return &gossh.ServerConfig{
+		// Each callback returns its own permissions, which carry the options
+		// of the key it accepted to the session (see sessionKey)
+		PasswordCallback: func(conn gossh.ConnMetadata, password []byte) (*gossh.Permissions, error) {
+			applyConnMetadata(ctx, conn)
+			if s.refusesRoot(ctx) || !s.passwordHandler(ctx, string(password)) {
+				return nil, fmt.Errorf("permission denied")
+			}
+			return s.secondFactor(ctx, &gossh.Permissions{})
+		},
+		PublicKeyCallback: func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			applyConnMetadata(ctx, conn)
+			if s.refusesRoot(ctx) {
+				return nil, fmt.Errorf("permission denied")
+			}
+			entry := s.publicKeyHandler(ctx, key)
+			if entry == nil {
+				return nil, fmt.Errorf("permission denied")
+			}
+			return s.secondFactor(ctx, entry.permissions())
+		},
+		// Failure counters are only cleared once the client is fully
+		// authenticated, not when a first factor passes or a key is queried
+		AuthLogCallback: func(conn gossh.ConnMetadata, method string, err error) {
+			if err == nil {
+				s.guard.Success(s.clientIP(conn.RemoteAddr()), conn.User())
+			}
+		},
 	}
-	
-	if err := command.Run(); err != nil {
-		s.log.WithError(err).WithField("command", cmd).Error("Command execution failed")
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			sess.Exit(exitErr.ExitCode())
-		} else {
-			sess.Exit(1)
-		}
+}
+
+// applyConnMetadata stores the connection metadata on the context, as
+// gliderlabs does before calling its own authentication handlers
+func applyConnMetadata(ctx ssh.Context, conn gossh.ConnMetadata) {
+	if ctx.Value(ssh.ContextKeySessionID) != nil {
 		return
 	}
-	
-	sess.Exit(0)
+	ctx.SetValue(ssh.ContextKeySessionID, hex.EncodeToString(conn.SessionID()))
+	ctx.SetValue(ssh.ContextKeyClientVersion, string(conn.ClientVersion()))
+	ctx.SetValue(ssh.ContextKeyServerVersion, string(conn.ServerVersion()))
+	ctx.SetValue(ssh.ContextKeyUser, conn.User())
+	ctx.SetValue(ssh.ContextKeyLocalAddr, conn.LocalAddr())
+	ctx.SetValue(ssh.ContextKeyRemoteAddr, conn.RemoteAddr())
 }
 
-// publicKeyHandler handles public key authentication
-func (s *Server) publicKeyHandler(ctx ssh.Context, key ssh.PublicKey) bool {
+// publicKeyHandler handles public key authentication. It returns the accepted
+// key's entry, whose options apply to the connection, or nil.
+func (s *Server) publicKeyHandler(ctx ssh.Context, key ssh.PublicKey) *authorizedKey {
+	if s.isBanned(ctx) {
+		return nil
+	}
+	
+	// Offering an unknown key is not counted as a failure: it cannot guess a
+	// credential, and agents routinely offer several keys before the right one
+	
+	// Certificates are checked against the trusted CAs instead of authorized_keys
+	if cert, ok := key.(*gossh.Certificate); ok {
+		return s.certificateHandler(ctx, cert)
+	}
+	
 	// Check if the public key is authorized
 	keyStr := string(gossh.MarshalAuthorizedKey(key))
 	
-	for _, authorizedKey := range s.authorizedKeys {
-		if ssh.KeysEqual(key, authorizedKey) {
+	if authorizedKey := s.authorizedKeys.lookup(key); authorizedKey != nil {
+		if authorizedKey.expired(time.Now()) {
 			s.log.WithFields(logrus.Fields{
 				"user":        ctx.User(),
 				"fingerprint": gossh.FingerprintSHA256(key),
-			}).Info("Public key authentication successful")
-			return true
+				"expired_at":  authorizedKey.ExpiresAt,
+			}).Warn("Public key authentication failed: key expired")
+			return nil
+		}
+		
+		if !authorizedKey.allowsUser(ctx.User()) {
+			s.log.WithFields(logrus.Fields{
+				"user":        ctx.User(),
+				"fingerprint": gossh.FingerprintSHA256(key),
+			}).Warn("Public key authentication failed: key not authorized for this user")
+			return nil
 		}
+		
+		if !authorizedKey.allowsAddress(ctx.RemoteAddr()) {
+			s.log.WithFields(logrus.Fields{
+				"user":        ctx.User(),
+				"fingerprint": gossh.FingerprintSHA256(key),
+				"remote_addr": ctx.RemoteAddr().String(),
+			}).Warn("Public key authentication failed: source address not permitted by from= option")
+			return nil
+		}
+		
+		s.log.WithFields(logrus.Fields{
+			"user":        ctx.User(),
+			"fingerprint": gossh.FingerprintSHA256(key),
+		}).Info("Public key authentication successful")
+		return authorizedKey
 	}
 	
 	s.log.WithFields(logrus.Fields{
@@ -354,150 +615,205 @@ func (s *Server) publicKeyHandler(ctx ssh.Context, key ssh.PublicKey) bool {
 		"key":         keyStr[:min(len(keyStr), 50)] + "...",
 	}).Warn("Public key authentication failed: key not authorized")
 	
-	return false
+	return nil
+}
+
+// certificateHandler handles authentication with an OpenSSH user certificate.
+// It returns an entry holding the certificate's options, or nil.
+func (s *Server) certificateHandler(ctx ssh.Context, cert *gossh.Certificate) *authorizedKey {
+	fields := logrus.Fields{
+		"user":        ctx.User(),
+		"key_id":      cert.KeyId,
+		"serial":      cert.Serial,
+		"fingerprint": gossh.FingerprintSHA256(cert.Key),
+	}
+	
+	entry, err := s.checkUserCert(ctx.User(), cert)
+	if err != nil {
+		s.log.WithError(err).WithFields(fields).Warn("Certificate authentication failed")
+		return nil
+	}
+	
+	if !entry.allowsAddress(ctx.RemoteAddr()) {
+		s.log.WithFields(fields).WithField("remote_addr", ctx.RemoteAddr().String()).Warn("Certificate authentication failed: source address not permitted")
+		return nil
+	}
+	
+	s.log.WithFields(fields).Info("Certificate authentication successful")
+	return entry
 }
 
 // passwordHandler handles password authentication
 // Uses user accounts from configuration file
 func (s *Server) passwordHandler(ctx ssh.Context, password string) bool {
 	username := ctx.User()
+	ip := s.clientIP(ctx.RemoteAddr())
 	
-	// Check if user exists in configuration
-	if validPassword, exists := s.config.Users[username]; exists {
-		if password == validPassword {
-			s.log.WithFields(logrus.Fields{
-				"user": username,
-			}).Info("Password authentication successful")
-			return true
-		}
+	if s.isBanned(ctx) {
+		return false
+	}
+	
+	// Paired devices log in through the WebSocket proxy with a ticket
+	if s.ticketHandler(ctx, password) {
+		return true
+	}
+	
+	// Unknown users are checked against a dummy hash so they take as long to reject
+	stored, exists := s.config.Users[username]
+	if !exists {
+		stored = dummyPasswordHash
+	}
+	
+	ok, err := verifyPassword(stored, password)
+	if err != nil {
+		s.log.WithError(err).WithField("user", username).Error("Failed to verify password hash")
+	}
+	
+	if ok && exists {
+		s.log.WithFields(logrus.Fields{
+			"user": username,
+		}).Info("Password authentication successful")
+		return true
 	}
 	
 	s.log.WithFields(logrus.Fields{
 		"user": username,
 	}).Warn("Password authentication failed: invalid credentials")
+	
+	// Slow down repeated guesses; the delay grows with each failure
+	if delay := s.guard.Failure(ip, username, "ssh"); delay > 0 {
+		time.Sleep(delay)
+	}
 	return false
 }
 
-// isAllowedIP checks if an IP address is in the allowed networks
-func (s *Server) isAllowedIP(ipStr string) bool {
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
+// ticketHandler accepts a paired device's ticket as the password of the user
+// it is paired to. Tickets are only accepted from loopback, where the
+// WebSocket proxy connects from after checking the device.
+func (s *Server) ticketHandler(ctx ssh.Context, password string) bool {
+	ip := net.ParseIP(remoteIP(ctx.RemoteAddr()))
+	if s.tickets == nil || ip == nil || !ip.IsLoopback() {
 		return false
 	}
 	
-	for _, cidr := range s.config.AllowedNetworks {
-		_, network, err := net.ParseCIDR(cidr)
-		if err != nil {
-			s.log.WithError(err).WithField("cidr", cidr).Warn("Invalid CIDR in allowed networks")
-			continue
-		}
-		
-		if network.Contains(ip) {
-			return true
-		}
+	grant, err := s.tickets.Verify(password)
+	if err != nil || grant.User != ctx.User() {
+		return false
 	}
 	
-	return false
+	s.log.WithFields(logrus.Fields{
+		"user":   grant.User,
+		"device": grant.DeviceID,
+	}).Info("Ticket authentication successful")
+	return true
 }
 
-// loadOrGenerateHostKey loads the host key or generates a new one
-func (s *Server) loadOrGenerateHostKey() (gossh.Signer, error) {
-	// Try to load existing key
-	if _, err := os.Stat(s.config.HostKeyPath); err == nil {
-		keyData, err := os.ReadFile(s.config.HostKeyPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read host key: %w", err)
-		}
-		
-		signer, err := gossh.ParsePrivateKey(keyData)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse host key: %w", err)
-		}
-		
-		s.log.WithField("path", s.config.HostKeyPath).Info("Loaded existing host key")
-		return signer, nil
+// refusesRoot reports (and logs) whether the login is for a root account
+// while PermitRootLogin is off
+func (s *Server) refusesRoot(ctx ssh.Context) bool {
+	if s.config.PermitRootLogin {
+		return false
 	}
-	
-	// Generate new key
-	s.log.WithField("path", s.config.HostKeyPath).Info("Generating new host key")
-	
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate RSA key: %w", err)
+	acct, err := lookupAccount(ctx.User())
+	if err != nil || !acct.isSuperuser() {
+		return false
 	}
-	
-	// Save private key
-	privateKeyPEM := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	s.log.WithFields(logrus.Fields{
+		"user":      ctx.User(),
+		"remote_ip": remoteIP(ctx.RemoteAddr()),
+	}).Warn("Authentication refused: root login is not permitted")
+	return true
+}
+
+// isBanned reports (and logs) whether the connection's source IP or user is banned
+func (s *Server) isBanned(ctx ssh.Context) bool {
+	ip := s.clientIP(ctx.RemoteAddr())
+	if err := s.guard.Check(ip, ctx.User()); err != nil {
+		s.log.WithFields(logrus.Fields{
+			"user":      ctx.User(),
+			"remote_ip": ip,
+		}).Warn("Authentication refused: login source is banned")
+		return true
 	}
-	
-	keyFile, err := os.OpenFile(s.config.HostKeyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create host key file: %w", err)
+	return false
+}
+
+// connCallback runs right after TCP accept, before the SSH handshake. Connections
+// from outside the allowed networks or from banned sources are dropped here, so
+// they can neither try credentials nor open any channel or global request.
+func (s *Server) connCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	ip := remoteIP(conn.RemoteAddr())
+	if !s.isAllowedIP(ip) {
+		s.log.WithField("remote_ip", ip).Warn("Connection attempt from unauthorized network")
+		return nil
 	}
-	defer keyFile.Close()
 	
-	if err := pem.Encode(keyFile, privateKeyPEM); err != nil {
-		return nil, fmt.Errorf("failed to write host key: %w", err)
+	if err := s.guard.Check(ip, ""); err != nil {
+		s.log.WithField("remote_ip", ip).Debug("Dropping connection from banned source")
+		return nil
 	}
 	
-	// Convert to SSH signer
-	signer, err := gossh.NewSignerFromKey(privateKey)
+	// Detect clients that vanish without closing the connection
+	if s.config.KeepAliveInterval > 0 {
+		go s.keepAlive(ctx, conn)
+	}
+	return conn
+}
+
+// remoteIP returns the host part of a remote address
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
 	if err != nil {
-		return nil, fmt.Errorf("failed to create signer: %w", err)
+		return addr.String()
 	}
-	
-	s.log.Info("Generated and saved new host key")
-	return signer, nil
+	return host
 }
 
-// loadAuthorizedKeys loads authorized public keys from file
-func (s *Server) loadAuthorizedKeys() error {
-	if s.config.AuthorizedKeysPath == "" {
-		return fmt.Errorf("authorized keys path not configured")
+// clientIP returns the address failures and bans are counted against: the
+// remote IP, or for the WebSocket proxy's loopback connections the real
+// client it is logging in for
+func (s *Server) clientIP(addr net.Addr) string {
+	ip := remoteIP(addr)
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.IsLoopback() {
+		if client := s.sessions.ProxyClient(addr.String()); client != "" {
+			return client
+		}
 	}
-	
-	data, err := os.ReadFile(s.config.AuthorizedKeysPath)
-	if err != nil {
-		return fmt.Errorf("failed to read authorized keys: %w", err)
+	return ip
+}
+
+// isAllowedIP checks if an IP address is in the allowed networks
+func (s *Server) isAllowedIP(ipStr string) bool {
+	ip := parseRemoteIP(ipStr)
+	if ip == nil {
+		return false
 	}
 	
-	// Parse authorized keys
-	for len(data) > 0 {
-		pubKey, _, _, rest, err := gossh.ParseAuthorizedKey(data)
-		if err != nil {
-			s.log.WithError(err).Warn("Failed to parse authorized key, skipping")
-			break
+	for _, network := range s.allowedNets {
+		if network.Contains(ip) {
+			return true
 		}
-		
-		keyStr := string(gossh.MarshalAuthorizedKey(pubKey))
-		s.authorizedKeys[keyStr] = pubKey
-		
-		data = rest
 	}
 	
-	s.log.WithField("count", len(s.authorizedKeys)).Info("Loaded authorized keys")
-	return nil
+	return false
 }
 
-// AddAuthorizedKey adds a public key to the authorized keys
-func (s *Server) AddAuthorizedKey(key gossh.PublicKey) {
-	keyStr := string(gossh.MarshalAuthorizedKey(key))
-	s.authorizedKeys[keyStr] = key
+// AddAuthorizedKey adds a public key that may log in as the given users.
+// Keys added this way are dropped when the authorized_keys file is reloaded.
+func (s *Server) AddAuthorizedKey(key gossh.PublicKey, users ...string) {
+	s.authorizedKeys.add(&authorizedKey{Key: key, Principals: users})
 	s.log.WithField("fingerprint", gossh.FingerprintSHA256(key)).Info("Added authorized key")
 }
 
 // RemoveAuthorizedKey removes a public key from the authorized keys
 func (s *Server) RemoveAuthorizedKey(key gossh.PublicKey) {
-	keyStr := string(gossh.MarshalAuthorizedKey(key))
-	delete(s.authorizedKeys, keyStr)
+	s.authorizedKeys.remove(key)
 	s.log.WithField("fingerprint", gossh.FingerprintSHA256(key)).Info("Removed authorized key")
 }
 
 // GetAuthorizedKeyCount returns the number of authorized keys
 func (s *Server) GetAuthorizedKeyCount() int {
-	return len(s.authorizedKeys)
+	return s.authorizedKeys.count()
 }
 
 func min(a, b int) int {
@@ -0,0 +1,79 @@
+package ssh
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shadow-shuttle/shadowd/lockout"
+	"github.com/shadow-shuttle/shadowd/sessions"
+	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// TestProxiedFailuresCountAgainstClient checks, through the loopback listener
+// the WebSocket proxy connects to, that failed logins announced as proxied
+// ban the real client while loopback itself stays usable
+func TestProxiedFailuresCountAgainstClient(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	guard, err := lockout.NewGuard(lockout.Config{
+		MaxFailures: 2,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    time.Millisecond,
+	}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := sessions.NewRegistry(log)
+
+	_, addr := startServerWith(t, Config{
+		Users: map[string]string{"alice": "secret", "bob": "secret", "carol": "secret"},
+	}, Services{Guard: guard, Sessions: registry})
+
+	// login connects as the proxy would for client, or directly if it is ""
+	login := func(user, password, client string) error {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client != "" {
+			release := registry.ExpectProxy(conn.LocalAddr().String(), client)
+			defer release()
+		}
+		c, chans, reqs, err := gossh.NewClientConn(conn, addr, &gossh.ClientConfig{
+			User:            user,
+			Auth:            []gossh.AuthMethod{gossh.Password(password)},
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		gossh.NewClient(c, chans, reqs).Close()
+		return nil
+	}
+
+	// Two users, so only the client's address reaches the limit
+	for _, user := range []string{"alice", "bob"} {
+		if err := login(user, "wrong", "203.0.113.9"); err == nil {
+			t.Fatalf("wrong password for %s accepted", user)
+		}
+	}
+
+	bans := guard.Bans()
+	if len(bans) != 1 || bans[0].Key != "ip:203.0.113.9" {
+		t.Fatalf("bans = %+v, want only ip:203.0.113.9", bans)
+	}
+
+	if err := login("carol", "secret", "203.0.113.9"); err == nil {
+		t.Error("banned client logged in through the proxy")
+	}
+	if err := login("carol", "secret", "203.0.113.10"); err != nil {
+		t.Errorf("other proxied client refused: %v", err)
+	}
+	if err := login("carol", "secret", ""); err != nil {
+		t.Errorf("direct loopback login refused: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/shadow-shuttle/shadowd/limits"
+	"github.com/shadow-shuttle/shadowd/sessions"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// trackedSession counts the session's input and output as activity for the
+// idle timeout and as traffic in the session registry
+type trackedSession struct {
+	ssh.Session
+	lease   *limits.Session
+	entry   *sessions.Session // registry entry, owned by the WebSocket proxy for its sessions
+	counted *sessions.Session // entry whose traffic this session counts, nil when proxied
+
+	ended   chan struct{} // closed when a limit or an administrator ends the session
+	endOnce sync.Once
+}
+
+func (t *trackedSession) Read(p []byte) (int, error) {
+	n, err := t.Session.Read(p)
+	if n > 0 {
+		t.lease.Touch()
+		t.counted.CountIn(n)
+	}
+	return n, err
+}
+
+func (t *trackedSession) Write(p []byte) (int, error) {
+	n, err := t.Session.Write(p)
+	t.wrote(n)
+	return n, err
+}
+
+func (t *trackedSession) Stderr() io.ReadWriter {
+	return &countingWriter{ReadWriter: t.Session.Stderr(), sess: t}
+}
+
+// wrote counts n bytes of output
+func (t *trackedSession) wrote(n int) {
+	if n > 0 {
+		t.lease.Touch()
+		t.counted.CountOut(n)
+	}
+}
+
+// notify shows a message to the client on stderr
+func (t *trackedSession) notify(message string) {
+	io.WriteString(t.Session.Stderr(), "\r\n*** "+message+" ***\r\n")
+}
+
+// end tells the client why it is disconnected and closes the session
+func (t *trackedSession) end(reason string) {
+	t.endOnce.Do(func() {
+		t.notify("Disconnected: " + reason)
+		close(t.ended)
+		t.Session.Close()
+	})
+}
+
+// countingWriter counts writes that bypass the session's Write, such as stderr
+type countingWriter struct {
+	io.ReadWriter
+	sess *trackedSession
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.sess.wrote(n)
+	return n, err
+}
+
+// withTracking registers a session handler's sessions in the session registry
+// and applies the per-user and per-IP session limits and the idle and lifetime
+// timeouts. The client is warned on stderr before it is disconnected.
+func (s *Server) withTracking(next ssh.Handler) ssh.Handler {
+	return func(sess ssh.Session) {
+		tracked := &trackedSession{Session: sess, ended: make(chan struct{})}
+
+		// The WebSocket proxy registers and limits its sessions itself, with
+		// the real client address; only what the SSH server knows is added
+		if proxied := s.sessions.Proxied(sess.RemoteAddr().String()); proxied != nil {
+			tracked.entry = proxied
+			setKeyFingerprint(tracked)
+			next(tracked)
+			return
+		}
+
+		// Every other session counts against the limits, including local
+		// clients on loopback
+		ip := remoteIP(sess.RemoteAddr())
+		lease, err := s.limiter.Acquire(sess.User(), ip)
+		if err != nil {
+			io.WriteString(sess.Stderr(), fmt.Sprintf("Session refused: %v\r\n", err))
+			sess.Exit(1)
+			return
+		}
+		defer lease.Release()
+		tracked.lease = lease
+
+		entry := s.sessions.Register(sess.User(), ip, sessions.TransportSSH, sessions.Controls{
+			Notify:    tracked.notify,
+			Terminate: tracked.end,
+		})
+		defer entry.Close()
+		tracked.entry, tracked.counted = entry, entry
+		setKeyFingerprint(tracked)
+
+		tracked.lease.Enforce(tracked.notify, tracked.end)
+		next(tracked)
+	}
+}
+
+// setKeyFingerprint records the fingerprint of the session's login key, if any
+func setKeyFingerprint(t *trackedSession) {
+	if key := sessionKey(t.Context()); key != nil {
+		t.entry.SetKeyFingerprint(gossh.FingerprintSHA256(key.Key))
+	}
+}
+
+// sessionEntry returns the registry entry of a session, or nil
+func sessionEntry(sess ssh.Session) *sessions.Session {
+	if tracked, ok := sess.(*trackedSession); ok {
+		return tracked.entry
+	}
+	return nil
+}
+
+// sessionDone returns a channel that is closed when the client's connection
+// closes or a session limit or an administrator ends the session
+func sessionDone(sess ssh.Session) <-chan struct{} {
+	tracked, ok := sess.(*trackedSession)
+	if !ok {
+		return sess.Context().Done()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-sess.Context().Done():
+		case <-tracked.ended:
+		}
+		close(done)
+	}()
+	return done
+}
@@ -0,0 +1,90 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shadow-shuttle/shadowd/limits"
+	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// TestSessionLimits checks that sessions of local clients on loopback, which
+// are all native SSH has behind the WebSocket proxy, are counted against the
+// limits and ended by the idle timeout
+func TestSessionLimits(t *testing.T) {
+	username := currentLoginUser(t)
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	limiter := limits.NewLimiter(limits.Config{
+		IdleTimeout: 2 * time.Second,
+		Warning:     time.Second,
+		MaxPerUser:  1,
+	}, log)
+
+	_, addr := startServerWith(t, Config{
+		Users: map[string]string{username: testPassword},
+	}, Services{Limiter: limiter})
+
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            username,
+		Auth:            []gossh.AuthMethod{gossh.Password(testPassword)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("ssh dial: %v", err)
+	}
+	defer client.Close()
+
+	idle, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	var idleStderr bytes.Buffer
+	idle.Stderr = &idleStderr
+	start := time.Now()
+	if err := idle.Start("sleep 10"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The idle session holds the user's only slot
+	second, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	var stderr bytes.Buffer
+	second.Stderr = &stderr
+	err = second.Run("true")
+	var exitErr *gossh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Errorf("session over the limit: err = %v, want exit status 1", err)
+	}
+	if !strings.Contains(stderr.String(), "Session refused") {
+		t.Errorf("stderr = %q, want the refusal", stderr.String())
+	}
+
+	idle.Wait()
+	if elapsed := time.Since(start); elapsed > 8*time.Second {
+		t.Errorf("idle session ended after %s, want the idle timeout", elapsed)
+	}
+	if !strings.Contains(idleStderr.String(), "Disconnected: idle timeout") {
+		t.Errorf("stderr = %q, want the idle disconnect", idleStderr.String())
+	}
+
+	// Its slot is free again
+	third, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if err := third.Run("true"); err != nil {
+		t.Errorf("session after the idle one ended: %v", err)
+	}
+}
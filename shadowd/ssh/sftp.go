@@ -0,0 +1,331 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+// sftpRootDefault is the SFTPRoots entry applied to users without their own entry
+const sftpRootDefault = "*"
+
+// maxSymlinkDepth bounds symlink resolution inside an SFTP root, like the kernel's ELOOP limit
+const maxSymlinkDepth = 40
+
+// sftpHandler serves the "sftp" subsystem with the permissions of the session's OS account
+func (s *Server) sftpHandler(sess ssh.Session) {
+	acct, err := lookupAccount(sess.User())
+	if err != nil {
+		s.log.WithError(err).WithField("user", sess.User()).Warn("Failed to resolve login account")
+		sess.Exit(1)
+		return
+	}
+
+	// A forced command replaces the subsystem, as in sshd
+	if key := sessionKey(sess.Context()); key != nil && key.Command != "" {
+		s.log.WithFields(logrus.Fields{
+			"user":           sess.User(),
+			"forced_command": key.Command,
+		}).Info("Running forced command instead of SFTP subsystem")
+		s.handleShell(sess, acct, key.Command, false, nil)
+		return
+	}
+
+	root := s.sftpRoot(acct)
+	s.log.WithFields(logrus.Fields{
+		"user":      acct.Username,
+		"uid":       acct.UID,
+		"root":      root,
+		"remote_ip": remoteIP(sess.RemoteAddr()),
+	}).Info("SFTP session started")
+
+	if acct.isDaemonUser() {
+		err = serveSFTP(sess, root, acct.HomeDir)
+	} else {
+		err = s.spawnSFTPServer(sess, acct, root)
+	}
+	if err != nil {
+		s.log.WithError(err).WithField("user", acct.Username).Error("SFTP session failed")
+		sess.Exit(1)
+		return
+	}
+
+	s.log.WithField("user", acct.Username).Info("SFTP session ended")
+}
+
+// sftpRoot returns the directory the account is confined to, or "" for no confinement.
+// "%h" expands to the home directory and "%u" to the username, as in sshd's ChrootDirectory.
+func (s *Server) sftpRoot(acct *loginAccount) string {
+	root, ok := s.config.SFTPRoots[acct.Username]
+	if !ok {
+		root = s.config.SFTPRoots[sftpRootDefault]
+	}
+	if root == "" || root == "none" {
+		return ""
+	}
+	return strings.NewReplacer("%h", acct.HomeDir, "%u", acct.Username, "%%", "%").Replace(root)
+}
+
+// spawnSFTPServer runs the SFTP server in a child process (shadowd sftp-server)
+// switched to the account, so the kernel enforces the account's file permissions
+func (s *Server) spawnSFTPServer(sess ssh.Session, acct *loginAccount, root string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate shadowd executable: %w", err)
+	}
+
+	cmd := exec.Command(exe, "sftp-server", "-root", root, "-home", acct.HomeDir)
+	cmd.Dir = acct.HomeDir
+	cmd.Env = loginEnv(acct, sess)
+	cmd.Stdin = sess
+	cmd.Stdout = sess
+	cmd.Stderr = sess.Stderr()
+
+	if err := acct.applyCredentials(cmd); err != nil {
+		return err
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("sftp-server exited: %w", err)
+	}
+	return nil
+}
+
+// stdioConn joins stdin and stdout into one stream
+type stdioConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// RunSFTPServer serves SFTP over stdin/stdout. It is the body of the hidden
+// "shadowd sftp-server" command, which the SSH server starts as the logged-in account.
+// A non-empty root confines the session to that directory.
+func RunSFTPServer(root, home string) error {
+	return serveSFTP(stdioConn{Reader: os.Stdin, WriteCloser: os.Stdout}, root, home)
+}
+
+// serveSFTP serves one SFTP session on rwc with the current process's permissions.
+// Without a root the whole filesystem is visible and relative paths start in home;
+// with a root, paths are resolved inside it and symlinks may not lead out of it.
+func serveSFTP(rwc io.ReadWriteCloser, root, home string) error {
+	if root == "" {
+		server, err := sftp.NewServer(rwc, sftp.WithServerWorkingDirectory(home))
+		if err != nil {
+			return fmt.Errorf("failed to create SFTP server: %w", err)
+		}
+		defer server.Close()
+		return server.Serve()
+	}
+
+	jail, err := newSFTPJail(root, home)
+	if err != nil {
+		return err
+	}
+
+	server := sftp.NewRequestServer(rwc, sftp.Handlers{
+		FileGet:  jail,
+		FilePut:  jail,
+		FileCmd:  jail,
+		FileList: jail,
+	}, sftp.WithStartDirectory(jail.start))
+	defer server.Close()
+
+	if err := server.Serve(); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// sftpJail implements the pkg/sftp request handlers on a directory tree.
+// Clients see the root as "/". The file operations below the handlers are
+// platform-specific.
+type sftpJail struct {
+	// root is the absolute, symlink-free path of the root directory
+	root string
+
+	// start is the virtual directory relative paths are resolved against
+	start string
+}
+
+// newSFTPJail creates handlers confined to root; home becomes the start
+// directory when it lies inside the root
+func newSFTPJail(root, home string) (*sftpJail, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SFTP root %q: %w", root, err)
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SFTP root %q: %w", root, err)
+	}
+	if info, err := os.Stat(resolved); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("SFTP root %q is not a directory", root)
+	}
+
+	j := &sftpJail{root: resolved, start: "/"}
+	if home != "" {
+		if realHome, err := filepath.EvalSymlinks(home); err == nil {
+			if rel, ok := j.relative(realHome); ok {
+				j.start = rel
+			}
+		}
+	}
+	return j, nil
+}
+
+// relative returns the virtual path of a real path, and whether it lies inside the root
+func (j *sftpJail) relative(real string) (string, bool) {
+	rel, err := filepath.Rel(j.root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return path.Join("/", filepath.ToSlash(rel)), true
+}
+
+// Fileread opens a file for reading
+func (j *sftpJail) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return j.open(r.Filepath, os.O_RDONLY, 0)
+}
+
+// Filewrite opens a file for writing
+func (j *sftpJail) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return j.openFile(r)
+}
+
+// OpenFile opens a file for reading and writing on the same handle
+func (j *sftpJail) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return j.openFile(r)
+}
+
+// openFile opens a file with the request's open flags
+func (j *sftpJail) openFile(r *sftp.Request) (*os.File, error) {
+	pflags := r.Pflags()
+	flags := os.O_RDONLY
+	switch {
+	case pflags.Read && pflags.Write:
+		flags = os.O_RDWR
+	case pflags.Write:
+		flags = os.O_WRONLY
+	}
+	// Append is not mapped to O_APPEND: the client writes at explicit offsets
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+
+	return j.open(r.Filepath, flags, 0666)
+}
+
+// Filecmd handles Setstat, Rename, PosixRename, Rmdir, Remove, Mkdir, Link and Symlink
+func (j *sftpJail) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return j.setstat(r.Filepath, r.AttrFlags(), r.Attributes())
+
+	case "Rename", "PosixRename":
+		// SFTPv3 rename must not replace an existing file; posix-rename@openssh.com may
+		return j.rename(r.Filepath, r.Target, r.Method == "PosixRename")
+
+	case "Rmdir", "Remove":
+		return j.remove(r.Filepath, r.Method == "Rmdir")
+
+	case "Mkdir":
+		return j.mkdir(r.Filepath)
+
+	case "Link":
+		return j.link(r.Filepath, r.Target)
+
+	case "Symlink":
+		// r.Filepath is the link target and r.Target the new link
+		target := r.Filepath
+		if path.IsAbs(target) {
+			// Absolute targets are virtual paths, so store them relative to the real root
+			target = filepath.Join(j.root, filepath.FromSlash(path.Clean(target)))
+		} else {
+			target = filepath.FromSlash(target)
+		}
+		return j.symlink(target, r.Target)
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// Filelist handles List and Stat
+func (j *sftpJail) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		infos, err := j.readDir(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(infos), nil
+
+	case "Stat":
+		info, err := j.stat(r.Filepath, true)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Lstat stats a path without following a final symlink
+func (j *sftpJail) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	info, err := j.stat(r.Filepath, false)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{info}, nil
+}
+
+// Readlink returns a symlink's target, with targets inside the root shown as virtual paths
+func (j *sftpJail) Readlink(p string) (string, error) {
+	target, err := j.readlink(p)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(target) {
+		if rel, ok := j.relative(target); ok {
+			return rel, nil
+		}
+	}
+	return filepath.ToSlash(target), nil
+}
+
+// RealPath canonicalizes a path against the start directory; symlinks are not resolved
+func (j *sftpJail) RealPath(p string) (string, error) {
+	if path.IsAbs(p) {
+		return path.Clean(p), nil
+	}
+	return path.Join(j.start, p), nil
+}
+
+// listerAt serves a fixed slice of file infos
+type listerAt []os.FileInfo
+
+// ListAt copies entries starting at offset into ls
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,399 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const testPassword = "sftp-test-password"
+
+// startTestServer starts a server on an ephemeral loopback port that accepts
+// the current user with testPassword, and returns its address
+func startTestServer(t *testing.T, sftpRoots map[string]string) (string, string) {
+	t.Helper()
+
+	username := currentLoginUser(t)
+	_, addr := startServer(t, Config{
+		Users:     map[string]string{username: testPassword},
+		SFTPRoots: sftpRoots,
+	})
+	return addr, username
+}
+
+// currentLoginUser returns the name of the current user, skipping the test if
+// it is not a login account sessions can run as
+func currentLoginUser(t *testing.T) string {
+	t.Helper()
+
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("cannot determine current user: %v", err)
+	}
+	if _, err := lookupAccount(u.Username); err != nil {
+		t.Skipf("current user is not a login account: %v", err)
+	}
+	return u.Username
+}
+
+// startServer starts a server with cfg on an ephemeral loopback port, only
+// allowing loopback clients, and returns it and its address
+func startServer(t *testing.T, cfg Config) (*Server, string) {
+	t.Helper()
+	return startServerWith(t, cfg, Services{})
+}
+
+// startServerWith is startServer with the given services
+func startServerWith(t *testing.T, cfg Config, services Services) (*Server, string) {
+	t.Helper()
+
+	// Reserve a free port; NewServer needs a fixed one
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve port: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+
+	cfg.MeshIP = "127.0.0.1"
+	cfg.Port = port
+	cfg.HostKeyPath = filepath.Join(t.TempDir(), "host_key")
+	cfg.PermitRootLogin = true // the tests log in as the current user, which may be root
+	if cfg.AllowedNetworks == nil {
+		cfg.AllowedNetworks = []string{"127.0.0.1/32"}
+	}
+	server, err := NewServer(cfg, services, log)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return server, addr
+}
+
+// dialSFTP opens an SFTP session to addr as username
+func dialSFTP(t *testing.T, addr, username string) *sftp.Client {
+	t.Helper()
+
+	conn, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            username,
+		Auth:            []gossh.AuthMethod{gossh.Password(testPassword)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("ssh dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("sftp client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func writeRemote(t *testing.T, client *sftp.Client, path string, data []byte) {
+	t.Helper()
+	f, err := client.Create(path)
+	if err != nil {
+		t.Fatalf("create %s: %v", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close %s: %v", path, err)
+	}
+}
+
+func readRemote(t *testing.T, client *sftp.Client, path string) []byte {
+	t.Helper()
+	f, err := client.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return data
+}
+
+func TestSFTPWithoutRoot(t *testing.T) {
+	addr, username := startTestServer(t, nil)
+	client := dialSFTP(t, addr, username)
+
+	acct, err := lookupAccount(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := client.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	if wd != filepath.ToSlash(acct.HomeDir) {
+		t.Errorf("working directory = %q, want home %q", wd, acct.HomeDir)
+	}
+
+	dir := t.TempDir()
+	remote := filepath.ToSlash(filepath.Join(dir, "upload.txt"))
+	want := []byte("hello over sftp\n")
+	writeRemote(t, client, remote, want)
+
+	onDisk, err := os.ReadFile(filepath.Join(dir, "upload.txt"))
+	if err != nil {
+		t.Fatalf("uploaded file missing on disk: %v", err)
+	}
+	if !bytes.Equal(onDisk, want) {
+		t.Errorf("on disk = %q, want %q", onDisk, want)
+	}
+	if got := readRemote(t, client, remote); !bytes.Equal(got, want) {
+		t.Errorf("downloaded = %q, want %q", got, want)
+	}
+}
+
+func TestSFTPRoot(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "docs", "readme.txt"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	addr, username := startTestServer(t, map[string]string{"*": root})
+	client := dialSFTP(t, addr, username)
+
+	t.Run("root is slash", func(t *testing.T) {
+		entries, err := client.ReadDir("/")
+		if err != nil {
+			t.Fatalf("readdir /: %v", err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		sort.Strings(names)
+		if len(names) != 2 || names[0] != "docs" || names[1] != "escape" {
+			t.Errorf("root listing = %v, want [docs escape]", names)
+		}
+
+		if got := readRemote(t, client, "/docs/readme.txt"); string(got) != "inside" {
+			t.Errorf("readme = %q", got)
+		}
+	})
+
+	t.Run("upload lands inside root", func(t *testing.T) {
+		writeRemote(t, client, "/docs/new.txt", []byte("data"))
+		if _, err := os.Stat(filepath.Join(root, "docs", "new.txt")); err != nil {
+			t.Errorf("uploaded file not in root: %v", err)
+		}
+		if err := client.Rename("/docs/new.txt", "/docs/renamed.txt"); err != nil {
+			t.Errorf("rename: %v", err)
+		}
+		if err := client.Remove("/docs/renamed.txt"); err != nil {
+			t.Errorf("remove: %v", err)
+		}
+	})
+
+	t.Run("dot-dot stays inside root", func(t *testing.T) {
+		rel, err := filepath.Rel(root, filepath.Join(outside, "secret.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Open(filepath.ToSlash(rel)); err == nil {
+			t.Error("opened a file outside the root through ..")
+		}
+		if _, err := client.Open("/../../../../../../" + filepath.ToSlash(filepath.Join(outside, "secret.txt"))); err == nil {
+			t.Error("opened a file outside the root through an absolute .. path")
+		}
+	})
+
+	t.Run("symlinks cannot escape", func(t *testing.T) {
+		if _, err := client.Open("/escape/secret.txt"); err == nil {
+			t.Error("read a file outside the root through a symlink")
+		}
+		if _, err := client.ReadDir("/escape"); err == nil {
+			t.Error("listed a directory outside the root through a symlink")
+		}
+		if _, err := client.Create("/escape/planted.txt"); err == nil {
+			t.Error("created a file outside the root through a symlink")
+		}
+		if _, err := os.Stat(filepath.Join(outside, "planted.txt")); err == nil {
+			t.Error("planted.txt was written outside the root")
+		}
+
+		// Lstat and removal of the link itself are fine
+		info, err := client.Lstat("/escape")
+		if err != nil {
+			t.Fatalf("lstat link: %v", err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("lstat mode = %v, want symlink", info.Mode())
+		}
+	})
+
+	t.Run("client symlinks are rooted", func(t *testing.T) {
+		if err := client.Symlink("/docs/readme.txt", "/link"); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+		if got := readRemote(t, client, "/link"); string(got) != "inside" {
+			t.Errorf("read through link = %q, want %q", got, "inside")
+		}
+		target, err := client.ReadLink("/link")
+		if err != nil {
+			t.Fatalf("readlink: %v", err)
+		}
+		if target != "/docs/readme.txt" {
+			t.Errorf("readlink = %q, want /docs/readme.txt", target)
+		}
+
+		// A dangling link pointing outside must not be usable to create files there
+		if err := os.Symlink(filepath.Join(outside, "dangling.txt"), filepath.Join(root, "dangling")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Create("/dangling"); err == nil {
+			t.Error("created a file outside the root through a dangling symlink")
+		}
+	})
+
+	t.Run("directories and attributes", func(t *testing.T) {
+		if err := client.Mkdir("/made"); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		writeRemote(t, client, "/made/file.txt", []byte("0123456789"))
+		if err := client.Truncate("/made/file.txt", 4); err != nil {
+			t.Errorf("truncate: %v", err)
+		}
+		if err := client.Chmod("/made/file.txt", 0600); err != nil {
+			t.Errorf("chmod: %v", err)
+		}
+		mtime := time.Unix(1700000000, 0)
+		if err := client.Chtimes("/made/file.txt", mtime, mtime); err != nil {
+			t.Errorf("chtimes: %v", err)
+		}
+
+		info, err := client.Stat("/made/file.txt")
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if info.Size() != 4 || info.Mode().Perm() != 0600 || !info.ModTime().Equal(mtime) {
+			t.Errorf("stat = size %d, mode %v, mtime %v", info.Size(), info.Mode(), info.ModTime())
+		}
+		if onDisk, err := os.Stat(filepath.Join(root, "made", "file.txt")); err != nil || onDisk.Size() != 4 {
+			t.Errorf("on disk: %v, %v", onDisk, err)
+		}
+
+		if err := client.RemoveDirectory("/made"); err == nil {
+			t.Error("removed a directory that is not empty")
+		}
+		if err := client.Remove("/made/file.txt"); err != nil {
+			t.Errorf("remove: %v", err)
+		}
+		if err := client.RemoveDirectory("/made"); err != nil {
+			t.Errorf("rmdir: %v", err)
+		}
+	})
+}
+
+// TestSFTPRootSymlinkSwap checks that a directory swapped for a symlink
+// leading out of the root while files are opened through it never exposes
+// the outside, whichever moment the swap happens at
+func TestSFTPRootSymlinkSwap(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "file.txt"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	jail, err := newSFTPJail(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap dir between the real directory and the symlink until told to stop
+	stop := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		held := filepath.Join(root, "held")
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			os.Rename(dir, held)
+			os.Rename(filepath.Join(root, "link"), dir)
+			os.Rename(dir, filepath.Join(root, "link"))
+			os.Rename(held, dir)
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-swapped
+	}()
+
+	for i := 0; i < 2000; i++ {
+		f, err := jail.open("/dir/file.txt", os.O_RDONLY, 0)
+		if err != nil {
+			continue
+		}
+		data, _ := io.ReadAll(f)
+		f.Close()
+		if string(data) == "outside" {
+			t.Fatal("read a file outside the root through a swapped symlink")
+		}
+	}
+}
@@ -0,0 +1,410 @@
+//go:build !windows
+// +build !windows
+
+package ssh
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/sys/unix"
+)
+
+// The jail reaches every file through a directory handle obtained by walking
+// the path from the root one component at a time. No component is ever
+// opened by a path the kernel resolves, so a client cannot swap in a symlink
+// between a check and its use: symlinks are read and resolved by the walk,
+// and must stay inside the root.
+
+// errSymlinkLoop is returned for paths with more than maxSymlinkDepth symlinks
+var errSymlinkLoop = errors.New("too many levels of symbolic links")
+
+// at returns a handle on the directory containing the virtual path p, and the
+// name of the final component in it ("." for a directory itself). With follow
+// set, a symlink in the final component is resolved too. A final component
+// that does not exist is returned as is, for the caller to create. The
+// handle must be closed with unix.Close.
+func (j *sftpJail) at(p string, follow bool) (int, string, error) {
+	fail := func(dir int, err error) (int, string, error) {
+		unix.Close(dir)
+		return -1, "", &os.PathError{Op: "open", Path: p, Err: err}
+	}
+
+	dir, err := j.openRoot()
+	if err != nil {
+		return -1, "", err
+	}
+	var done []string // components walked so far, all real directories
+	todo := splitPath(path.Clean("/" + p))
+	links := 0
+
+	for len(todo) > 0 {
+		name, rest := todo[0], todo[1:]
+		switch name {
+		case ".":
+			todo = rest
+			continue
+		case "..":
+			// Only symlink targets still contain "..", and they may not climb out
+			if len(done) == 0 {
+				return fail(dir, os.ErrPermission)
+			}
+			unix.Close(dir)
+			if dir, err = j.openRoot(); err != nil {
+				return -1, "", err
+			}
+			todo = append(append([]string(nil), done[:len(done)-1]...), rest...)
+			done = nil
+			continue
+		}
+
+		last := len(rest) == 0
+		if last && !follow {
+			return dir, name, nil
+		}
+
+		var st unix.Stat_t
+		err := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if last && errors.Is(err, unix.ENOENT) {
+			return dir, name, nil
+		}
+		if err != nil {
+			return fail(dir, err)
+		}
+
+		if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			if links++; links > maxSymlinkDepth {
+				return fail(dir, errSymlinkLoop)
+			}
+			target, err := readlinkAt(dir, name)
+			if err != nil {
+				return fail(dir, err)
+			}
+			if filepath.IsAbs(target) {
+				// Absolute targets are real paths, which must lie inside the root
+				rel, ok := j.relative(filepath.Clean(target))
+				if !ok {
+					return fail(dir, os.ErrPermission)
+				}
+				unix.Close(dir)
+				if dir, err = j.openRoot(); err != nil {
+					return -1, "", err
+				}
+				done = nil
+				target = rel
+			}
+			todo = append(splitPath(filepath.ToSlash(target)), rest...)
+			continue
+		}
+
+		if last {
+			return dir, name, nil
+		}
+		next, err := unix.Openat(dir, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fail(dir, err)
+		}
+		unix.Close(dir)
+		dir = next
+		done = append(done, name)
+		todo = rest
+	}
+	return dir, ".", nil
+}
+
+// openRoot opens the root directory
+func (j *sftpJail) openRoot() (int, error) {
+	fd, err := unix.Open(j.root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: "/", Err: err}
+	}
+	return fd, nil
+}
+
+// splitPath splits a slash-separated path into its non-empty components
+func splitPath(p string) []string {
+	return strings.FieldsFunc(p, func(r rune) bool { return r == '/' })
+}
+
+// readlinkAt returns the target of the symlink name in dir
+func readlinkAt(dir int, name string) (string, error) {
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(dir, name, buf)
+		if err != nil {
+			return "", err
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// open opens a file inside the root, following a final symlink
+func (j *sftpJail) open(p string, flags int, perm os.FileMode) (*os.File, error) {
+	dir, name, err := j.at(p, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dir)
+
+	fd, err := unix.Openat(dir, name, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return os.NewFile(uintptr(fd), p), nil
+}
+
+// stat stats a file inside the root
+func (j *sftpJail) stat(p string, follow bool) (os.FileInfo, error) {
+	dir, name, err := j.at(p, follow)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dir)
+	return statAt(dir, name, path.Base(path.Clean("/"+p)))
+}
+
+// statAt stats name in dir without following a symlink; base is the name reported
+func statAt(dir int, name, base string) (os.FileInfo, error) {
+	var st unix.Stat_t
+	if err := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: base, Err: err}
+	}
+	return &statInfo{name: base, st: st}, nil
+}
+
+// readDir lists a directory inside the root
+func (j *sftpJail) readDir(p string) ([]os.FileInfo, error) {
+	dir, name, err := j.at(p, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dir)
+
+	fd, err := unix.Openat(dir, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), p)
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, entry := range names {
+		info, err := statAt(fd, entry, entry)
+		if err != nil {
+			continue // removed while listing
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// mkdir creates a directory inside the root
+func (j *sftpJail) mkdir(p string) error {
+	dir, name, err := j.at(p, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	return pathError("mkdir", p, unix.Mkdirat(dir, name, 0755))
+}
+
+// remove removes a file, or with isDir set an empty directory, inside the root
+func (j *sftpJail) remove(p string, isDir bool) error {
+	dir, name, err := j.at(p, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+
+	var st unix.Stat_t
+	if err := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return pathError("remove", p, err)
+	}
+	if (st.Mode&unix.S_IFMT == unix.S_IFDIR) != isDir {
+		return os.ErrInvalid
+	}
+	flags := 0
+	if isDir {
+		flags = unix.AT_REMOVEDIR
+	}
+	return pathError("remove", p, unix.Unlinkat(dir, name, flags))
+}
+
+// rename moves a file inside the root; without replace, an existing target is refused
+func (j *sftpJail) rename(from, to string, replace bool) error {
+	fromDir, fromName, err := j.at(from, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fromDir)
+	toDir, toName, err := j.at(to, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(toDir)
+
+	if !replace {
+		var st unix.Stat_t
+		if err := unix.Fstatat(toDir, toName, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+			return os.ErrExist
+		}
+	}
+	return pathError("rename", from, unix.Renameat(fromDir, fromName, toDir, toName))
+}
+
+// link creates a hard link inside the root
+func (j *sftpJail) link(oldname, newname string) error {
+	oldDir, oldName, err := j.at(oldname, true)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(oldDir)
+	newDir, newName, err := j.at(newname, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(newDir)
+	return pathError("link", newname, unix.Linkat(oldDir, oldName, newDir, newName, 0))
+}
+
+// symlink creates a symlink inside the root pointing at target, a real path
+func (j *sftpJail) symlink(target, linkname string) error {
+	dir, name, err := j.at(linkname, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	return pathError("symlink", linkname, unix.Symlinkat(target, dir, name))
+}
+
+// readlink returns the target of a symlink inside the root
+func (j *sftpJail) readlink(p string) (string, error) {
+	dir, name, err := j.at(p, false)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(dir)
+
+	target, err := readlinkAt(dir, name)
+	if err != nil {
+		return "", pathError("readlink", p, err)
+	}
+	return target, nil
+}
+
+// setstat applies the attributes of a Setstat request through a handle on the
+// file, so a symlink swapped in meanwhile is not followed out of the root
+func (j *sftpJail) setstat(p string, flags sftp.FileAttrFlags, attrs *sftp.FileStat) error {
+	dir, name, err := j.at(p, true)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+
+	// Truncating needs write access; for the rest, either suffices
+	open := func(mode int) (int, error) {
+		return unix.Openat(dir, name, mode|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	}
+	var fd int
+	if flags.Size {
+		fd, err = open(unix.O_WRONLY)
+	} else if fd, err = open(unix.O_RDONLY); errors.Is(err, unix.EACCES) {
+		fd, err = open(unix.O_WRONLY)
+	}
+	if err != nil {
+		return pathError("open", p, err)
+	}
+	defer unix.Close(fd)
+
+	if flags.Size {
+		if err := unix.Ftruncate(fd, int64(attrs.Size)); err != nil {
+			return pathError("truncate", p, err)
+		}
+	}
+	if flags.Permissions {
+		if err := unix.Fchmod(fd, uint32(attrs.FileMode().Perm())); err != nil {
+			return pathError("chmod", p, err)
+		}
+	}
+	if flags.UidGid {
+		if err := unix.Fchown(fd, int(attrs.UID), int(attrs.GID)); err != nil {
+			return pathError("chown", p, err)
+		}
+	}
+	if flags.Acmodtime {
+		times := []unix.Timeval{
+			unix.NsecToTimeval(time.Unix(int64(attrs.Atime), 0).UnixNano()),
+			unix.NsecToTimeval(time.Unix(int64(attrs.Mtime), 0).UnixNano()),
+		}
+		if err := unix.Futimes(fd, times); err != nil {
+			return pathError("chtimes", p, err)
+		}
+	}
+	return nil
+}
+
+// pathError wraps a non-nil syscall error with the operation and virtual path
+func pathError(op, p string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+// statInfo is the os.FileInfo of an Fstatat result
+type statInfo struct {
+	name string
+	st   unix.Stat_t
+}
+
+func (fi *statInfo) Name() string       { return fi.name }
+func (fi *statInfo) Size() int64        { return fi.st.Size }
+func (fi *statInfo) ModTime() time.Time { return time.Unix(fi.st.Mtim.Unix()) }
+func (fi *statInfo) IsDir() bool        { return fi.Mode().IsDir() }
+
+// Sys carries the owner, the only part pkg/sftp reads
+func (fi *statInfo) Sys() interface{} {
+	return &syscall.Stat_t{Uid: fi.st.Uid, Gid: fi.st.Gid}
+}
+
+// Mode converts the Unix mode bits as os.Stat does
+func (fi *statInfo) Mode() os.FileMode {
+	raw := uint32(fi.st.Mode)
+	mode := os.FileMode(raw & 0777)
+	switch raw & unix.S_IFMT {
+	case unix.S_IFDIR:
+		mode |= os.ModeDir
+	case unix.S_IFLNK:
+		mode |= os.ModeSymlink
+	case unix.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case unix.S_IFSOCK:
+		mode |= os.ModeSocket
+	case unix.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case unix.S_IFBLK:
+		mode |= os.ModeDevice
+	}
+	if raw&unix.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if raw&unix.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if raw&unix.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
@@ -0,0 +1,226 @@
+//go:build windows
+// +build windows
+
+package ssh
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Windows has no openat, so the jail checks where a path's symlinks lead and
+// then uses the path. Sessions run as the daemon's account there, and creating
+// symlinks needs a privilege ordinary accounts lack.
+
+// resolve maps a virtual path to a real path inside the root. With follow set,
+// symlinks in the final component are followed too; either way a path whose
+// symlinks lead outside the root is refused.
+func (j *sftpJail) resolve(p string, follow bool) (string, error) {
+	real := filepath.Join(j.root, filepath.FromSlash(path.Clean("/"+p)))
+
+	check := real
+	if !follow {
+		check = filepath.Dir(real)
+	}
+	resolved, err := evalPath(check, 0)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := j.relative(resolved); !ok {
+		return "", os.ErrPermission
+	}
+	return real, nil
+}
+
+// evalPath resolves symlinks in p like filepath.EvalSymlinks, but also follows
+// dangling links and tolerates missing components, so a file about to be
+// created is checked where it would really be created
+func evalPath(p string, depth int) (string, error) {
+	if depth > maxSymlinkDepth {
+		return "", errors.New("too many levels of symbolic links")
+	}
+
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		parent := filepath.Dir(p)
+		if parent == p {
+			return p, nil
+		}
+		dir, err := evalPath(parent, depth)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, filepath.Base(p)), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		return filepath.EvalSymlinks(p)
+	}
+
+	target, err := os.Readlink(p)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		dir, err := evalPath(filepath.Dir(p), depth+1)
+		if err != nil {
+			return "", err
+		}
+		target = filepath.Join(dir, target)
+	}
+	return evalPath(target, depth+1)
+}
+
+// open opens a file inside the root, following a final symlink
+func (j *sftpJail) open(p string, flags int, perm os.FileMode) (*os.File, error) {
+	real, err := j.resolve(p, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(real, flags, perm)
+}
+
+// stat stats a file inside the root
+func (j *sftpJail) stat(p string, follow bool) (os.FileInfo, error) {
+	real, err := j.resolve(p, follow)
+	if err != nil {
+		return nil, err
+	}
+	if follow {
+		return os.Stat(real)
+	}
+	return os.Lstat(real)
+}
+
+// readDir lists a directory inside the root
+func (j *sftpJail) readDir(p string) ([]os.FileInfo, error) {
+	real, err := j.resolve(p, true)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(real)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed while listing
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// mkdir creates a directory inside the root
+func (j *sftpJail) mkdir(p string) error {
+	real, err := j.resolve(p, false)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(real, 0755)
+}
+
+// remove removes a file, or with dir set an empty directory, inside the root
+func (j *sftpJail) remove(p string, dir bool) error {
+	real, err := j.resolve(p, false)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(real)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() != dir {
+		return os.ErrInvalid
+	}
+	return os.Remove(real)
+}
+
+// rename moves a file inside the root; without replace, an existing target is refused
+func (j *sftpJail) rename(from, to string, replace bool) error {
+	realFrom, err := j.resolve(from, false)
+	if err != nil {
+		return err
+	}
+	realTo, err := j.resolve(to, false)
+	if err != nil {
+		return err
+	}
+	if !replace {
+		if _, err := os.Lstat(realTo); err == nil {
+			return os.ErrExist
+		}
+	}
+	return os.Rename(realFrom, realTo)
+}
+
+// link creates a hard link inside the root
+func (j *sftpJail) link(oldname, newname string) error {
+	realOld, err := j.resolve(oldname, true)
+	if err != nil {
+		return err
+	}
+	realNew, err := j.resolve(newname, false)
+	if err != nil {
+		return err
+	}
+	return os.Link(realOld, realNew)
+}
+
+// symlink creates a symlink inside the root pointing at target, a real path
+func (j *sftpJail) symlink(target, linkname string) error {
+	real, err := j.resolve(linkname, false)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, real)
+}
+
+// readlink returns the target of a symlink inside the root
+func (j *sftpJail) readlink(p string) (string, error) {
+	real, err := j.resolve(p, false)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(real)
+}
+
+// setstat applies the attributes of a Setstat request
+func (j *sftpJail) setstat(p string, flags sftp.FileAttrFlags, attrs *sftp.FileStat) error {
+	real, err := j.resolve(p, true)
+	if err != nil {
+		return err
+	}
+
+	if flags.Size {
+		if err := os.Truncate(real, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(real, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := os.Chown(real, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(real, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package ssh
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// TOTP parameters (RFC 6238 defaults, which every authenticator app supports)
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	totpSkew   = 1 // accepted steps before and after the current one
+)
+
+// totpPrompt is the keyboard-interactive question for the second factor
+const totpPrompt = "Verification code: "
+
+// totpEncoding is unpadded base32, as used in otpauth URIs
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpReplay remembers the last accepted time step per user, so a code
+// cannot be used twice
+type totpReplay struct {
+	mu       sync.Mutex
+	lastStep map[string]int64
+}
+
+// accept records step for username, refusing steps at or before the last accepted one
+func (r *totpReplay) accept(username string, step int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if last, ok := r.lastStep[username]; ok && step <= last {
+		return false
+	}
+	r.lastStep[username] = step
+	return true
+}
+
+// GenerateTOTPSecret returns a new random 160-bit TOTP secret in base32
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI returns the otpauth:// URI that authenticator apps scan
+func TOTPURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + v.Encode()
+}
+
+// ValidateTOTP reports whether code is valid for secret at time t
+func ValidateTOTP(secret, code string, t time.Time) bool {
+	_, ok := matchTOTP(secret, code, t)
+	return ok
+}
+
+// matchTOTP returns the time step code is valid for, within the allowed skew
+func matchTOTP(secret, code string, t time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := t.Unix() / int64(totpPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// hotp computes the RFC 4226 one-time password for counter
+func hotp(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// secondFactor completes a successful password or public key authentication
+// with the permissions it grants. Users with a TOTP secret get a partial
+// success and must then answer a keyboard-interactive prompt with their
+// current code, which grants the same permissions.
+func (s *Server) secondFactor(ctx ssh.Context, perms *gossh.Permissions) (*gossh.Permissions, error) {
+	secret, ok := s.config.TOTPSecrets[ctx.User()]
+	if !ok {
+		return perms, nil
+	}
+
+	return perms, &gossh.PartialSuccessError{
+		Next: gossh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(conn gossh.ConnMetadata, client gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+				if !s.totpHandler(ctx, secret, client) {
+					return nil, fmt.Errorf("permission denied")
+				}
+				return perms, nil
+			},
+		},
+	}
+}
+
+// totpHandler asks for a verification code and checks it
+func (s *Server) totpHandler(ctx ssh.Context, secret string, client gossh.KeyboardInteractiveChallenge) bool {
+	username := ctx.User()
+	ip := s.clientIP(ctx.RemoteAddr())
+
+	if s.isBanned(ctx) {
+		return false
+	}
+
+	answers, err := client(username, "Two-factor authentication", []string{totpPrompt}, []bool{false})
+	if err != nil || len(answers) != 1 {
+		return false
+	}
+
+	step, ok := matchTOTP(secret, answers[0], time.Now())
+	if ok && s.totpReplay.accept(username, step) {
+		s.log.WithField("user", username).Info("TOTP verification successful")
+		return true
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"user":   username,
+		"replay": ok,
+	}).Warn("TOTP verification failed")
+
+	if delay := s.guard.Failure(ip, username, "ssh"); delay > 0 {
+		time.Sleep(delay)
+	}
+	return false
+}
+
+// keyboardInteractiveHandler refuses keyboard-interactive as a first factor;
+// it is only offered for the TOTP step after a password or key succeeded
+func (s *Server) keyboardInteractiveHandler(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+	return false
+}
@@ -0,0 +1,203 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shadow-shuttle/shadowd/lockout"
+	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors, "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1; the six-digit codes are the last six
+	// digits of the eight-digit ones listed there
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	key := mustDecodeTOTP(t, rfc6238Secret)
+	for _, tt := range tests {
+		if got := hotp(key, tt.unix/30); got != tt.code {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.code)
+		}
+		if !ValidateTOTP(rfc6238Secret, tt.code, time.Unix(tt.unix, 0)) {
+			t.Errorf("ValidateTOTP rejected %s at %d", tt.code, tt.unix)
+		}
+	}
+}
+
+func TestTOTPSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0) // step 37037037, code 050471
+
+	tests := []struct {
+		name string
+		at   time.Time
+		code string
+		want bool
+	}{
+		{"current step", now, "050471", true},
+		{"previous step", now.Add(30 * time.Second), "050471", true},
+		{"next step", now.Add(-30 * time.Second), "050471", true},
+		{"two steps late", now.Add(60 * time.Second), "050471", false},
+		{"two steps early", now.Add(-60 * time.Second), "050471", false},
+		{"surrounding spaces", now, " 050471 ", true},
+		{"wrong code", now, "050472", false},
+		{"too short", now, "50471", false},
+		{"eight digits", now, "14050471", false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidateTOTP(rfc6238Secret, tt.code, tt.at); got != tt.want {
+			t.Errorf("%s: ValidateTOTP = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Secrets are accepted in lower case and with padding, as apps show them
+	if !ValidateTOTP(strings.ToLower(rfc6238Secret)+"====", "050471", now) {
+		t.Error("lower-case padded secret rejected")
+	}
+	if ValidateTOTP("not base32!", "050471", now) {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestTOTPReplay(t *testing.T) {
+	r := &totpReplay{lastStep: make(map[string]int64)}
+
+	tests := []struct {
+		user string
+		step int64
+		want bool
+	}{
+		{"alice", 100, true},
+		{"alice", 100, false}, // the same code again
+		{"alice", 99, false},  // an older code still within the skew
+		{"bob", 100, true},    // replay is tracked per user
+		{"alice", 101, true},
+		{"alice", 100, false},
+	}
+
+	for i, tt := range tests {
+		if got := r.accept(tt.user, tt.step); got != tt.want {
+			t.Errorf("%d: accept(%s, %d) = %v, want %v", i, tt.user, tt.step, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(key) != 20 {
+		t.Errorf("secret %q decodes to %d bytes, %v", secret, len(key), err)
+	}
+
+	uri := TOTPURI("shadowd", "alice@host", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/shadowd:alice@host?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("URI = %q", uri)
+	}
+}
+
+// TestFailuresClearedAfterSecondFactor checks that the failure counters of a
+// user with TOTP are kept when the password is right, and only cleared when
+// the code is
+func TestFailuresClearedAfterSecondFactor(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	guard, err := lockout.NewGuard(lockout.Config{MaxFailures: 100}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(Config{
+		MeshIP:      "127.0.0.1",
+		Port:        2222,
+		HostKeyPath: "unused",
+		Users:       map[string]string{"alice": "secret", "bob": "secret"},
+		TOTPSecrets: map[string]string{"alice": rfc6238Secret},
+	}, Services{Guard: guard}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 50000}
+	failures := func(user string) int {
+		// The delay of one more failure tells how many came before it
+		delay := guard.Failure("203.0.113.7", user, "ssh")
+		n := 0
+		for d := time.Second; d < delay; d *= 2 {
+			n++
+		}
+		return n
+	}
+
+	// alice: password accepted, TOTP pending
+	guard.Failure("203.0.113.7", "alice", "ssh")
+	ctx := newTestContext()
+	config := s.serverConfig(ctx)
+	conn := testConnMetadata{user: "alice", remote: remote}
+
+	_, err = config.PasswordCallback(conn, []byte("secret"))
+	var partial *gossh.PartialSuccessError
+	if !errors.As(err, &partial) {
+		t.Fatalf("password for a TOTP user = %v, want a partial success", err)
+	}
+	config.AuthLogCallback(conn, "password", err)
+	if n := failures("alice"); n != 1 {
+		t.Fatalf("%d failures after the first factor, want the earlier one kept", n)
+	}
+
+	// The code completes the login and clears the counters
+	code := hotp(mustDecodeTOTP(t, rfc6238Secret), time.Now().Unix()/30)
+	answer := func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return []string{code}, nil
+	}
+	if _, err := partial.Next.KeyboardInteractiveCallback(conn, answer); err != nil {
+		t.Fatalf("valid code refused: %v", err)
+	}
+	config.AuthLogCallback(conn, "keyboard-interactive", nil)
+	if n := failures("alice"); n != 0 {
+		t.Errorf("%d failures after the second factor, want none", n)
+	}
+
+	// bob has no second factor, so the password alone completes the login
+	guard.Failure("203.0.113.7", "bob", "ssh")
+	ctx = newTestContext()
+	config = s.serverConfig(ctx)
+	conn = testConnMetadata{user: "bob", remote: remote}
+	if _, err := config.PasswordCallback(conn, []byte("secret")); err != nil {
+		t.Fatalf("password refused: %v", err)
+	}
+	config.AuthLogCallback(conn, "password", nil)
+	if n := failures("bob"); n != 0 {
+		t.Errorf("%d failures after a password login, want none", n)
+	}
+}
+
+// mustDecodeTOTP decodes a base32 TOTP secret
+func mustDecodeTOTP(t *testing.T, secret string) []byte {
+	t.Helper()
+
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
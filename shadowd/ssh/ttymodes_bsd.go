@@ -0,0 +1,12 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+package ssh
+
+import "golang.org/x/sys/unix"
+
+// termios ioctls on macOS and the BSDs
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+)
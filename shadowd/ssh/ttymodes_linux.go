@@ -0,0 +1,17 @@
+package ssh
+
+import (
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// termios ioctls on Linux
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+)
+
+func init() {
+	// IUTF8 is Linux-only
+	ttyFlags[gossh.IUTF8] = ttyFlag{'i', unix.IUTF8}
+}
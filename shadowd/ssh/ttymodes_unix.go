@@ -0,0 +1,156 @@
+//go:build !windows
+// +build !windows
+
+package ssh
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/creack/pty"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// ttyControlChars maps RFC 4254 control character opcodes to termios indices
+var ttyControlChars = map[uint8]int{
+	gossh.VINTR:    unix.VINTR,
+	gossh.VQUIT:    unix.VQUIT,
+	gossh.VERASE:   unix.VERASE,
+	gossh.VKILL:    unix.VKILL,
+	gossh.VEOF:     unix.VEOF,
+	gossh.VEOL:     unix.VEOL,
+	gossh.VEOL2:    unix.VEOL2,
+	gossh.VSTART:   unix.VSTART,
+	gossh.VSTOP:    unix.VSTOP,
+	gossh.VSUSP:    unix.VSUSP,
+	gossh.VREPRINT: unix.VREPRINT,
+	gossh.VWERASE:  unix.VWERASE,
+	gossh.VLNEXT:   unix.VLNEXT,
+	gossh.VDISCARD: unix.VDISCARD,
+}
+
+// ttyFlag is a termios flag bit and the flag word it belongs to
+type ttyFlag struct {
+	word byte // 'i', 'o', 'c' or 'l'
+	mask uint64
+}
+
+// ttyFlags maps RFC 4254 flag opcodes to termios flags
+var ttyFlags = map[uint8]ttyFlag{
+	gossh.IGNPAR:  {'i', unix.IGNPAR},
+	gossh.PARMRK:  {'i', unix.PARMRK},
+	gossh.INPCK:   {'i', unix.INPCK},
+	gossh.ISTRIP:  {'i', unix.ISTRIP},
+	gossh.INLCR:   {'i', unix.INLCR},
+	gossh.IGNCR:   {'i', unix.IGNCR},
+	gossh.ICRNL:   {'i', unix.ICRNL},
+	gossh.IXON:    {'i', unix.IXON},
+	gossh.IXANY:   {'i', unix.IXANY},
+	gossh.IXOFF:   {'i', unix.IXOFF},
+	gossh.IMAXBEL: {'i', unix.IMAXBEL},
+	gossh.ISIG:    {'l', unix.ISIG},
+	gossh.ICANON:  {'l', unix.ICANON},
+	gossh.ECHO:    {'l', unix.ECHO},
+	gossh.ECHOE:   {'l', unix.ECHOE},
+	gossh.ECHOK:   {'l', unix.ECHOK},
+	gossh.ECHONL:  {'l', unix.ECHONL},
+	gossh.NOFLSH:  {'l', unix.NOFLSH},
+	gossh.TOSTOP:  {'l', unix.TOSTOP},
+	gossh.IEXTEN:  {'l', unix.IEXTEN},
+	gossh.ECHOCTL: {'l', unix.ECHOCTL},
+	gossh.ECHOKE:  {'l', unix.ECHOKE},
+	gossh.PENDIN:  {'l', unix.PENDIN},
+	gossh.OPOST:   {'o', unix.OPOST},
+	gossh.ONLCR:   {'o', unix.ONLCR},
+	gossh.OCRNL:   {'o', unix.OCRNL},
+	gossh.ONOCR:   {'o', unix.ONOCR},
+	gossh.ONLRET:  {'o', unix.ONLRET},
+	gossh.PARENB:  {'c', unix.PARENB},
+	gossh.PARODD:  {'c', unix.PARODD},
+}
+
+// startPty starts cmd on a new PTY configured with the client's terminal
+// modes and returns the PTY master. Like pty.Start, the command gets a new
+// session with the PTY as its controlling terminal.
+func startPty(cmd *exec.Cmd, modes gossh.TerminalModes) (*os.File, error) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+
+	if len(modes) > 0 {
+		if err := applyTerminalModes(tty, modes); err != nil {
+			ptmx.Close()
+			return nil, err
+		}
+	}
+
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+
+	if err := cmd.Start(); err != nil {
+		ptmx.Close()
+		return nil, err
+	}
+	return ptmx, nil
+}
+
+// applyTerminalModes sets the termios of tty from RFC 4254 terminal modes.
+// Modes this system does not have are ignored, as in sshd.
+func applyTerminalModes(tty *os.File, modes gossh.TerminalModes) error {
+	fd := int(tty.Fd())
+	termios, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return err
+	}
+
+	for op, value := range modes {
+		if index, ok := ttyControlChars[op]; ok {
+			termios.Cc[index] = uint8(value)
+			continue
+		}
+		if flag, ok := ttyFlags[op]; ok {
+			switch flag.word {
+			case 'i':
+				setFlag(&termios.Iflag, flag.mask, value != 0)
+			case 'o':
+				setFlag(&termios.Oflag, flag.mask, value != 0)
+			case 'c':
+				setFlag(&termios.Cflag, flag.mask, value != 0)
+			case 'l':
+				setFlag(&termios.Lflag, flag.mask, value != 0)
+			}
+			continue
+		}
+		switch op {
+		case gossh.CS7:
+			if value != 0 {
+				termios.Cflag = termios.Cflag&^unix.CSIZE | unix.CS7
+			}
+		case gossh.CS8:
+			if value != 0 {
+				termios.Cflag = termios.Cflag&^unix.CSIZE | unix.CS8
+			}
+		}
+	}
+
+	return unix.IoctlSetTermios(fd, ioctlSetTermios, termios)
+}
+
+// setFlag sets or clears mask in a termios flag word, whose width differs between systems
+func setFlag[T uint32 | uint64](word *T, mask uint64, on bool) {
+	if on {
+		*word |= T(mask)
+	} else {
+		*word &^= T(mask)
+	}
+}
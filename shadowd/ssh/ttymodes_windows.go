@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package ssh
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// startPty starts cmd on a new PTY; terminal modes are not supported on Windows
+func startPty(cmd *exec.Cmd, modes gossh.TerminalModes) (*os.File, error) {
+	return pty.Start(cmd)
+}
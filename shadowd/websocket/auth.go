@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/shadow-shuttle/shadowd/pairing"
+)
+
+// errNoTicket is returned by authenticate when the request carries no ticket
+var errNoTicket = errors.New("no ticket")
+
+// checkOrigin guards against cross-site WebSocket hijacking. Browsers send an
+// Origin header with every WebSocket upgrade, so a request from a browser is
+// allowed only from the server's own origin or one in AllowedOrigins, and an
+// AllowedOrigins entry of "*" turns the check off. Non-browser clients, such
+// as the mobile app, omit the header and are allowed; they still need a
+// ticket unless AllowUnauthenticated is set.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range s.config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate verifies the ticket of an upgrade request, given as a bearer
+// token in the Authorization header or, for browsers that cannot set headers,
+// in the "ticket" query parameter
+func (s *Server) authenticate(r *http.Request) (*pairing.Grant, error) {
+	ticket := r.URL.Query().Get("ticket")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, token, ok := strings.Cut(auth, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return nil, pairing.ErrInvalidTicket
+		}
+		ticket = strings.TrimSpace(token)
+	}
+	if ticket == "" {
+		return nil, errNoTicket
+	}
+
+	grant, err := s.tickets.Verify(ticket)
+	if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
@@ -0,0 +1,62 @@
+package websocket
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Defaults for dead-peer detection
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPongTimeout  = 10 * time.Second
+)
+
+// keepAlive pings the client every PingInterval and arms a read deadline that
+// every pong or message pushes back, so a client that vanished without closing
+// the connection makes the read loop fail with a timeout. The returned
+// function stops the pings.
+func (s *Server) keepAlive(conn *websocket.Conn) func() {
+	if s.config.PingInterval <= 0 {
+		return func() {}
+	}
+
+	s.extendReadDeadline(conn)
+	conn.SetPongHandler(func(string) error {
+		s.extendReadDeadline(conn)
+		return nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.config.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// WriteControl may be called concurrently with the session's writes
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// extendReadDeadline gives the client another ping interval plus PongTimeout to send something
+func (s *Server) extendReadDeadline(conn *websocket.Conn) {
+	if s.config.PingInterval > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.config.PingInterval + s.config.PongTimeout))
+	}
+}
+
+// isTimeout reports whether a read failed because the read deadline passed
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
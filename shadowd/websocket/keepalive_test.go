@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// connPair connects a client asking for the given subprotocols to a test
+// server offering the proxy's, and returns the server's and the client's end
+// of the connection
+func connPair(t *testing.T, protocols ...string) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+
+	accepted := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{Subprotocols: []string{protocolBinary, protocolJSON}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer{Subprotocols: protocols}
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	select {
+	case conn := <-accepted:
+		t.Cleanup(func() { conn.Close() })
+		return conn, client
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not accepted")
+		return nil, nil
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	s := &Server{config: Config{PingInterval: 50 * time.Millisecond, PongTimeout: 50 * time.Millisecond}}
+
+	tests := []struct {
+		name    string
+		answer  bool // the client reads, which answers pings with pongs
+		wantEnd bool
+	}{
+		{"responsive client", true, false},
+		{"unresponsive client", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := connPair(t)
+			if tt.answer {
+				go func() {
+					for {
+						if _, _, err := client.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}()
+			}
+
+			stop := s.keepAlive(conn)
+			defer stop()
+
+			// Read as the session loop does; the client never sends a message
+			done := make(chan error, 1)
+			go func() {
+				_, _, err := conn.ReadMessage()
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				if !tt.wantEnd {
+					t.Fatalf("read ended with %v while the client answered pings", err)
+				}
+				if !isTimeout(err) {
+					t.Errorf("read error = %v, want a timeout", err)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if tt.wantEnd {
+					t.Fatal("unresponsive client not detected")
+				}
+			}
+		})
+	}
+}
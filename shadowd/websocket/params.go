@@ -0,0 +1,209 @@
+package websocket
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/shadow-shuttle/shadowd/acceptenv"
+	"golang.org/x/crypto/ssh"
+)
+
+// Defaults and limits for the session parameters of a "connect" message
+const (
+	defaultTerm = "xterm-256color"
+	defaultRows = 40
+	defaultCols = 80
+
+	maxTerminalSize  = 1000      // rows or columns
+	maxTermLength    = 64        // length of a TERM value
+	maxEnvValue      = 4096      // length of an environment variable's value
+	maxCommandLength = 32 * 1024 // length of a command
+)
+
+// terminalModes maps the RFC 4254 names of terminal modes, as given in
+// "connect" messages, to their opcodes
+var terminalModes = map[string]uint8{
+	"VINTR":         ssh.VINTR,
+	"VQUIT":         ssh.VQUIT,
+	"VERASE":        ssh.VERASE,
+	"VKILL":         ssh.VKILL,
+	"VEOF":          ssh.VEOF,
+	"VEOL":          ssh.VEOL,
+	"VEOL2":         ssh.VEOL2,
+	"VSTART":        ssh.VSTART,
+	"VSTOP":         ssh.VSTOP,
+	"VSUSP":         ssh.VSUSP,
+	"VDSUSP":        ssh.VDSUSP,
+	"VREPRINT":      ssh.VREPRINT,
+	"VWERASE":       ssh.VWERASE,
+	"VLNEXT":        ssh.VLNEXT,
+	"VFLUSH":        ssh.VFLUSH,
+	"VSWTCH":        ssh.VSWTCH,
+	"VSTATUS":       ssh.VSTATUS,
+	"VDISCARD":      ssh.VDISCARD,
+	"IGNPAR":        ssh.IGNPAR,
+	"PARMRK":        ssh.PARMRK,
+	"INPCK":         ssh.INPCK,
+	"ISTRIP":        ssh.ISTRIP,
+	"INLCR":         ssh.INLCR,
+	"IGNCR":         ssh.IGNCR,
+	"ICRNL":         ssh.ICRNL,
+	"IUCLC":         ssh.IUCLC,
+	"IXON":          ssh.IXON,
+	"IXANY":         ssh.IXANY,
+	"IXOFF":         ssh.IXOFF,
+	"IMAXBEL":       ssh.IMAXBEL,
+	"IUTF8":         ssh.IUTF8,
+	"ISIG":          ssh.ISIG,
+	"ICANON":        ssh.ICANON,
+	"XCASE":         ssh.XCASE,
+	"ECHO":          ssh.ECHO,
+	"ECHOE":         ssh.ECHOE,
+	"ECHOK":         ssh.ECHOK,
+	"ECHONL":        ssh.ECHONL,
+	"NOFLSH":        ssh.NOFLSH,
+	"TOSTOP":        ssh.TOSTOP,
+	"IEXTEN":        ssh.IEXTEN,
+	"ECHOCTL":       ssh.ECHOCTL,
+	"ECHOKE":        ssh.ECHOKE,
+	"PENDIN":        ssh.PENDIN,
+	"OPOST":         ssh.OPOST,
+	"OLCUC":         ssh.OLCUC,
+	"ONLCR":         ssh.ONLCR,
+	"OCRNL":         ssh.OCRNL,
+	"ONOCR":         ssh.ONOCR,
+	"ONLRET":        ssh.ONLRET,
+	"CS7":           ssh.CS7,
+	"CS8":           ssh.CS8,
+	"PARENB":        ssh.PARENB,
+	"PARODD":        ssh.PARODD,
+	"TTY_OP_ISPEED": ssh.TTY_OP_ISPEED,
+	"TTY_OP_OSPEED": ssh.TTY_OP_OSPEED,
+}
+
+// sessionParams are the validated session parameters of a "connect" message
+type sessionParams struct {
+	pty   bool
+	term  string
+	rows  int
+	cols  int
+	modes ssh.TerminalModes
+	env   []string // NAME=value, sorted by name
+
+	// command is run instead of the login shell, and changes to the requested
+	// working directory first; empty starts the shell
+	command string
+}
+
+// sessionParams validates the session parameters of a "connect" message.
+// A PTY is requested for the login shell, and for a command only if the
+// message asks for one. local is whether the session is on this machine.
+func (s *Server) sessionParams(msg WSMessage, local bool) (*sessionParams, error) {
+	p := &sessionParams{
+		pty:  msg.Command == "",
+		term: defaultTerm,
+		rows: defaultRows,
+		cols: defaultCols,
+	}
+	if msg.Pty != nil {
+		p.pty = *msg.Pty
+	}
+
+	if !p.pty && (msg.Term != "" || msg.Rows != 0 || msg.Cols != 0 || len(msg.Modes) > 0) {
+		return nil, fmt.Errorf("terminal parameters require a PTY")
+	}
+	if msg.Term != "" {
+		if !validTerm(msg.Term) {
+			return nil, fmt.Errorf("invalid TERM %q", msg.Term)
+		}
+		p.term = msg.Term
+	}
+	if msg.Rows != 0 || msg.Cols != 0 {
+		if msg.Rows <= 0 || msg.Rows > maxTerminalSize || msg.Cols <= 0 || msg.Cols > maxTerminalSize {
+			return nil, fmt.Errorf("terminal size must be between 1 and %d rows and columns", maxTerminalSize)
+		}
+		p.rows, p.cols = msg.Rows, msg.Cols
+	}
+	if p.pty {
+		p.modes = ssh.TerminalModes{}
+		for name, value := range msg.Modes {
+			opcode, ok := terminalModes[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown terminal mode %q", name)
+			}
+			p.modes[opcode] = value
+		}
+	}
+
+	names := make([]string, 0, len(msg.Env))
+	for name := range msg.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := msg.Env[name]
+		if !validEnvName(name) || !acceptenv.Match(s.config.AcceptEnv, name) {
+			return nil, fmt.Errorf("environment variable %s is not accepted", name)
+		}
+		if len(value) > maxEnvValue || strings.ContainsRune(value, 0) {
+			return nil, fmt.Errorf("invalid value for environment variable %s", name)
+		}
+		p.env = append(p.env, name+"="+value)
+	}
+
+	if len(msg.Command) > maxCommandLength || strings.ContainsRune(msg.Command, 0) {
+		return nil, fmt.Errorf("command must be at most %d bytes without NUL characters", maxCommandLength)
+	}
+	p.command = msg.Command
+
+	if msg.Cwd != "" {
+		// SSH has no working directory request, so the command changes to it,
+		// which needs a POSIX shell on the other end
+		if local && runtime.GOOS == "windows" {
+			return nil, fmt.Errorf("working directory is not supported on this server")
+		}
+		if !path.IsAbs(msg.Cwd) || strings.ContainsAny(msg.Cwd, "\x00\n") {
+			return nil, fmt.Errorf("working directory must be an absolute path")
+		}
+		command := msg.Command
+		if command == "" {
+			command = `exec "$SHELL" -l`
+		}
+		p.command = "cd -- " + shellQuote(msg.Cwd) + " || exit; " + command
+	}
+	return p, nil
+}
+
+// validTerm reports whether term is a plausible terminal type
+func validTerm(term string) bool {
+	if len(term) > maxTermLength {
+		return false
+	}
+	for _, r := range term {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._+-", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validEnvName reports whether name is a valid environment variable name
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// shellQuote quotes s as a single word for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
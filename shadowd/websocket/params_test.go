@@ -0,0 +1,110 @@
+package websocket
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSessionParams(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	s := NewServer(Config{}, Services{}, log)
+
+	yes, no := true, false
+	shell := func(p sessionParams) *sessionParams {
+		p.pty, p.term = true, defaultTerm
+		if p.rows == 0 {
+			p.rows, p.cols = defaultRows, defaultCols
+		}
+		return &p
+	}
+
+	tests := []struct {
+		name    string
+		msg     WSMessage
+		want    *sessionParams // terminal modes are not compared
+		wantErr string         // substring of the error
+	}{
+		{name: "defaults", msg: WSMessage{}, want: shell(sessionParams{})},
+		{name: "terminal", msg: WSMessage{Term: "screen-256color", Rows: 50, Cols: 132}, want: &sessionParams{pty: true, term: "screen-256color", rows: 50, cols: 132}},
+		{name: "accepted env sorted", msg: WSMessage{Env: map[string]string{"LC_ALL": "C", "LANG": "en_US.UTF-8"}}, want: shell(sessionParams{env: []string{"LANG=en_US.UTF-8", "LC_ALL=C"}})},
+		{name: "command without PTY", msg: WSMessage{Command: "uptime"}, want: &sessionParams{term: defaultTerm, rows: defaultRows, cols: defaultCols, command: "uptime"}},
+		{name: "command with PTY", msg: WSMessage{Command: "top", Pty: &yes, Rows: 30, Cols: 100}, want: shell(sessionParams{rows: 30, cols: 100, command: "top"})},
+		{name: "shell in directory", msg: WSMessage{Cwd: "/srv/it's here"}, want: shell(sessionParams{command: `cd -- '/srv/it'\''s here' || exit; exec "$SHELL" -l`})},
+		{name: "command in directory", msg: WSMessage{Cwd: "/tmp", Command: "ls"}, want: &sessionParams{term: defaultTerm, rows: defaultRows, cols: defaultCols, command: "cd -- '/tmp' || exit; ls"}},
+		{name: "terminal size without PTY", msg: WSMessage{Pty: &no, Rows: 24, Cols: 80}, wantErr: "require a PTY"},
+		{name: "modes without PTY", msg: WSMessage{Command: "ls", Modes: map[string]uint32{"ECHO": 0}}, wantErr: "require a PTY"},
+		{name: "invalid TERM", msg: WSMessage{Term: "xterm; rm -rf /"}, wantErr: "invalid TERM"},
+		{name: "TERM too long", msg: WSMessage{Term: strings.Repeat("x", maxTermLength+1)}, wantErr: "invalid TERM"},
+		{name: "zero rows", msg: WSMessage{Cols: 80}, wantErr: "terminal size"},
+		{name: "too many columns", msg: WSMessage{Rows: 24, Cols: maxTerminalSize + 1}, wantErr: "terminal size"},
+		{name: "unknown mode", msg: WSMessage{Modes: map[string]uint32{"NOPE": 1}}, wantErr: "unknown terminal mode"},
+		{name: "env not accepted", msg: WSMessage{Env: map[string]string{"LD_PRELOAD": "/tmp/x.so"}}, wantErr: "LD_PRELOAD is not accepted"},
+		{name: "invalid env name", msg: WSMessage{Env: map[string]string{"LC_=X": "y"}}, wantErr: "is not accepted"},
+		{name: "env value with NUL", msg: WSMessage{Env: map[string]string{"LANG": "C\x00"}}, wantErr: "invalid value"},
+		{name: "env value too long", msg: WSMessage{Env: map[string]string{"LANG": strings.Repeat("x", maxEnvValue+1)}}, wantErr: "invalid value"},
+		{name: "command with NUL", msg: WSMessage{Command: "ls\x00"}, wantErr: "command must be"},
+		{name: "command too long", msg: WSMessage{Command: strings.Repeat("x", maxCommandLength+1)}, wantErr: "command must be"},
+		{name: "relative directory", msg: WSMessage{Cwd: "tmp"}, wantErr: "absolute path"},
+		{name: "directory with newline", msg: WSMessage{Cwd: "/tmp\nrm -rf /"}, wantErr: "absolute path"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := s.sessionParams(tt.msg, false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sessionParams: %v", err)
+			}
+
+			got, want := *p, *tt.want
+			got.modes = nil
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("sessionParams = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestSessionParamsModes(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	s := NewServer(Config{}, Services{}, log)
+
+	p, err := s.sessionParams(WSMessage{Modes: map[string]uint32{"ECHO": 0, "VERASE": 127, "IUTF8": 1}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ssh.TerminalModes{ssh.ECHO: 0, ssh.VERASE: 127, ssh.IUTF8: 1}
+	if len(p.modes) != len(want) {
+		t.Fatalf("modes = %v, want %v", p.modes, want)
+	}
+	for opcode, value := range want {
+		if got, ok := p.modes[opcode]; !ok || got != value {
+			t.Errorf("mode %d = %d, want %d", opcode, got, value)
+		}
+	}
+}
+
+func TestSessionParamsAcceptEnv(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	s := NewServer(Config{AcceptEnv: []string{"GIT_*"}}, Services{}, log)
+
+	if _, err := s.sessionParams(WSMessage{Env: map[string]string{"GIT_AUTHOR_NAME": "a"}}, false); err != nil {
+		t.Errorf("configured pattern refused: %v", err)
+	}
+	if _, err := s.sessionParams(WSMessage{Env: map[string]string{"LANG": "C"}}, false); err == nil {
+		t.Error("default variable accepted despite a configured AcceptEnv")
+	}
+}
@@ -0,0 +1,83 @@
+package websocket
+
+import (
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocols offered in Sec-WebSocket-Protocol, preferred first. Clients
+// that ask for none get the JSON protocol.
+const (
+	// protocolBinary carries terminal data in binary frames and control
+	// messages as JSON in text frames
+	protocolBinary = "shadowd.v2"
+
+	// protocolJSON carries everything as JSON text frames, terminal data as
+	// strings in "data" messages
+	protocolJSON = "shadowd.v1"
+)
+
+// Kinds of binary frames; the first byte of a frame is its kind and the rest
+// its payload. Frames of unknown kinds are ignored. The kinds of output
+// frames also identify the shell's output streams.
+const (
+	// frameData is terminal input from the client and the shell's standard
+	// output to it
+	frameData byte = 0x00
+
+	// frameStderr is the shell's standard error
+	frameStderr byte = 0x01
+)
+
+// outputTypes are the JSON message types of the output streams, by frame kind
+var outputTypes = [...]string{
+	frameData:   "data",
+	frameStderr: "stderr",
+}
+
+// isBinary reports whether conn negotiated the binary protocol
+func isBinary(conn *websocket.Conn) bool {
+	return conn.Subprotocol() == protocolBinary
+}
+
+// protocolVersion returns the protocol conn speaks, for the "hello" message
+func protocolVersion(conn *websocket.Conn) string {
+	if isBinary(conn) {
+		return protocolBinary
+	}
+	return protocolJSON
+}
+
+// capabilities returns the optional features announced in "hello", so clients
+// can tell what this server supports without guessing from its version
+func (s *Server) capabilities() []string {
+	capabilities := []string{"resume", "stderr", "exit", "otp", "pty", "exec"}
+	if s.jumps != nil {
+		capabilities = append(capabilities, "jump")
+	}
+	return capabilities
+}
+
+// outputFrame returns a binary frame of the given kind carrying p
+func outputFrame(kind byte, p []byte) []byte {
+	frame := make([]byte, 1+len(p))
+	frame[0] = kind
+	copy(frame[1:], p)
+	return frame
+}
+
+// incompleteUTF8 returns the length of the incomplete UTF-8 sequence at the
+// end of p, which the JSON protocol holds back until the rest arrives
+func incompleteUTF8(p []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		if !utf8.RuneStart(p[len(p)-i]) {
+			continue
+		}
+		if !utf8.FullRune(p[len(p)-i:]) {
+			return i
+		}
+		return 0
+	}
+	return 0
+}
@@ -0,0 +1,176 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIncompleteUTF8(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want int
+	}{
+		{"empty", "", 0},
+		{"ASCII", "hello", 0},
+		{"complete two-byte rune", "caf\xc3\xa9", 0},
+		{"complete four-byte rune", "ok \xf0\x9f\x98\x80", 0},
+		{"first byte of two", "caf\xc3", 1},
+		{"first byte of three", "\xe4", 1},
+		{"two bytes of three", "x\xe4\xb8", 2},
+		{"three bytes of four", "\xf0\x9f\x98", 3},
+		{"stray continuation byte", "x\x80", 0},
+		{"invalid start byte", "x\xff", 0},
+		{"continuations after a complete rune", "\xc3\xa9\x80\x80\x80", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := incompleteUTF8([]byte(tt.data)); got != tt.want {
+				t.Errorf("incompleteUTF8(%q) = %d, want %d", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncompleteUTF8Split(t *testing.T) {
+	// Holding back the incomplete tail at any split keeps both halves valid
+	text := []byte("a\xc3\xa9\xe4\xb8\xad\xf0\x9f\x98\x80z")
+	for split := 0; split <= len(text); split++ {
+		head := text[:split]
+		held := incompleteUTF8(head)
+		sent, rest := head[:len(head)-held], append(append([]byte{}, head[len(head)-held:]...), text[split:]...)
+		if !utf8.Valid(sent) || !utf8.Valid(rest) {
+			t.Errorf("split at %d: sent %q, then %q", split, sent, rest)
+		}
+	}
+}
+
+// readMessage returns the next message the client receives, as its type and payload
+func readMessage(t *testing.T, client *websocket.Conn) (int, string) {
+	t.Helper()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return messageType, string(data)
+}
+
+func TestHelloMessage(t *testing.T) {
+	s := &Server{}
+	tests := []struct {
+		name      string
+		protocols []string
+		want      string
+	}{
+		{"no subprotocol", nil, `{"type":"hello","version":"shadowd.v1","capabilities":["resume","stderr","exit","otp","pty","exec"]}`},
+		{"JSON", []string{protocolJSON}, `{"type":"hello","version":"shadowd.v1","capabilities":["resume","stderr","exit","otp","pty","exec"]}`},
+		{"binary", []string{protocolBinary, protocolJSON}, `{"type":"hello","version":"shadowd.v2","capabilities":["resume","stderr","exit","otp","pty","exec"]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := connPair(t, tt.protocols...)
+			c := newClientConn(conn)
+			defer c.abort()
+
+			s.sendMessage(c, WSMessage{Type: "hello", Version: protocolVersion(conn), Capabilities: s.capabilities()})
+			if messageType, got := readMessage(t, client); messageType != websocket.TextMessage || got != tt.want {
+				t.Errorf("hello = %d %s, want %s", messageType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStderrOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		protocols []string
+		want      []string // text messages, or binary frames as %q
+	}{
+		{"JSON", nil, []string{
+			`{"type":"data","offset":3,"data":"ok\n"}`,
+			`{"type":"stderr","offset":8,"data":"oops "}`,
+			`{"type":"stderr","offset":11,"data":"é!"}`,
+		}},
+		{"binary", []string{protocolBinary}, []string{
+			`"\x00ok\n"`,
+			`"\x01oops \xc3"`,
+			`"\x01\xa9!"`,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := connPair(t, tt.protocols...)
+			c := newClientConn(conn)
+			defer c.abort()
+			ts := &terminalSession{server: &Server{}, conn: c, output: newRingBuffer(1024)}
+
+			ts.write(frameData, []byte("ok\n"))
+			ts.write(frameStderr, []byte("oops \xc3")) // "é" split across two reads
+			ts.write(frameStderr, []byte("\xa9!"))
+
+			for i, want := range tt.want {
+				messageType, got := readMessage(t, client)
+				if messageType == websocket.BinaryMessage {
+					got = fmt.Sprintf("%q", got)
+				}
+				if got != want {
+					t.Errorf("message %d = %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExitMessage(t *testing.T) {
+	status := 143
+	tests := []struct {
+		name string
+		msg  WSMessage
+		want string
+	}{
+		{"success", exitMessage(nil), `{"type":"exit","exitCode":0}`},
+		{"no status", exitMessage(errors.New("connection lost")), `{"type":"exit","message":"Shell exited without reporting a status"}`},
+		{"signal", WSMessage{Type: "exit", ExitCode: &status, Signal: "TERM"}, `{"type":"exit","exitCode":143,"signal":"TERM"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("exit = %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailureMessages(t *testing.T) {
+	conn, client := connPair(t)
+	c := newClientConn(conn)
+	defer c.abort()
+	s := &Server{}
+
+	s.sendConnectFailed(c, "Host not permitted")
+	s.sendAuthFailed(c, "Authentication failed")
+	for _, want := range []string{
+		`{"type":"connect_failed","message":"Host not permitted"}`,
+		`{"type":"auth_failed","message":"Authentication failed"}`,
+	} {
+		if _, got := readMessage(t, client); got != want {
+			t.Errorf("message = %s, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/shadow-shuttle/shadowd/limits"
+	"github.com/shadow-shuttle/shadowd/pairing"
+	"github.com/shadow-shuttle/shadowd/sessions"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Defaults for session resumption
+const (
+	defaultResumeGracePeriod = 5 * time.Minute
+	defaultResumeBufferSize  = 256 * 1024
+)
+
+// writeTimeout bounds a write to a client, so a dead connection cannot stall
+// the shell's output. A variable so tests can shorten it.
+var writeTimeout = 10 * time.Second
+
+// terminalSession is an SSH shell that outlives the WebSocket it was opened on.
+// When the client drops, the session is detached and kept for the grace period;
+// a client presenting the session ID and resume token within it is reattached
+// and sent the output it missed from the ring buffer.
+type terminalSession struct {
+	id     string
+	user   string
+	server *Server
+
+	// grant is the ticket the session was opened with, nil without one; only
+	// a client holding a ticket for the same device and user may resume it
+	grant *pairing.Grant
+
+	client  *ssh.Client
+	session *ssh.Session
+	stdin   io.WriteCloser
+	pty     bool              // whether the shell or command has a terminal
+	lease   *limits.Session   // counted against the session limits, nil without them
+	entry   *sessions.Session // entry in the session registry, nil without one
+
+	mu     sync.Mutex
+	token  string
+	conn   *clientConn // attached client, nil while detached
+	output *ringBuffer
+	expiry *time.Timer
+	closed bool
+
+	// Output held back from a JSON client per stream, the start of a split
+	// UTF-8 sequence, and the offset it starts at
+	pending   [len(outputTypes)][]byte
+	pendingAt [len(outputTypes)]int64
+
+	streams int // output streams still open
+}
+
+// newTerminalSession registers a session for an established shell
+func (s *Server) newTerminalSession(user string, grant *pairing.Grant, client *ssh.Client, session *ssh.Session, stdin io.WriteCloser, pty bool, lease *limits.Session, entry *sessions.Session) (*terminalSession, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	token, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &terminalSession{
+		id:      id,
+		user:    user,
+		server:  s,
+		grant:   grant,
+		client:  client,
+		session: session,
+		stdin:   stdin,
+		pty:     pty,
+		lease:   lease,
+		entry:   entry,
+		token:   token,
+		output:  newRingBuffer(s.config.ResumeBufferSize),
+		streams: 2, // stdout and stderr
+	}
+
+	s.sessionsMu.Lock()
+	s.sessions[id] = ts
+	s.sessionsMu.Unlock()
+	return ts, nil
+}
+
+// lookupSession returns the session with the given ID if token matches and
+// grant, the resuming client's ticket, is for the session's device and user
+func (s *Server) lookupSession(id, token string, grant *pairing.Grant) *terminalSession {
+	s.sessionsMu.Lock()
+	ts := s.sessions[id]
+	s.sessionsMu.Unlock()
+	if ts == nil {
+		return nil
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.closed || subtle.ConstantTimeCompare([]byte(ts.token), []byte(token)) != 1 || !sameGrant(ts.grant, grant) {
+		return nil
+	}
+	return ts
+}
+
+// sameGrant reports whether two tickets, either of which may be absent, are
+// for the same device and user
+func sameGrant(a, b *pairing.Grant) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.DeviceID == b.DeviceID && a.User == b.User
+}
+
+// closeAllSessions ends every session, attached or not
+func (s *Server) closeAllSessions() {
+	s.sessionsMu.Lock()
+	sessions := make([]*terminalSession, 0, len(s.sessions))
+	for _, ts := range s.sessions {
+		sessions = append(sessions, ts)
+	}
+	s.sessionsMu.Unlock()
+
+	for _, ts := range sessions {
+		ts.end("server shutting down")
+	}
+}
+
+// closeDeviceSessions ends the sessions opened with a ticket of the given device
+func (s *Server) closeDeviceSessions(deviceID string) {
+	s.sessionsMu.Lock()
+	var sessions []*terminalSession
+	for _, ts := range s.sessions {
+		if ts.grant != nil && ts.grant.DeviceID == deviceID {
+			sessions = append(sessions, ts)
+		}
+	}
+	s.sessionsMu.Unlock()
+
+	for _, ts := range sessions {
+		ts.end("device unpaired")
+	}
+}
+
+// attach makes conn the session's client. When resuming, it rotates the resume
+// token and replays the output after offset; it reports whether output the
+// client had not seen was already dropped from the buffer.
+// Any previously attached client is disconnected.
+func (ts *terminalSession) attach(conn *clientConn, offset int64, resumed bool) (bool, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.expiry != nil {
+		ts.expiry.Stop()
+		ts.expiry = nil
+	}
+	if ts.conn != nil && ts.conn != conn {
+		ts.conn.abort()
+	}
+	ts.conn = conn
+	ts.pending = [len(outputTypes)][]byte{}
+
+	if !resumed {
+		return false, nil
+	}
+
+	// Rotate the token so a leaked one cannot be replayed
+	token, err := randomHex(32)
+	if err != nil {
+		return false, err
+	}
+	ts.token = token
+
+	missed, end, complete := ts.output.since(offset)
+	message := "Session resumed"
+	if !complete {
+		message = "Session resumed, some output was lost"
+	}
+	start := end
+	for _, c := range missed {
+		start -= int64(len(c.data))
+	}
+	if err := ts.send(WSMessage{
+		Type:        "resumed",
+		SessionID:   ts.id,
+		ResumeToken: token,
+		Offset:      start,
+		Message:     message,
+	}); err != nil {
+		return false, err
+	}
+	for _, c := range missed {
+		if err := ts.sendOutput(c.kind, c.data, c.end); err != nil {
+			return false, err
+		}
+	}
+	return !complete, nil
+}
+
+// detach forgets conn if it is still the attached client and starts the grace period
+func (ts *terminalSession) detach(conn *clientConn) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.closed || ts.conn != conn {
+		return
+	}
+	ts.conn = nil
+
+	grace := ts.server.config.ResumeGracePeriod
+	ts.expiry = time.AfterFunc(grace, func() {
+		ts.close("resume grace period expired")
+	})
+
+	ts.server.log.WithFields(logrus.Fields{
+		"session": ts.id,
+		"user":    ts.user,
+		"grace":   grace.String(),
+	}).Info("Terminal session detached, waiting for client to resume")
+}
+
+// forwardOutput copies the output stream of the given frame kind into the ring
+// buffer and to the attached client. While the client's write queue is full the
+// stream is not read, so a slow client throttles the shell instead of growing
+// the queue. The session ends when all streams are closed.
+func (ts *terminalSession) forwardOutput(reader io.Reader, kind byte) {
+	buf := make([]byte, 32*1024)
+
+	for {
+		ts.waitWritable()
+		n, err := reader.Read(buf)
+		if n > 0 {
+			ts.write(kind, buf[:n])
+		}
+		if err != nil {
+			if err != io.EOF {
+				ts.server.log.WithError(err).WithField("stream", outputTypes[kind]).Debug("SSH output stream closed")
+			}
+			break
+		}
+	}
+
+	ts.mu.Lock()
+	ts.streams--
+	done := ts.streams == 0
+	ts.mu.Unlock()
+	if done {
+		ts.exit()
+	}
+}
+
+// exit tells the attached client how the shell exited and ends the session.
+// Nothing is sent if the session was closed from this side.
+func (ts *terminalSession) exit() {
+	ts.notify(exitMessage(ts.session.Wait()))
+	ts.end("shell exited")
+}
+
+// exitMessage returns the "exit" message for the result of waiting for the shell
+func exitMessage(err error) WSMessage {
+	msg := WSMessage{Type: "exit"}
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		code := 0
+		msg.ExitCode = &code
+	case errors.As(err, &exitErr):
+		code := exitErr.ExitStatus()
+		msg.ExitCode = &code
+		msg.Signal = exitErr.Signal()
+		msg.Message = exitErr.Msg()
+	default:
+		msg.Message = "Shell exited without reporting a status"
+	}
+	return msg
+}
+
+// write buffers output of the stream of the given frame kind and sends it to
+// the attached client, if any
+func (ts *terminalSession) write(kind byte, p []byte) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.lease.Touch()
+	ts.entry.CountOut(len(p))
+	end := ts.output.write(kind, p)
+	if ts.conn == nil {
+		return
+	}
+	if err := ts.sendOutput(kind, p, end); err != nil {
+		// The read loop notices the closed connection and detaches it
+		ts.server.log.WithError(err).WithField("session", ts.id).Debug("Failed to send data to WebSocket")
+	}
+}
+
+// waitWritable blocks while the attached client's write queue is full
+func (ts *terminalSession) waitWritable() {
+	ts.mu.Lock()
+	conn := ts.conn
+	ts.mu.Unlock()
+
+	conn.waitWritable()
+}
+
+// notify sends a control message to the attached client, if any
+func (ts *terminalSession) notify(msg WSMessage) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.conn == nil || ts.closed {
+		return
+	}
+	if err := ts.send(msg); err != nil {
+		ts.server.log.WithError(err).WithField("session", ts.id).Warn("Failed to send message to WebSocket")
+	}
+}
+
+// end tells the attached client why it is disconnected and closes the session
+func (ts *terminalSession) end(reason string) {
+	ts.notify(WSMessage{Type: "closed", Message: "Disconnected: " + reason})
+	ts.close(reason)
+}
+
+// send queues a message for the attached client. ts.mu must be held.
+func (ts *terminalSession) send(msg WSMessage) error {
+	return ts.server.sendMessage(ts.conn, msg)
+}
+
+// sendOutput queues output of the stream of the given frame kind, ending at
+// offset end, for the attached client: as a binary frame or, for JSON clients,
+// as a "data" or "stderr" message holding back any split UTF-8 sequence until
+// its remaining bytes arrive. The offset sent stops short of output still held
+// back in either stream, so a resume replays it. ts.mu must be held.
+func (ts *terminalSession) sendOutput(kind byte, p []byte, end int64) error {
+	if ts.conn.binary {
+		return ts.conn.send(websocket.BinaryMessage, outputFrame(kind, p))
+	}
+
+	data := append(ts.pending[kind], p...)
+	held := incompleteUTF8(data)
+	ts.pending[kind] = append([]byte(nil), data[len(data)-held:]...)
+	ts.pendingAt[kind] = end - int64(held)
+	data = data[:len(data)-held]
+	if len(data) == 0 {
+		return nil
+	}
+
+	offset := end
+	for k := range ts.pending {
+		if len(ts.pending[k]) > 0 && ts.pendingAt[k] < offset {
+			offset = ts.pendingAt[k]
+		}
+	}
+	return ts.server.sendMessage(ts.conn, WSMessage{Type: outputTypes[kind], Data: string(data), Offset: offset})
+}
+
+// close ends the session and its SSH connection, and closes the attached
+// client's connection once the messages queued for it are written
+func (ts *terminalSession) close(reason string) {
+	ts.mu.Lock()
+	if ts.closed {
+		ts.mu.Unlock()
+		return
+	}
+	ts.closed = true
+	if ts.expiry != nil {
+		ts.expiry.Stop()
+	}
+	if ts.conn != nil {
+		ts.conn.close()
+	}
+	ts.mu.Unlock()
+
+	ts.server.sessionsMu.Lock()
+	delete(ts.server.sessions, ts.id)
+	ts.server.sessionsMu.Unlock()
+
+	ts.stdin.Close()
+	ts.session.Close()
+	ts.client.Close()
+	ts.lease.Release()
+	ts.entry.Close()
+
+	ts.server.log.WithFields(logrus.Fields{
+		"session": ts.id,
+		"user":    ts.user,
+		"reason":  reason,
+	}).Info("Terminal session closed")
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// ringBuffer keeps the most recent output of a session. Offsets count every
+// byte ever written, so a client can say exactly how much it has seen.
+type ringBuffer struct {
+	data []byte
+	runs []run // the streams of the bytes in data, oldest first
+	size int
+	end  int64 // offset just past the last byte written
+}
+
+// run is a stretch of output from a single stream
+type run struct {
+	kind byte  // frame kind of the stream
+	end  int64 // offset just past the run
+}
+
+// chunk is output from a single stream, returned for replay
+type chunk struct {
+	kind byte
+	data []byte
+	end  int64 // offset just past data
+}
+
+// newRingBuffer creates a ring buffer holding up to size bytes
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{size: size}
+}
+
+// write appends p from the stream of the given kind, dropping the oldest bytes
+// beyond the buffer size, and returns the new end offset
+func (b *ringBuffer) write(kind byte, p []byte) int64 {
+	b.end += int64(len(p))
+	if n := len(b.runs); n > 0 && b.runs[n-1].kind == kind {
+		b.runs[n-1].end = b.end
+	} else {
+		b.runs = append(b.runs, run{kind: kind, end: b.end})
+	}
+
+	b.data = append(b.data, p...)
+	if len(b.data) > b.size {
+		b.data = append(b.data[:0], b.data[len(b.data)-b.size:]...)
+	}
+
+	start := b.end - int64(len(b.data))
+	dropped := 0
+	for dropped < len(b.runs) && b.runs[dropped].end <= start {
+		dropped++
+	}
+	if dropped > 0 {
+		b.runs = append(b.runs[:0], b.runs[dropped:]...)
+	}
+	return b.end
+}
+
+// since returns the buffered output after offset, a chunk per run, and the end
+// offset. complete is false when some bytes after offset were already dropped.
+func (b *ringBuffer) since(offset int64) ([]chunk, int64, bool) {
+	start := b.end - int64(len(b.data))
+	complete := true
+	if offset < start {
+		offset = start
+		complete = false
+	}
+	if offset > b.end {
+		offset = b.end
+	}
+
+	var chunks []chunk
+	for _, r := range b.runs {
+		if r.end <= offset {
+			continue
+		}
+		chunks = append(chunks, chunk{
+			kind: r.kind,
+			data: append([]byte(nil), b.data[offset-start:r.end-start]...),
+			end:  r.end,
+		})
+		offset = r.end
+	}
+	return chunks, b.end, complete
+}
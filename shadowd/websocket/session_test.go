@@ -0,0 +1,148 @@
+package websocket
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/shadow-shuttle/shadowd/pairing"
+	"github.com/sirupsen/logrus"
+)
+
+// describe renders replayed chunks as "kind:data@end" for comparison
+func describe(chunks []chunk) string {
+	var parts []string
+	for _, c := range chunks {
+		parts = append(parts, fmt.Sprintf("%s:%s@%d", outputTypes[c.kind], c.data, c.end))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestRingBufferSince(t *testing.T) {
+	b := newRingBuffer(16)
+	b.write(frameData, []byte("hello ")) // 0-6
+	b.write(frameData, []byte("world"))  // 6-11
+	b.write(frameStderr, []byte("oops")) // 11-15
+	if end := b.write(frameData, []byte("!")); end != 16 {
+		t.Fatalf("end = %d, want 16", end)
+	}
+
+	tests := []struct {
+		offset   int64
+		want     string
+		complete bool
+	}{
+		{0, "data:hello world@11 stderr:oops@15 data:!@16", true},
+		{3, "data:lo world@11 stderr:oops@15 data:!@16", true},
+		{11, "stderr:oops@15 data:!@16", true},
+		{13, "stderr:ps@15 data:!@16", true},
+		{16, "", true},
+		{99, "", true},
+	}
+	for _, tt := range tests {
+		chunks, end, complete := b.since(tt.offset)
+		if got := describe(chunks); got != tt.want || complete != tt.complete || end != 16 {
+			t.Errorf("since(%d) = %q, %d, %v, want %q, 16, %v", tt.offset, got, end, complete, tt.want, tt.complete)
+		}
+	}
+}
+
+func TestRingBufferDropsOldest(t *testing.T) {
+	b := newRingBuffer(8)
+	b.write(frameData, []byte("abcd"))   // 0-4
+	b.write(frameStderr, []byte("efgh")) // 4-8
+	b.write(frameData, []byte("ijklmn")) // 8-14, keeps 6-14
+
+	tests := []struct {
+		offset   int64
+		want     string
+		complete bool
+	}{
+		{0, "stderr:gh@8 data:ijklmn@14", false},
+		{5, "stderr:gh@8 data:ijklmn@14", false},
+		{6, "stderr:gh@8 data:ijklmn@14", true},
+		{8, "data:ijklmn@14", true},
+		{12, "data:mn@14", true},
+	}
+	for _, tt := range tests {
+		chunks, _, complete := b.since(tt.offset)
+		if got := describe(chunks); got != tt.want || complete != tt.complete {
+			t.Errorf("since(%d) = %q, %v, want %q, %v", tt.offset, got, complete, tt.want, tt.complete)
+		}
+	}
+
+	// Runs that fall out of the buffer entirely are forgotten
+	b.write(frameStderr, []byte("opqrstuvwxyz")) // 14-26, keeps 18-26
+	if len(b.runs) != 1 || b.runs[0].kind != frameStderr {
+		t.Errorf("runs = %+v, want only the last stderr run", b.runs)
+	}
+	if chunks, _, complete := b.since(14); describe(chunks) != "stderr:stuvwxyz@26" || complete {
+		t.Errorf("since(14) = %q, %v", describe(chunks), complete)
+	}
+}
+
+func TestRingBufferReplayIsCopied(t *testing.T) {
+	b := newRingBuffer(8)
+	b.write(frameData, []byte("abc"))
+	chunks, _, _ := b.since(0)
+	b.write(frameData, []byte("defghijk"))
+	if string(chunks[0].data) != "abc" {
+		t.Errorf("replayed chunk changed to %q by a later write", chunks[0].data)
+	}
+}
+
+func TestSameGrant(t *testing.T) {
+	phone := &pairing.Grant{DeviceID: "phone", User: "alice"}
+	tests := []struct {
+		name string
+		a, b *pairing.Grant
+		want bool
+	}{
+		{"both without ticket", nil, nil, true},
+		{"same device and user", phone, &pairing.Grant{DeviceID: "phone", User: "alice"}, true},
+		{"other device", phone, &pairing.Grant{DeviceID: "tablet", User: "alice"}, false},
+		{"other user", phone, &pairing.Grant{DeviceID: "phone", User: "bob"}, false},
+		{"ticket missing", phone, nil, false},
+		{"unexpected ticket", nil, phone, false},
+	}
+
+	for _, tt := range tests {
+		if got := sameGrant(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: sameGrant = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLookupSessionChecksGrant(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	s := NewServer(Config{}, Services{}, log)
+
+	phone := &pairing.Grant{DeviceID: "phone", User: "alice"}
+	s.sessions["paired"] = &terminalSession{id: "paired", user: "alice", grant: phone, token: "t1"}
+	s.sessions["open"] = &terminalSession{id: "open", user: "alice", token: "t2"}
+
+	tests := []struct {
+		name  string
+		id    string
+		token string
+		grant *pairing.Grant
+		want  bool
+	}{
+		{"same device", "paired", "t1", &pairing.Grant{DeviceID: "phone", User: "alice"}, true},
+		{"wrong token", "paired", "t2", phone, false},
+		{"other device with the token", "paired", "t1", &pairing.Grant{DeviceID: "laptop", User: "alice"}, false},
+		{"other user's ticket", "paired", "t1", &pairing.Grant{DeviceID: "phone", User: "bob"}, false},
+		{"no ticket", "paired", "t1", nil, false},
+		{"unpaired session without ticket", "open", "t2", nil, true},
+		{"unpaired session with a ticket", "open", "t2", phone, false},
+		{"unknown session", "missing", "t1", phone, false},
+	}
+
+	for _, tt := range tests {
+		if got := s.lookupSession(tt.id, tt.token, tt.grant) != nil; got != tt.want {
+			t.Errorf("%s: found = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
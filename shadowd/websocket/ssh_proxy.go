@@ -4,15 +4,31 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/shadow-shuttle/shadowd/acceptenv"
+	"github.com/shadow-shuttle/shadowd/jump"
+	"github.com/shadow-shuttle/shadowd/limits"
+	"github.com/shadow-shuttle/shadowd/lockout"
+	"github.com/shadow-shuttle/shadowd/pairing"
+	"github.com/shadow-shuttle/shadowd/sessions"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 )
 
+// Defaults for connecting to SSH servers
+const (
+	defaultJumpPort = 22               // port of jump targets when the client gives none
+	resolveTimeout  = 5 * time.Second  // resolving a jump target's name
+	dialTimeout     = 10 * time.Second // establishing the TCP connection to an SSH server
+)
+
 // Config contains WebSocket SSH proxy configuration
 type Config struct {
 	// ListenAddr is the address to listen on (e.g., "0.0.0.0:8022")
@@ -23,6 +39,37 @@ type Config struct {
 	
 	// SSHPort is the SSH port to connect to
 	SSHPort int
+	
+	// ResumeGracePeriod is how long a shell is kept after its WebSocket drops,
+	// waiting for the client to resume it (default: 5m)
+	ResumeGracePeriod time.Duration
+	
+	// ResumeBufferSize is how many bytes of recent output are kept per session
+	// for replay on resume (default: 256 KiB)
+	ResumeBufferSize int
+	
+	// PingInterval is how often clients are pinged (default: 30s); a negative
+	// value disables pings and read deadlines
+	PingInterval time.Duration
+	
+	// PongTimeout is how long past the next ping a silent client is kept
+	// before its connection is dropped (default: 10s)
+	PongTimeout time.Duration
+	
+	// AllowedOrigins are the origins (e.g. "https://app.example.com") browsers
+	// may connect from besides the server's own; "*" disables the origin check,
+	// letting any web page connect. Non-browser clients, such as the mobile
+	// app, send no Origin header and are not affected.
+	AllowedOrigins []string
+	
+	// AllowUnauthenticated lets clients without a ticket connect, logging in
+	// with a password or private key alone as before pairing existed
+	AllowUnauthenticated bool
+	
+	// AcceptEnv are the names of environment variables clients may set in
+	// "connect"; "*" and "?" match as in sshd_config. Defaults to LANG, LC_*
+	// and TERM, as for the SSH server.
+	AcceptEnv []string
 }
 
 // Server represents the WebSocket SSH proxy server
@@ -34,11 +81,31 @@ type Server struct {
 	ctx      context.Context
 	cancel   context.CancelFunc
 	wg       sync.WaitGroup
+	
+	// Brute-force protection shared with the SSH server (nil disables it)
+	guard *lockout.Guard
+	
+	// Session limits shared with the SSH server (nil disables them)
+	limiter *limits.Limiter
+	
+	// Live sessions of all transports, shared with the SSH server (nil tracks none)
+	registry *sessions.Registry
+	
+	// Mesh peers clients may jump to, shared with the SSH server (nil allows none)
+	jumps *jump.Policy
+	
+	// Issues and verifies the tickets of paired devices, shared with the SSH
+	// server and the HTTP API (nil accepts no ticket)
+	tickets *pairing.Authority
+	
+	// Terminal sessions by ID, attached or waiting to be resumed
+	sessions   map[string]*terminalSession
+	sessionsMu sync.Mutex
 }
 
 // Message types for WebSocket communication
 type WSMessage struct {
-	Type string `json:"type"` // "connect", "data", "resize", "disconnect"
+	Type string `json:"type"` // "connect", "resume", "data", "resize", "eof", "disconnect"; from the server also "hello", "stderr", "exit", "auth_failed", "connect_failed", "warning" and "closed"
 	
 	// Connection parameters
 	Host       string `json:"host,omitempty"`
@@ -46,39 +113,99 @@ type WSMessage struct {
 	Username   string `json:"username,omitempty"`
 	Password   string `json:"password,omitempty"`
 	PrivateKey string `json:"privateKey,omitempty"`
+	OTP        string `json:"otp,omitempty"` // TOTP code, for users with two-factor authentication
+	
+	// Session parameters, with "connect". Rows and Cols below give the initial
+	// terminal size. Command runs instead of the login shell, without a PTY
+	// unless Pty is true; Pty false starts the shell without one.
+	Term    string            `json:"term,omitempty"`
+	Modes   map[string]uint32 `json:"modes,omitempty"` // RFC 4254 names, e.g. "ECHO", "VERASE"
+	Env     map[string]string `json:"env,omitempty"`
+	Cwd     string            `json:"cwd,omitempty"`
+	Command string            `json:"command,omitempty"`
+	Pty     *bool             `json:"pty,omitempty"`
+	
+	// Session resumption: sent with "connected" and "resumed", and by the
+	// client with "resume". Offset counts output bytes since the session
+	// started; on "data" it is the offset just past the payload.
+	SessionID   string `json:"sessionId,omitempty"`
+	ResumeToken string `json:"resumeToken,omitempty"`
+	Offset      int64  `json:"offset,omitempty"`
 	
-	// Data payload
+	// Data payload (JSON protocol; the binary protocol sends data in binary frames)
 	Data string `json:"data,omitempty"`
 	
-	// Terminal resize
+	// Terminal size, with "connect" and "resize"
 	Rows int `json:"rows,omitempty"`
 	Cols int `json:"cols,omitempty"`
 	
+	// Sent with "hello": the protocol spoken and the optional features supported
+	Version      string   `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	
+	// Sent with "exit": the shell's exit status, and the signal that killed
+	// it if any. ExitCode is missing if the SSH server reported no status.
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+	
 	// Response
 	Message string `json:"message,omitempty"`
 }
 
+// Services are the shared services a Server uses. Any of them may be nil to
+// turn its feature off.
+type Services struct {
+	Guard    *lockout.Guard     // brute-force protection
+	Limiter  *limits.Limiter    // session limits
+	Sessions *sessions.Registry // live sessions for the admin API
+	Jumps    *jump.Policy       // other hosts clients may connect to; nil allows only the local server
+	Tickets  *pairing.Authority // paired devices' tickets; nil allows only unauthenticated clients
+}
+
 // NewServer creates a new WebSocket SSH proxy server
-func NewServer(config Config, log *logrus.Logger) *Server {
+func NewServer(config Config, services Services, log *logrus.Logger) *Server {
 	if log == nil {
 		log = logrus.New()
 	}
 	
+	if config.ResumeGracePeriod <= 0 {
+		config.ResumeGracePeriod = defaultResumeGracePeriod
+	}
+	if config.ResumeBufferSize <= 0 {
+		config.ResumeBufferSize = defaultResumeBufferSize
+	}
+	if config.PingInterval == 0 {
+		config.PingInterval = defaultPingInterval
+	}
+	if config.PongTimeout <= 0 {
+		config.PongTimeout = defaultPongTimeout
+	}
+	if config.AcceptEnv == nil {
+		config.AcceptEnv = acceptenv.Default
+	}
+	
 	ctx, cancel := context.WithCancel(context.Background())
 	
-	return &Server{
-		config: config,
-		log:    log,
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				// Allow all origins for development
-				// In production, you should check the origin
-				return true
-			},
-		},
-		ctx:    ctx,
-		cancel: cancel,
+	s := &Server{
+		config:   config,
+		log:      log,
+		ctx:      ctx,
+		cancel:   cancel,
+		guard:    services.Guard,
+		limiter:  services.Limiter,
+		registry: services.Sessions,
+		jumps:    services.Jumps,
+		tickets:  services.Tickets,
+		sessions: make(map[string]*terminalSession),
+	}
+	s.upgrader = websocket.Upgrader{
+		CheckOrigin:  s.checkOrigin,
+		Subprotocols: []string{protocolBinary, protocolJSON},
 	}
+	
+	// An unpaired device loses its open sessions along with its tickets
+	s.tickets.OnUnpair(s.closeDeviceSessions)
+	return s
 }
 
 // Start starts the WebSocket server
@@ -119,55 +246,114 @@ func (s *Server) Stop() error {
 	
 	s.wg.Wait()
 	
+	// Detached sessions have no connection for Shutdown to wait on
+	s.closeAllSessions()
+	
 	s.log.Info("WebSocket SSH proxy stopped")
 	return nil
 }
 
 // handleWebSocket handles WebSocket connections
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = host
+	}
+	
+	// Only paired devices get as far as the upgrade, unless configured otherwise
+	if err := s.guard.Check(clientIP, ""); err != nil {
+		s.log.WithField("client_ip", clientIP).Warn("WebSocket upgrade refused: login source is banned")
+		http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+	grant, err := s.authenticate(r)
+	if err != nil && !(err == errNoTicket && s.config.AllowUnauthenticated) {
+		s.log.WithError(err).WithField("client_ip", clientIP).Warn("WebSocket upgrade refused: missing or invalid ticket")
+		if err != errNoTicket {
+			if delay := s.guard.Failure(clientIP, "", "websocket"); delay > 0 {
+				time.Sleep(delay)
+			}
+		}
+		http.Error(w, "A valid ticket is required", http.StatusUnauthorized)
+		return
+	}
+	
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		s.log.WithError(err).Error("Failed to upgrade WebSocket connection")
 		return
 	}
-	defer conn.Close()
+	client := newClientConn(conn)
+	defer client.close()
 	
-	clientIP := r.RemoteAddr
-	s.log.WithField("client_ip", clientIP).Info("WebSocket client connected")
+	fields := logrus.Fields{"client_ip": clientIP, "protocol": conn.Subprotocol()}
+	if grant != nil {
+		fields["device"] = grant.DeviceID
+	}
+	s.log.WithFields(fields).Info("WebSocket client connected")
+	
+	s.sendMessage(client, WSMessage{
+		Type:         "hello",
+		Version:      protocolVersion(conn),
+		Capabilities: s.capabilities(),
+	})
+	
+	// Detect clients that vanish without closing the connection
+	stopPings := s.keepAlive(conn)
+	defer stopPings()
 	
 	// Handle the SSH session
-	s.handleSSHSession(conn)
+	s.handleSSHSession(client, clientIP, grant)
 	
 	s.log.WithField("client_ip", clientIP).Info("WebSocket client disconnected")
 }
 
-// handleSSHSession handles an SSH session over WebSocket
-func (s *Server) handleSSHSession(wsConn *websocket.Conn) {
-	var sshClient *ssh.Client
-	var session *ssh.Session
-	var stdin io.WriteCloser
+// handleSSHSession handles an SSH session over WebSocket.
+// If the WebSocket drops, the session is detached rather than closed so that
+// the client can resume it; only "disconnect" or the shell exiting ends it.
+// grant is the client's verified ticket, or nil if it connected without one.
+func (s *Server) handleSSHSession(wsConn *clientConn, clientIP string, grant *pairing.Grant) {
+	var term *terminalSession
+	disconnect := false
 	
 	defer func() {
-		if stdin != nil {
-			stdin.Close()
-		}
-		if session != nil {
-			session.Close()
+		if term == nil {
+			return
 		}
-		if sshClient != nil {
-			sshClient.Close()
+		if disconnect {
+			term.close("client disconnected")
+		} else {
+			term.detach(wsConn)
 		}
 	}()
 	
 	for {
 		// Read message from WebSocket
-		_, message, err := wsConn.ReadMessage()
+		messageType, message, err := wsConn.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if isTimeout(err) {
+				s.log.WithFields(logrus.Fields{
+					"client_ip": clientIP,
+					"reason":    "ping timeout",
+				}).Warn("WebSocket client stopped answering pings, closing connection")
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				s.log.WithError(err).Warn("WebSocket read error")
 			}
 			break
 		}
+		s.extendReadDeadline(wsConn.conn)
+		
+		// Binary frames carry terminal input in the binary protocol
+		if messageType == websocket.BinaryMessage {
+			if !wsConn.binary {
+				s.sendError(wsConn, "Binary frames require the "+protocolBinary+" protocol")
+				continue
+			}
+			if len(message) > 0 && message[0] == frameData {
+				s.writeInput(wsConn, term, message[1:])
+			}
+			continue
+		}
 		
 		var msg WSMessage
 		if err := json.Unmarshal(message, &msg); err != nil {
@@ -179,211 +365,479 @@ func (s *Server) handleSSHSession(wsConn *websocket.Conn) {
 		switch msg.Type {
 		case "connect":
 			// Connect to SSH server
-			if sshClient != nil {
+			if term != nil {
 				s.sendError(wsConn, "Already connected")
 				continue
 			}
 			
-			// Always connect to local SSH server (ignore client's host/port)
-			host := s.config.SSHHost
-			port := s.config.SSHPort
+			term = s.connectSSH(wsConn, clientIP, msg, grant)
 			
-			s.log.WithFields(logrus.Fields{
-				"username": msg.Username,
-				"has_password": msg.Password != "",
-				"has_key": msg.PrivateKey != "",
-			}).Info("Processing SSH connection request")
-			
-			// Create SSH client config
-			config := &ssh.ClientConfig{
-				User: msg.Username,
-				Auth: []ssh.AuthMethod{},
-				HostKeyCallback: ssh.InsecureIgnoreHostKey(), // TODO: Implement proper host key verification
-			}
-			
-			if msg.Password != "" {
-				config.Auth = append(config.Auth, ssh.Password(msg.Password))
-				s.log.Info("Using password authentication")
-			}
-			
-			if msg.PrivateKey != "" {
-				signer, err := ssh.ParsePrivateKey([]byte(msg.PrivateKey))
-				if err != nil {
-					s.log.WithError(err).Error("Failed to parse private key")
-					s.sendError(wsConn, fmt.Sprintf("Invalid private key: %v", err))
-					continue
-				}
-				config.Auth = append(config.Auth, ssh.PublicKeys(signer))
-				s.log.Info("Using public key authentication")
-			}
-			
-			if len(config.Auth) == 0 {
-				s.log.Error("No authentication method provided")
-				s.sendError(wsConn, "No authentication method provided (password or private key required)")
-				continue
-			}
-			
-			// Connect to SSH server
-			addr := fmt.Sprintf("%s:%d", host, port)
-			s.log.WithField("address", addr).Info("Connecting to SSH server")
-			
-			client, err := ssh.Dial("tcp", addr, config)
-			if err != nil {
-				s.log.WithError(err).Error("Failed to connect to SSH server")
-				s.sendError(wsConn, fmt.Sprintf("SSH connection failed: %v", err))
+		case "resume":
+			// Reattach to a session whose WebSocket dropped
+			if term != nil {
+				s.sendError(wsConn, "Already connected")
 				continue
 			}
-			sshClient = client
 			
-			// Create SSH session
-			sess, err := client.NewSession()
-			if err != nil {
-				s.log.WithError(err).Error("Failed to create SSH session")
-				s.sendError(wsConn, fmt.Sprintf("Failed to create session: %v", err))
-				sshClient.Close()
-				sshClient = nil
-				continue
+			if err := s.guard.Check(clientIP, ""); err != nil {
+				s.log.WithField("client_ip", clientIP).Warn("Session resume refused: login source is banned")
+				s.sendError(wsConn, "Too many failed login attempts, try again later")
+				return
 			}
-			session = sess
 			
-			// Request PTY
-			if err := session.RequestPty("xterm-256color", 40, 80, ssh.TerminalModes{}); err != nil {
-				s.log.WithError(err).Error("Failed to request PTY")
-				s.sendError(wsConn, fmt.Sprintf("Failed to request PTY: %v", err))
-				session.Close()
-				session = nil
-				sshClient.Close()
-				sshClient = nil
+			resumed := s.lookupSession(msg.SessionID, msg.ResumeToken, grant)
+			if resumed == nil {
+				s.log.WithFields(logrus.Fields{
+					"client_ip": clientIP,
+					"session":   msg.SessionID,
+				}).Warn("Session resume failed: unknown session, invalid token or another device")
+				// Tokens cannot be guessed, but repeated attempts are still counted
+				if delay := s.guard.Failure(clientIP, "", "websocket"); delay > 0 {
+					time.Sleep(delay)
+				}
+				s.sendError(wsConn, "Session not found or expired")
 				continue
 			}
 			
-			// Get stdin/stdout pipes
-			stdinPipe, err := session.StdinPipe()
+			lost, err := resumed.attach(wsConn, msg.Offset, true)
 			if err != nil {
-				s.log.WithError(err).Error("Failed to get stdin pipe")
-				s.sendError(wsConn, fmt.Sprintf("Failed to get stdin: %v", err))
-				session.Close()
-				session = nil
-				sshClient.Close()
-				sshClient = nil
-				continue
+				s.log.WithError(err).WithField("session", resumed.id).Warn("Failed to resume session")
+				resumed.detach(wsConn)
+				return
 			}
-			stdin = stdinPipe  // Save for later use
+			term = resumed
 			
-			stdout, err := session.StdoutPipe()
-			if err != nil {
-				s.log.WithError(err).Error("Failed to get stdout pipe")
-				s.sendError(wsConn, fmt.Sprintf("Failed to get stdout: %v", err))
-				session.Close()
-				session = nil
-				sshClient.Close()
-				sshClient = nil
-				continue
-			}
+			s.log.WithFields(logrus.Fields{
+				"client_ip":   clientIP,
+				"session":     term.id,
+				"user":        term.user,
+				"output_lost": lost,
+			}).Info("Terminal session resumed")
 			
-			stderr, err := session.StderrPipe()
-			if err != nil {
-				s.log.WithError(err).Error("Failed to get stderr pipe")
-				s.sendError(wsConn, fmt.Sprintf("Failed to get stderr: %v", err))
-				session.Close()
-				session = nil
-				sshClient.Close()
-				sshClient = nil
-				continue
-			}
+		case "data":
+			// Forward data to SSH
+			s.writeInput(wsConn, term, []byte(msg.Data))
 			
-			// Start shell
-			if err := session.Shell(); err != nil {
-				s.log.WithError(err).Error("Failed to start shell")
-				s.sendError(wsConn, fmt.Sprintf("Failed to start shell: %v", err))
+		case "resize":
+			// Resize terminal
+			if term == nil {
+				s.sendError(wsConn, "Not connected to SSH server")
 				continue
 			}
 			
-			// Forward SSH output to WebSocket
-			go s.forwardOutput(wsConn, stdout, "stdout")
-			go s.forwardOutput(wsConn, stderr, "stderr")
-			
-			// Send connected message
-			s.sendMessage(wsConn, WSMessage{
-				Type:    "connected",
-				Message: "SSH connection established",
-			})
-			
-			s.log.Info("SSH session established")
-			
-		case "data":
-			// Forward data to SSH
-			if session == nil || stdin == nil {
-				s.sendError(wsConn, "Not connected to SSH server")
+			if !term.pty {
+				s.sendError(wsConn, "Session has no terminal")
 				continue
 			}
 			
-			if _, err := stdin.Write([]byte(msg.Data)); err != nil {
-				s.log.WithError(err).Error("Failed to write to SSH stdin")
-				s.sendError(wsConn, fmt.Sprintf("Write failed: %v", err))
+			if err := term.session.WindowChange(msg.Rows, msg.Cols); err != nil {
+				s.log.WithError(err).Warn("Failed to resize terminal")
 			}
 			
-		case "resize":
-			// Resize terminal
-			if session == nil {
+		case "eof":
+			// End the input of a command that reads until end of file
+			if term == nil {
 				s.sendError(wsConn, "Not connected to SSH server")
 				continue
 			}
 			
-			if err := session.WindowChange(msg.Rows, msg.Cols); err != nil {
-				s.log.WithError(err).Warn("Failed to resize terminal")
+			if err := term.stdin.Close(); err != nil {
+				s.log.WithError(err).Debug("Failed to close SSH stdin")
 			}
 			
 		case "disconnect":
 			// Close SSH connection
 			s.log.Info("Client requested disconnect")
+			disconnect = true
 			return
 		}
 	}
 }
 
-// forwardOutput forwards SSH output to WebSocket
-func (s *Server) forwardOutput(wsConn *websocket.Conn, reader interface{ Read([]byte) (int, error) }, streamType string) {
-	buf := make([]byte, 32*1024)
+// dialSSH connects and logs in to the SSH server at addr. For the local
+// server, the connection is announced to the registry first, so the server
+// counts failed logins and bans against clientIP instead of loopback.
+func (s *Server) dialSSH(addr string, local bool, clientIP string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if !local {
+		return ssh.Dial("tcp", addr, config)
+	}
 	
-	for {
-		n, err := reader.Read(buf)
+	conn, err := net.DialTimeout("tcp", addr, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	release := s.registry.ExpectProxy(conn.LocalAddr().String(), clientIP)
+	defer release()
+	
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// writeInput forwards terminal input from the client to the shell
+func (s *Server) writeInput(wsConn *clientConn, term *terminalSession, data []byte) {
+	if term == nil {
+		s.sendError(wsConn, "Not connected to SSH server")
+		return
+	}
+	
+	term.lease.Touch()
+	term.entry.CountIn(len(data))
+	if _, err := term.stdin.Write(data); err != nil {
+		s.log.WithError(err).Error("Failed to write to SSH stdin")
+		s.sendError(wsConn, fmt.Sprintf("Write failed: %v", err))
+	}
+}
+
+// connectSSH opens an SSH connection and shell for a "connect" message and
+// registers it as a resumable session attached to wsConn. It reports errors to
+// the client and returns nil on failure.
+func (s *Server) connectSSH(wsConn *clientConn, clientIP string, msg WSMessage, grant *pairing.Grant) *terminalSession {
+	// Refuse banned clients before doing any work for them
+	if err := s.guard.Check(clientIP, msg.Username); err != nil {
+		s.log.WithFields(logrus.Fields{
+			"client_ip": clientIP,
+			"username":  msg.Username,
+		}).Warn("SSH connection refused: login source is banned")
+		s.sendAuthFailed(wsConn, "Too many failed login attempts, try again later")
+		wsConn.close()
+		return nil
+	}
+	
+	// Connect to the local SSH server, or jump to another mesh peer if the
+	// jump policy allows it
+	addr, local, err := s.target(msg)
+	if err != nil {
+		s.log.WithError(err).WithFields(logrus.Fields{
+			"client_ip": clientIP,
+			"host":      msg.Host,
+			"port":      msg.Port,
+		}).Warn("SSH connection refused: destination not permitted")
+		s.sendConnectFailed(wsConn, fmt.Sprintf("Destination not permitted: %s", net.JoinHostPort(msg.Host, strconv.Itoa(msg.Port))))
+		return nil
+	}
+	
+	// Check the terminal, environment and command before connecting
+	params, err := s.sessionParams(msg, local)
+	if err != nil {
+		s.log.WithError(err).WithField("client_ip", clientIP).Warn("SSH connection refused: invalid session parameters")
+		s.sendConnectFailed(wsConn, fmt.Sprintf("Invalid session parameters: %v", err))
+		return nil
+	}
+	
+	// A ticket logs its device in to the local server as the user it is
+	// paired to. Jump targets check their own credentials.
+	useTicket := false
+	if grant != nil && local {
+		if msg.Username == "" {
+			msg.Username = grant.User
+		}
+		if msg.Username != grant.User {
+			s.log.WithFields(logrus.Fields{
+				"client_ip": clientIP,
+				"device":    grant.DeviceID,
+				"username":  msg.Username,
+			}).Warn("SSH connection refused: ticket is for another user")
+			s.sendAuthFailed(wsConn, fmt.Sprintf("Ticket is not valid for user %s", msg.Username))
+			return nil
+		}
+		useTicket = msg.Password == "" && msg.PrivateKey == ""
+	}
+	
+	s.log.WithFields(logrus.Fields{
+		"username": msg.Username,
+		"has_password": msg.Password != "",
+		"has_key": msg.PrivateKey != "",
+		"has_ticket": useTicket,
+		"pty": params.pty,
+		"command": params.command != "",
+	}).Info("Processing SSH connection request")
+	
+	// Create SSH client config
+	config := &ssh.ClientConfig{
+		User: msg.Username,
+		Auth: []ssh.AuthMethod{},
+		Timeout: dialTimeout,
+	}
+	if local {
+		// The local server is this process, reached over loopback
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		// Credentials are only sent to a jump target whose host key is known
+		config.HostKeyCallback = s.jumps.HostKeyCallback(msg.Host)
+	}
+	
+	if msg.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(msg.Password))
+		s.log.Info("Using password authentication")
+	}
+	
+	if msg.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(msg.PrivateKey))
 		if err != nil {
-			if err.Error() != "EOF" {
-				s.log.WithError(err).WithField("stream", streamType).Debug("SSH output stream closed")
-			}
-			break
+			s.log.WithError(err).Error("Failed to parse private key")
+			s.sendAuthFailed(wsConn, fmt.Sprintf("Invalid private key: %v", err))
+			return nil
 		}
-		
-		if n > 0 {
-			msg := WSMessage{
-				Type: "data",
-				Data: string(buf[:n]),
-			}
-			
-			if err := s.sendMessage(wsConn, msg); err != nil {
-				s.log.WithError(err).Error("Failed to send data to WebSocket")
-				break
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+		s.log.Info("Using public key authentication")
+	}
+	
+	if useTicket {
+		// The upgrade's ticket may have expired by now, so log in with a fresh one
+		ticket, err := s.tickets.Renew(*grant)
+		if err != nil {
+			s.log.WithError(err).WithField("device", grant.DeviceID).Warn("Failed to renew ticket")
+			s.sendAuthFailed(wsConn, "Device is no longer paired")
+			return nil
+		}
+		config.Auth = append(config.Auth, ssh.Password(ticket.Ticket))
+		s.log.Info("Using ticket authentication")
+	}
+	
+	if len(config.Auth) == 0 {
+		s.log.Error("No authentication method provided")
+		s.sendAuthFailed(wsConn, "No authentication method provided (password or private key required)")
+		return nil
+	}
+	
+	// Users with TOTP enabled are asked for a code after the first factor
+	otpRequired := false
+	config.Auth = append(config.Auth, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) == 0 {
+			return nil, nil
+		}
+		if msg.OTP == "" {
+			otpRequired = true
+			return nil, fmt.Errorf("verification code required")
+		}
+		answers := make([]string, len(questions))
+		for i := range answers {
+			answers[i] = msg.OTP
+		}
+		return answers, nil
+	}))
+	
+	// Connect to SSH server
+	s.log.WithFields(logrus.Fields{
+		"address": addr,
+		"jump":    !local,
+	}).Info("Connecting to SSH server")
+	
+	sshClient, err := s.dialSSH(addr, local, clientIP, config)
+	if err != nil {
+		s.log.WithError(err).Error("Failed to connect to SSH server")
+		if otpRequired {
+			// Not a failed attempt: the client has to ask the user for a code and retry
+			s.sendAuthFailed(wsConn, "Verification code required")
+			return nil
+		}
+		if isAuthError(err) {
+			// The local server counts its failures against clientIP itself
+			if !local {
+				if delay := s.guard.Failure(clientIP, msg.Username, "websocket"); delay > 0 {
+					time.Sleep(delay)
+				}
 			}
+			s.sendAuthFailed(wsConn, "Authentication failed")
+			return nil
 		}
+		s.sendConnectFailed(wsConn, fmt.Sprintf("SSH connection failed: %v", err))
+		return nil
+	}
+	if !local {
+		s.guard.Success(clientIP, msg.Username)
 	}
+	
+	// Count the session against the user's and the client's limits. The SSH
+	// server leaves proxied sessions to us, as it only sees the loopback address.
+	lease, err := s.limiter.Acquire(msg.Username, clientIP)
+	if err != nil {
+		s.sendConnectFailed(wsConn, fmt.Sprintf("Session refused: %v", err))
+		sshClient.Close()
+		return nil
+	}
+	
+	// Register the session with the real client address. The SSH server finds
+	// the entry by our end of the connection and adds what only it knows.
+	entry := s.registry.Register(msg.Username, clientIP, sessions.TransportWebSocket, sessions.Controls{})
+	if local {
+		entry.SetProxyAddr(sshClient.LocalAddr().String())
+	}
+	
+	// Create SSH session
+	session, err := sshClient.NewSession()
+	if err != nil {
+		s.log.WithError(err).Error("Failed to create SSH session")
+		s.sendConnectFailed(wsConn, fmt.Sprintf("Failed to create session: %v", err))
+		entry.Close()
+		lease.Release()
+		sshClient.Close()
+		return nil
+	}
+	
+	// fail reports a setup error and tears down the connection
+	fail := func(logMsg, clientMsg string, err error) *terminalSession {
+		s.log.WithError(err).Error(logMsg)
+		s.sendConnectFailed(wsConn, fmt.Sprintf("%s: %v", clientMsg, err))
+		entry.Close()
+		lease.Release()
+		session.Close()
+		sshClient.Close()
+		return nil
+	}
+	
+	// Pass the environment, which servers may refuse, and request a PTY
+	for _, kv := range params.env {
+		name, value, _ := strings.Cut(kv, "=")
+		if err := session.Setenv(name, value); err != nil {
+			return fail("Failed to set environment variable", "Failed to set "+name, err)
+		}
+	}
+	if params.pty {
+		if err := session.RequestPty(params.term, params.rows, params.cols, params.modes); err != nil {
+			return fail("Failed to request PTY", "Failed to request PTY", err)
+		}
+	}
+	
+	// Get stdin/stdout pipes
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return fail("Failed to get stdin pipe", "Failed to get stdin", err)
+	}
+	
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return fail("Failed to get stdout pipe", "Failed to get stdout", err)
+	}
+	
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		return fail("Failed to get stderr pipe", "Failed to get stderr", err)
+	}
+	
+	// Start the shell or the command
+	if params.command == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(params.command)
+	}
+	if err != nil {
+		return fail("Failed to start shell", "Failed to start shell", err)
+	}
+	
+	term, err := s.newTerminalSession(msg.Username, grant, sshClient, session, stdin, params.pty, lease, entry)
+	if err != nil {
+		return fail("Failed to create terminal session", "Failed to create session", err)
+	}
+	term.attach(wsConn, 0, false)
+	
+	// Send connected message with what the client needs to resume later
+	s.sendMessage(wsConn, WSMessage{
+		Type:        "connected",
+		Message:     "SSH connection established",
+		SessionID:   term.id,
+		ResumeToken: term.token,
+	})
+	
+	// Forward SSH output to the attached WebSocket
+	go term.forwardOutput(stdout, frameData)
+	go term.forwardOutput(stderr, frameStderr)
+	
+	// Warn the client before an idle or lifetime timeout or an administrator
+	// ends the session
+	warn := func(message string) {
+		term.notify(WSMessage{Type: "warning", Message: message})
+	}
+	lease.Enforce(warn, term.end)
+	entry.SetControls(sessions.Controls{Notify: warn, Terminate: term.end})
+	
+	s.log.WithFields(logrus.Fields{
+		"session": term.id,
+		"user":    term.user,
+	}).Info("SSH session established")
+	return term
 }
 
-// sendMessage sends a message to the WebSocket client
-func (s *Server) sendMessage(conn *websocket.Conn, msg WSMessage) error {
+// target returns the SSH server to connect to for a "connect" message and
+// whether it is the local one. Messages naming no host, or an address of this
+// machine, go to the local server whatever their port; other hosts must be
+// allowed by the jump policy, on port 22 unless the message gives one.
+func (s *Server) target(msg WSMessage) (string, bool, error) {
+	if isLocalHost(msg.Host) {
+		return net.JoinHostPort(s.config.SSHHost, strconv.Itoa(s.config.SSHPort)), true, nil
+	}
+	
+	port := msg.Port
+	if port == 0 {
+		port = defaultJumpPort
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, resolveTimeout)
+	defer cancel()
+	addr, err := s.jumps.Permit(ctx, msg.Host, port)
+	return addr, false, err
+}
+
+// isLocalHost reports whether host is empty, "localhost" or an address of this machine
+func isLocalHost(host string) bool {
+	if host == "" || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuthError reports whether an ssh.Dial error was an authentication failure
+func isAuthError(err error) bool {
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// sendMessage queues a message for the WebSocket client
+func (s *Server) sendMessage(conn *clientConn, msg WSMessage) error {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
 	
-	return conn.WriteMessage(websocket.TextMessage, data)
+	return conn.send(websocket.TextMessage, data)
 }
 
-// sendError sends an error message to the WebSocket client
-func (s *Server) sendError(conn *websocket.Conn, errMsg string) {
+// sendError queues an error message for the WebSocket client
+func (s *Server) sendError(conn *clientConn, errMsg string) {
 	msg := WSMessage{
 		Type:    "error",
 		Message: errMsg,
 	}
 	s.sendMessage(conn, msg)
 }
+
+// sendAuthFailed tells the WebSocket client that a "connect" was refused for
+// its credentials, so it can ask the user for them again
+func (s *Server) sendAuthFailed(conn *clientConn, errMsg string) {
+	s.sendMessage(conn, WSMessage{Type: "auth_failed", Message: errMsg})
+}
+
+// sendConnectFailed tells the WebSocket client that a "connect" failed for any
+// other reason, such as the destination being unreachable or not permitted
+func (s *Server) sendConnectFailed(conn *clientConn, errMsg string) {
+	s.sendMessage(conn, WSMessage{Type: "connect_failed", Message: errMsg})
+}
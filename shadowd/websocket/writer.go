@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeQueueSize is how many bytes may wait to be written to a client before
+// the shell's output is no longer read, leaving the SSH channel's flow control
+// to throttle the shell
+const writeQueueSize = 256 * 1024
+
+// errConnClosed is returned when sending to a connection that is closed
+var errConnClosed = errors.New("websocket connection closed")
+
+// frame is a message waiting to be written
+type frame struct {
+	messageType int
+	data        []byte
+}
+
+// clientConn is a client's WebSocket connection. gorilla/websocket allows only
+// one writer at a time, so every message goes through a queue that a single
+// goroutine writes out, each write bounded by writeTimeout. Reads, Close and
+// control frames still use the connection directly.
+type clientConn struct {
+	conn   *websocket.Conn
+	binary bool // negotiated the binary protocol
+
+	mu       sync.Mutex
+	cond     *sync.Cond // signalled when the queue shrinks or the connection closes
+	queue    []frame
+	queued   int // bytes in queue
+	closing  bool
+	closed   bool
+	deadline time.Time // for the remaining writes once closing
+}
+
+// newClientConn wraps conn and starts its writer
+func newClientConn(conn *websocket.Conn) *clientConn {
+	c := &clientConn{
+		conn:   conn,
+		binary: isBinary(conn),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.run()
+	return c
+}
+
+// send queues a message. It never blocks; producers that can wait call
+// waitWritable first so the queue stays bounded.
+func (c *clientConn) send(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing || c.closed {
+		return errConnClosed
+	}
+	c.queue = append(c.queue, frame{messageType: messageType, data: data})
+	c.queued += len(data)
+	c.cond.Broadcast()
+	return nil
+}
+
+// waitWritable blocks while the queue is full. It returns at once for a nil
+// connection, and when the connection closes.
+func (c *clientConn) waitWritable() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.queued >= writeQueueSize && !c.closing && !c.closed {
+		c.cond.Wait()
+	}
+}
+
+// close stops accepting messages, writes out those already queued within
+// writeTimeout and closes the connection with a close frame
+func (c *clientConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing || c.closed {
+		return
+	}
+	c.closing = true
+	c.deadline = time.Now().Add(writeTimeout)
+	c.cond.Broadcast()
+}
+
+// abort closes the connection without writing out the queue
+func (c *clientConn) abort() {
+	c.mu.Lock()
+	c.closed = true
+	c.queue, c.queued = nil, 0
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	c.conn.Close()
+}
+
+// run writes queued messages until the connection is closed or a write fails
+func (c *clientConn) run() {
+	for {
+		c.mu.Lock()
+		for len(c.queue) == 0 && !c.closing && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed || len(c.queue) == 0 {
+			// Closed, or closing with nothing left to write
+			graceful := !c.closed
+			c.mu.Unlock()
+			if graceful {
+				c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), c.deadline)
+			}
+			c.abort()
+			return
+		}
+		next := c.queue[0]
+		c.queue[0] = frame{}
+		c.queue = c.queue[1:]
+		deadline := time.Now().Add(writeTimeout)
+		if c.closing {
+			deadline = c.deadline
+		}
+		c.mu.Unlock()
+
+		c.conn.SetWriteDeadline(deadline)
+		err := c.conn.WriteMessage(next.messageType, next.data)
+
+		c.mu.Lock()
+		c.queued -= len(next.data)
+		c.cond.Broadcast()
+		c.mu.Unlock()
+
+		if err != nil {
+			// The read loop sees the closed connection and detaches the session
+			c.abort()
+			return
+		}
+	}
+}
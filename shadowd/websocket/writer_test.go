@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// queuedBytes returns the bytes waiting in c's queue
+func (c *clientConn) queuedBytes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queued
+}
+
+// produce sends count messages of size bytes from each of writers concurrent
+// goroutines, waiting for room first as the session's output does. Each
+// message starts with "writer seq ". It returns the largest queue seen.
+func produce(c *clientConn, writers, count, size int) (int, error) {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		maxQueue int
+		firstErr error
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for seq := 0; seq < count; seq++ {
+				msg := make([]byte, size)
+				copy(msg, fmt.Sprintf("%d %d ", w, seq))
+				c.waitWritable()
+				err := c.send(websocket.BinaryMessage, msg)
+				queued := c.queuedBytes()
+
+				mu.Lock()
+				if queued > maxQueue {
+					maxQueue = queued
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	return maxQueue, firstErr
+}
+
+func TestClientConnBackpressure(t *testing.T) {
+	const (
+		writers = 4
+		count   = 128
+		size    = 64 * 1024 // 32MB in all, well past the socket buffers
+	)
+	conn, client := connPair(t)
+	c := newClientConn(conn)
+	defer c.abort()
+
+	type result struct {
+		maxQueue int
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		maxQueue, err := produce(c, writers, count, size)
+		done <- result{maxQueue, err}
+	}()
+
+	// While the client reads nothing, the writers stall on a full queue
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case r := <-done:
+		t.Fatalf("writers finished (%v) while the client read nothing", r.err)
+	default:
+	}
+	if queued := c.queuedBytes(); queued < writeQueueSize || queued > writeQueueSize+writers*size {
+		t.Errorf("queued %d bytes while stalled, want about %d", queued, writeQueueSize)
+	}
+
+	// A slow reader gets every message, each writer's in order
+	next := make([]int, writers)
+	for received := 0; received < writers*count; received++ {
+		if received%64 == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		client.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("read after %d messages: %v", received, err)
+		}
+		if len(data) != size {
+			t.Fatalf("message %d is %d bytes, want %d", received, len(data), size)
+		}
+		var w, seq int
+		if _, err := fmt.Sscanf(string(data), "%d %d ", &w, &seq); err != nil || w < 0 || w >= writers {
+			t.Fatalf("message %d is garbled: %q", received, data[:16])
+		}
+		if seq != next[w] {
+			t.Fatalf("writer %d: got message %d, want %d", w, seq, next[w])
+		}
+		next[w]++
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.maxQueue > writeQueueSize+writers*size {
+		t.Errorf("queue grew to %d bytes, want at most %d", r.maxQueue, writeQueueSize+writers*size)
+	}
+}
+
+func TestClientConnOverflow(t *testing.T) {
+	timeout := writeTimeout
+	writeTimeout = 100 * time.Millisecond
+	defer func() { writeTimeout = timeout }()
+
+	conn, client := connPair(t)
+	c := newClientConn(conn)
+	defer c.abort()
+
+	// The client never reads, so once the socket buffers fill a write times
+	// out and the connection is closed, releasing the waiting writers
+	done := make(chan error, 1)
+	go func() {
+		_, err := produce(c, 4, 1024, 64*1024)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errConnClosed) {
+			t.Fatalf("writers ended with %v, want %v", err, errConnClosed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("writers still blocked on a client that reads nothing")
+	}
+
+	// The client finds the connection closed once it drains what was sent
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if _, _, err := client.ReadMessage(); err != nil {
+			if isTimeout(err) {
+				t.Fatal("connection to the client left open")
+			}
+			break
+		}
+	}
+}
+
+func TestClientConnClose(t *testing.T) {
+	conn, client := connPair(t)
+	c := newClientConn(conn)
+
+	for _, msg := range []string{"one", "two", "three"} {
+		if err := c.send(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.close()
+	if err := c.send(websocket.TextMessage, []byte("late")); !errors.Is(err, errConnClosed) {
+		t.Errorf("send after close = %v, want %v", err, errConnClosed)
+	}
+	c.waitWritable() // returns at once once closing
+
+	// Messages queued before close are written out, then a close frame
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got []string
+	for {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Errorf("read error = %v, want a normal close", err)
+			}
+			break
+		}
+		got = append(got, string(data))
+	}
+	if strings.Join(got, " ") != "one two three" {
+		t.Errorf("client got %q, want one, two, three", got)
+	}
+}